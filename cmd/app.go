@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var appCmd = &cobra.Command{
+	Use:   "app <appName> <domains...>",
+	Short: "Issue an app cert, also for app names taken by a command",
+	Long: `Issue an app cert like crtforge <appName> <domains...>.
+App names that equal a command, e.g. proxy, serve or root, run the command
+in the short form, so they have to be issued with crtforge app.`,
+	Args: cobra.MinimumNArgs(2),
+	Run:  rootRun,
+}
+
+func init() {
+	rootCmd.AddCommand(appCmd)
+
+	addAppFlags(appCmd)
+
+	appCmd.Example = `Generate a cert for an app named proxy:
+crtforge app proxy proxy.crtforge.com [flags]`
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var importCrtFile string
+var importKeyFile string
+var importCaName string
+
+// caCmd groups the commands that manage certificate authorities
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage certificate authorities",
+}
+
+var caImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import an existing CA",
+	Long: `Import an existing CA certificate and key into crtforge.
+A self-signed certificate is imported as a root ca, any other ca certificate
+is imported as an intermediate ca under the root ca selected with --root-ca.`,
+	Run: caImportRun,
+}
+
+func caImportRun(cmd *cobra.Command, args []string) {
+	if importCrtFile == "" || importKeyFile == "" || importCaName == "" {
+		log.Fatal("--cert, --key and --name are required.")
+	}
+
+	services.ImportCa(services.ImportCAOptions{
+		ConfigDirectory:     getConfigDirectory(),
+		CACrt:               importCrtFile,
+		CAKey:               importKeyFile,
+		Name:                importCaName,
+		RootCAName:          caName,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caImportCmd)
+
+	// Files of the ca to import
+	caImportCmd.Flags().StringVar(&importCrtFile, "cert", "", "CA certificate file to import.")
+	caImportCmd.Flags().StringVar(&importKeyFile, "key", "", "CA private key file to import.")
+
+	// Name of the imported ca
+	caImportCmd.Flags().StringVar(&importCaName, "name", "", "Name of the imported CA.")
+
+	// Select the root ca of an imported intermediate ca
+	caImportCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set the Root CA of an imported Intermediate CA.")
+
+	// Subject attributes written to the generated cnf files
+	addCaSubjectFlags(caImportCmd)
+
+	caImportCmd.Example = `Import an mkcert root and use it as the corp root ca:
+crtforge ca import --cert "$(mkcert -CAROOT)/rootCA.pem" --key "$(mkcert -CAROOT)/rootCA-key.pem" --name corp
+crtforge -r corp crtforgeapp crtforge.com
+
+Import an intermediate ca under the corp root ca:
+crtforge ca import -r corp --cert team.crt --key team.key --name team`
+}
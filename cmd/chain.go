@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var chainLeafFile string
+var chainPool []string
+var chainOutput string
+var chainCaFile string
+
+// chainCmd groups the commands that work on cert chains
+var chainCmd = &cobra.Command{
+	Use:   "chain",
+	Short: "Build and repair cert chains",
+}
+
+var chainBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build the ordered chain of a leaf cert",
+	Long: `Build the ordered chain of a leaf cert.
+The chain is written leaf first, followed by its issuers up to the root like a
+fullchain.crt. Issuers are matched by name, key id and signature, from the
+other certs of the leaf file, the certs of the pool and the intermediate cas of
+the root ca. Duplicates and unrelated certs are dropped. A warning is logged
+when the chain does not reach the root ca.`,
+	Run: chainBuildRun,
+}
+
+func chainBuildRun(cmd *cobra.Command, args []string) {
+	if chainLeafFile == "" {
+		log.Fatal("--leaf is required.")
+	}
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	rootCaCrt := chainCaFile
+	if rootCaCrt == "" {
+		rootCaDir := defaultCADir + "/rootCA"
+		rootCaCrt = rootCaDir + "/rootCA.crt"
+		// During a rollover the trust bundle has the old and the new root ca
+		if _, err := os.Stat(rootCaDir + "/trust-bundle.crt"); err == nil {
+			rootCaCrt = rootCaDir + "/trust-bundle.crt"
+		}
+	}
+	services.BuildChain(services.BuildChainOptions{
+		Leaf:      chainLeafFile,
+		Pool:      chainPool,
+		CADir:     defaultCADir,
+		RootCACrt: rootCaCrt,
+		Output:    chainOutput,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(chainCmd)
+	chainCmd.AddCommand(chainBuildCmd)
+
+	chainBuildCmd.Flags().StringVar(&chainLeafFile, "leaf", "", "Leaf crt file, or a bundle with the leaf cert.")
+	chainBuildCmd.Flags().StringSliceVar(&chainPool, "pool", nil, "Files and dirs with issuer certs, may be repeated.")
+	chainBuildCmd.Flags().StringVarP(&chainOutput, "output", "o", "", "Chain file. Defaults to stdout.")
+	chainBuildCmd.Flags().StringVar(&chainCaFile, "ca-file", "", "Root ca crt file the chain has to reach, instead of the root ca of --root-ca.")
+	chainBuildCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	chainBuildCmd.Example = `crtforge chain build --leaf app.crt --pool certs/ -o fullchain.crt
+crtforge chain build --leaf broken-bundle.pem -r corp > fullchain.crt`
+}
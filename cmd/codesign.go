@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var codesignName string
+var codesignKeyType string
+var signFileSigner string
+var signFileCrt string
+var signFileKey string
+var signFileChain string
+var signFileOutput string
+var verifyFileSignature string
+var verifyFileCaFile string
+
+var codesignCmd = &cobra.Command{
+	Use:   "codesign \"Example Corp\"",
+	Short: "Issue a code signing cert",
+	Long: `Issue a code signing cert.
+The name is the common name of the cert, which has no SANs and is only valid
+for code signing. Sign files with it using sign-file.`,
+	Args: cobra.ExactArgs(1),
+	Run:  codesignRun,
+}
+
+var signFileCmd = &cobra.Command{
+	Use:   "sign-file <file>",
+	Short: "Write a detached CMS signature of a file",
+	Long: `Write a detached CMS signature of a file.
+The signature is a DER encoded PKCS#7 SignedData without the content, signed
+with the key of a code signing cert and carrying its intermediate ca. It is
+written next to the file with a .p7s suffix unless --output is set.`,
+	Args: cobra.ExactArgs(1),
+	Run:  signFileRun,
+}
+
+var verifyFileCmd = &cobra.Command{
+	Use:   "verify-file <file>",
+	Short: "Verify a detached CMS signature of a file",
+	Long: `Verify a detached CMS signature of a file.
+The signature has to match the file and its signer has to be a code signing
+cert issued under the root ca, or under a root of its trust bundle during a
+rollover.`,
+	Args: cobra.ExactArgs(1),
+	Run:  verifyFileRun,
+}
+
+func codesignRun(cmd *cobra.Command, args []string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	if outputDir == "" {
+		outputDir = defaultCADir
+	}
+	services.CreateCodesignCrt(services.CreateCodesignCrtOptions{
+		Name: args[0],
+		AppCrt: services.CreateAppCrtOptions{
+			OutputDir:          outputDir,
+			IntermediateCACnf:  intermediateCA.IntermediateCACnf,
+			IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+			RootCACrt:          defaultCARootCACrt,
+			AppName:            codesignName,
+			KeyType:            codesignKeyType,
+			SignatureAlgorithm: signatureAlgorithm,
+		},
+	})
+}
+
+func signFileRun(cmd *cobra.Command, args []string) {
+	if signFileSigner == "" && (signFileCrt == "" || signFileKey == "") {
+		log.Fatal("Set the code signing cert with --signer, or with --cert and --key.")
+	}
+	if signFileSigner != "" {
+		signerDir := services.CreateCaDir(getConfigDirectory(), caName) + "/" + signFileSigner
+		if signFileCrt == "" {
+			signFileCrt = signerDir + "/" + signFileSigner + ".crt"
+		}
+		if signFileKey == "" {
+			signFileKey = signerDir + "/" + signFileSigner + ".key"
+		}
+		if signFileChain == "" {
+			signFileChain = signerDir + "/fullchain.crt"
+		}
+	}
+	services.SignFile(services.SignFileOptions{
+		File:      args[0],
+		Output:    signFileOutput,
+		SignerCrt: signFileCrt,
+		SignerKey: signFileKey,
+		ChainCrt:  signFileChain,
+	})
+}
+
+func verifyFileRun(cmd *cobra.Command, args []string) {
+	rootCaCrt := verifyFileCaFile
+	if rootCaCrt == "" {
+		rootCaDir := services.CreateCaDir(getConfigDirectory(), caName) + "/rootCA"
+		rootCaCrt = rootCaDir + "/rootCA.crt"
+		// During a rollover the trust bundle has the old and the new root ca
+		if _, err := os.Stat(rootCaDir + "/trust-bundle.crt"); err == nil {
+			rootCaCrt = rootCaDir + "/trust-bundle.crt"
+		}
+	}
+	signer, err := services.VerifyFile(services.VerifyFileOptions{
+		File:      args[0],
+		Signature: verifyFileSignature,
+		RootCACrt: rootCaCrt,
+	})
+	if err != nil {
+		log.Fatal("Verification failed: ", err)
+	}
+	log.Info("Verified OK, signed by ", signer.Subject.String())
+}
+
+func init() {
+	rootCmd.AddCommand(codesignCmd, signFileCmd, verifyFileCmd)
+
+	codesignCmd.Flags().StringVar(&codesignName, "name", "", "Name of the cert files. Defaults to the common name.")
+	codesignCmd.Flags().StringVar(&codesignKeyType, "key-type", "rsa", "Key type of the cert: rsa or ecdsa.")
+	codesignCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	codesignCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	codesignCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
+	addCaSubjectFlags(codesignCmd)
+	addSignatureAlgorithmFlag(codesignCmd)
+
+	signFileCmd.Flags().StringVar(&signFileSigner, "signer", "", "Name of a code signing cert of the root ca.")
+	signFileCmd.Flags().StringVar(&signFileCrt, "cert", "", "Code signing crt file, instead of --signer.")
+	signFileCmd.Flags().StringVar(&signFileKey, "key", "", "Key file of the code signing cert, instead of --signer.")
+	signFileCmd.Flags().StringVar(&signFileChain, "chain", "", "Pem file with the intermediate ca certs to add to the signature.")
+	signFileCmd.Flags().StringVarP(&signFileOutput, "output", "o", "", "Signature file. Defaults to the file with a .p7s suffix.")
+	signFileCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	verifyFileCmd.Flags().StringVarP(&verifyFileSignature, "signature", "s", "", "Signature file. Defaults to the file with a .p7s suffix.")
+	verifyFileCmd.Flags().StringVar(&verifyFileCaFile, "ca-file", "", "Root ca crt file to verify against, instead of the root ca of --root-ca.")
+	verifyFileCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	codesignCmd.Example = `crtforge codesign "Example Corp" --name release -r signing
+crtforge sign-file dist/app.tar.gz --signer release -r signing
+crtforge verify-file dist/app.tar.gz -r signing
+
+Verify with openssl:
+openssl cms -verify -binary -inform DER -in dist/app.tar.gz.p7s -content dist/app.tar.gz -CAfile ~/.config/crtforge/signing/rootCA/rootCA.crt -purpose any`
+	signFileCmd.Example = `crtforge sign-file dist/app.tar.gz --signer release -r signing
+crtforge sign-file app.exe --cert signer.crt --key signer.key --chain fullchain.crt -o app.exe.p7s`
+	verifyFileCmd.Example = `crtforge verify-file dist/app.tar.gz -r signing
+crtforge verify-file app.exe --signature app.exe.p7s --ca-file rootCA.crt`
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var convertFrom string
+var convertTo string
+var convertOutput string
+var convertKey string
+var convertKeyOutput string
+var convertPassword string
+var convertOutPassword string
+var convertAlias string
+
+var convertCmd = &cobra.Command{
+	Use:   "convert <input>",
+	Short: "Convert certs and keys between pem, der, pkcs12, pkcs7 and jks",
+	Long: `Convert certs and keys between pem, der, pkcs12, pkcs7 and jks.
+The input format is detected from the content and the output format from the
+extension of the output file, unless they are set with --from and --to. A key
+has to match one of the certs, which is written first followed by its chain in
+issuing order. Certs without a key, like trust stores, keep their order unless
+they form a single chain.
+
+Formats: ` + strings.Join(services.ConvertFormats, ", "),
+	Args: cobra.ExactArgs(1),
+	Run:  convertRun,
+}
+
+func convertRun(cmd *cobra.Command, args []string) {
+	if convertPassword == "" {
+		convertPassword = os.Getenv("CRTFORGE_PFX_PASSWORD")
+	}
+	services.Convert(services.ConvertOptions{
+		Input:       args[0],
+		From:        convertFrom,
+		Key:         convertKey,
+		Password:    convertPassword,
+		Output:      convertOutput,
+		To:          convertTo,
+		KeyOutput:   convertKeyOutput,
+		OutPassword: convertOutPassword,
+		Alias:       convertAlias,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(convertCmd)
+
+	convertCmd.Flags().StringVarP(&convertOutput, "output", "o", "", "Output file.")
+	convertCmd.Flags().StringVar(&convertFrom, "from", "", "Input format. Detected from the content when empty.")
+	convertCmd.Flags().StringVar(&convertTo, "to", "", "Output format. Derived from the output file extension when empty.")
+	convertCmd.Flags().StringVar(&convertKey, "key", "", "Private key file of the input certs.")
+	convertCmd.Flags().StringVar(&convertKeyOutput, "key-out", "", "Write the private key to a separate file, e.g. for der and pkcs7 output.")
+	convertCmd.Flags().StringVar(&convertPassword, "password", "", "Password of the input and its key. Defaults to CRTFORGE_PFX_PASSWORD, changeit for jks.")
+	convertCmd.Flags().StringVar(&convertOutPassword, "out-password", "", "Password of the output. Keystores default to --password or changeit, pem and der keys are only encrypted with it.")
+	convertCmd.Flags().StringVar(&convertAlias, "alias", "", "Alias of the key in jks keystores. Defaults to the common name of the cert.")
+
+	convertCmd.Example = `crtforge convert app.pfx -o app.pem --password secret
+crtforge convert app.crt --key app.key -o app.jks --out-password changeit
+crtforge convert chain.p7b -o chain.pem
+crtforge convert truststore.jks -o ca-bundle.crt --password changeit
+crtforge convert app.pem -o app.der --key-out app.pkcs8.der`
+}
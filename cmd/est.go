@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var estUsername string
+var estPassword string
+var estListenAddress string
+
+// estCmd groups the EST enrollment commands
+var estCmd = &cobra.Command{
+	Use:   "est",
+	Short: "Enroll devices with EST (RFC 7030)",
+}
+
+var estServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve EST enrollment for an intermediate ca",
+	Long: `Serve EST enrollment for an intermediate ca.
+Devices get the ca certs from /.well-known/est/cacerts and enroll with
+/.well-known/est/simpleenroll, authenticated with http basic auth or a client
+cert. /.well-known/est/simplereenroll renews the client cert of a device.`,
+	Run: estServeRun,
+}
+
+func estServeRun(cmd *cobra.Command, args []string) {
+	if estUsername != "" && estPassword == "" {
+		estPassword = os.Getenv("CRTFORGE_EST_PASSWORD")
+	}
+	if estUsername != "" && estPassword == "" {
+		log.Fatal("--password or CRTFORGE_EST_PASSWORD is required with --username.")
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	if tlsCrtFile == "" || tlsKeyFile == "" {
+		tlsCrtFile, tlsKeyFile = issueServerCrt("crtforge-est", serveHostnames)
+	}
+	// Devices reenroll with the certs issued under the root ca
+	if clientCaCrtFile == "" {
+		clientCaCrtFile = defaultCARootCACrt
+	}
+
+	services.ServeEst(services.EstServerOptions{
+		Listen:            estListenAddress,
+		TLSCrt:            tlsCrtFile,
+		TLSKey:            tlsKeyFile,
+		ClientCACrt:       clientCaCrtFile,
+		Username:          estUsername,
+		Password:          estPassword,
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         defaultCARootCACrt,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(estCmd)
+	estCmd.AddCommand(estServeCmd)
+
+	estServeCmd.Flags().StringVar(&estListenAddress, "listen", ":9443", "Address to listen on.")
+	estServeCmd.Flags().StringVar(&estUsername, "username", "", "Http basic auth username for enrollment.")
+	estServeCmd.Flags().StringVar(&estPassword, "password", "", "Http basic auth password. Defaults to CRTFORGE_EST_PASSWORD.")
+	estServeCmd.Flags().StringVar(&clientCaCrtFile, "client-ca", "", "CA crt file to verify client certs with. Defaults to the Root CA.")
+
+	// Server cert and the ca that signs the enrollments
+	estServeCmd.Flags().StringVar(&tlsCrtFile, "tls-cert", "", "Server crt file. Issued by the selected ca when empty.")
+	estServeCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "Server key file.")
+	estServeCmd.Flags().StringSliceVar(&serveHostnames, "hostname", []string{"localhost", "127.0.0.1"}, "Names of the issued server cert.")
+	estServeCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	estServeCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	addCaSubjectFlags(estServeCmd)
+
+	estCmd.Example = `crtforge est serve -r lab -i devices --username device --password secret
+
+Enroll with curl:
+openssl req -new -newkey rsa:2048 -nodes -keyout device.key -subj /CN=device1 -outform DER | base64 > device.b64
+curl --cacert ~/.config/crtforge/lab/rootCA/rootCA.crt -u device:secret \
+  -H "Content-Type: application/pkcs10" --data-binary @device.b64 \
+  https://localhost:9443/.well-known/est/simpleenroll`
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var fixturesOutputDir string
+var fixturesHostname string
+var fixturesIntermediateCaName string
+
+var fixturesCmd = &cobra.Command{
+	Use:   "fixtures",
+	Short: "Create deliberately broken certs to test tls clients with",
+	Long: `Create deliberately broken certs to test tls clients with.
+The fixtures are signed by a dedicated intermediate ca: expired, not-yet-valid,
+wrong-hostname, missing-intermediate, self-signed, revoked, weak-key, wrong-eku
+and ca-leaf, next to a valid control cert. manifest.json lists what a correct
+client should reject each fixture for. The fixtures skip the issuance
+policies and name constraints, keep their intermediate ca for fixtures only.`,
+	Run: fixturesRun,
+}
+
+func fixturesRun(cmd *cobra.Command, args []string) {
+	// Fixtures are recorded and revoked in their own intermediate ca
+	intermediateCaName = fixturesIntermediateCaName
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	services.CreateFixtures(services.CreateFixturesOptions{
+		OutputDir:         fixturesOutputDir,
+		Hostname:          fixturesHostname,
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         defaultCARootCACrt,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(fixturesCmd)
+
+	fixturesCmd.Flags().StringVarP(&fixturesOutputDir, "output", "o", "fixtures", "Directory to write the fixtures and the manifest to.")
+	fixturesCmd.Flags().StringVar(&fixturesHostname, "hostname", "localhost", "Name the clients connect to in the tests.")
+	fixturesCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	fixturesCmd.Flags().StringVarP(&fixturesIntermediateCaName, "intermediate-ca", "i", "fixtures", "Set Intermediate CA Name of the fixtures.")
+	addCaSubjectFlags(fixturesCmd)
+
+	fixturesCmd.Example = `crtforge fixtures -r testing --hostname localhost -o testdata/tls
+
+Check a fixture:
+openssl verify -CAfile testdata/tls/rootCA.crt -untrusted testdata/tls/expired/fullchain.crt testdata/tls/expired/expired.crt`
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var csrFile string
+var rootDir string
+var signedCrtFile string
+var rootCrtFile string
+var reissueLeaves bool
+var leafDirs []string
+var forceRotate bool
+
+// intermediateCmd groups the commands that manage intermediate cas
+var intermediateCmd = &cobra.Command{
+	Use:   "intermediate",
+	Short: "Manage intermediate certificate authorities",
+}
+
+var intermediateCsrCmd = &cobra.Command{
+	Use:   "csr",
+	Short: "Create an intermediate ca key and csr without signing it",
+	Run:   intermediateCsrRun,
+}
+
+var intermediateSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Sign an intermediate ca csr with a root ca",
+	Long: `Sign an intermediate ca csr with a root ca.
+Run it where the root ca key is kept. The root ca directory can live outside
+of the crtforge config directory, for example on a removable disk.`,
+	Run: intermediateSignRun,
+}
+
+var intermediateInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install a signed intermediate ca crt",
+	Run:   intermediateInstallRun,
+}
+
+var intermediateRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace an intermediate ca with a new key and crt",
+	Long: `Replace an intermediate ca with a new key and crt under the same root ca.
+The old intermediate ca is archived and stays valid, so existing fullchain
+files keep working. With --reissue, every leaf signed by the old intermediate
+ca is reissued with the same SANs. An intermediate ca that signed other
+intermediate cas is only rotated with --force.`,
+	Run: intermediateRotateRun,
+}
+
+func intermediateCsrRun(cmd *cobra.Command, args []string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	intermediateCA := services.CreateIntermediateCsr(services.CreateIntermediateCAOptions{
+		ConfigDirectory:     defaultCADir,
+		IntermediateCAName:  intermediateCaName,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+		NameConstraints:     nameConstraints(),
+		SignatureAlgorithm:  intermediateSignatureAlgorithm,
+	})
+
+	log.Info("Intermediate CA Csr created successfully.")
+	log.Info("Intermediate CA Csr: ", intermediateCA.IntermediateCACsr)
+	log.Info("Sign it with the root ca, then run: crtforge intermediate install -r ", caName, " -i ", intermediateCaName, " --cert signed.crt")
+}
+
+func intermediateSignRun(cmd *cobra.Command, args []string) {
+	if csrFile == "" {
+		log.Fatal("--csr is required.")
+	}
+
+	// Use the root ca under the config directory unless a root dir is given
+	if rootDir == "" {
+		rootDir = services.CreateCaDir(getConfigDirectory(), caName)
+	}
+	_, rootCACnf, _ := services.OpenRootCa(services.CreateRootCAOptions{
+		ConfigDirectory:     rootDir,
+		RootCAName:          caName,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+		SignatureAlgorithm:  rootSignatureAlgorithm,
+	})
+
+	if signedCrtFile == "" {
+		signedCrtFile = strings.TrimSuffix(csrFile, ".csr") + ".crt"
+	}
+	services.SignIntermediateCsr(services.SignIntermediateCSROptions{
+		RootCACnf:          rootCACnf,
+		IntermediateCACsr:  csrFile,
+		IntermediateCACrt:  signedCrtFile,
+		SignatureAlgorithm: intermediateSignatureAlgorithm,
+		PathLen:            intermediatePathLen,
+	})
+}
+
+func intermediateInstallRun(cmd *cobra.Command, args []string) {
+	if signedCrtFile == "" {
+		log.Fatal("--cert is required.")
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	services.InstallIntermediateCa(services.InstallIntermediateCAOptions{
+		ConfigDirectory:    defaultCADir,
+		IntermediateCAName: intermediateCaName,
+		IntermediateCACrt:  signedCrtFile,
+		RootCACrt:          rootCrtFile,
+	})
+}
+
+func intermediateRotateRun(cmd *cobra.Command, args []string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, defaultCARootCACnf, _ := services.CreateRootCa(services.CreateRootCAOptions{
+		ConfigDirectory:     defaultCADir,
+		RootCAName:          caName,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+	})
+
+	services.RotateIntermediateCa(services.RotateIntermediateCAOptions{
+		IntermediateCA: services.CreateIntermediateCAOptions{
+			ConfigDirectory:     defaultCADir,
+			RootCACnf:           defaultCARootCACnf,
+			IntermediateCAName:  intermediateCaName,
+			EmailAddress:        emailAddress,
+			StateOrProvinceName: stateOrProvinceName,
+			LocalityName:        localityName,
+			CountryName:         countryName,
+			BasicConstraints:    basicConstraints,
+		},
+		RootCACrt:       defaultCARootCACrt,
+		Reissue:         reissueLeaves,
+		LeafDirectories: leafDirs,
+		Force:           forceRotate,
+		Leaf: services.CreateAppCrtOptions{
+			NameTemplate:       nameTemplate,
+			KeyPassword:        appKeyPassword(),
+			SignatureAlgorithm: signatureAlgorithm,
+		},
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(intermediateCmd)
+	intermediateCmd.AddCommand(intermediateCsrCmd, intermediateSignCmd, intermediateInstallCmd, intermediateRotateCmd)
+
+	// Select custom root ca
+	intermediateCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	// Select custom intermediate ca
+	intermediateCsrCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	intermediateInstallCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	intermediateRotateCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+
+	// Subject attributes written to the generated cnf files
+	addCaSubjectFlags(intermediateCsrCmd)
+	addCaSubjectFlags(intermediateSignCmd)
+
+	// Name constraints requested in the csr
+	addNameConstraintFlags(intermediateCsrCmd)
+
+	// Csr to sign and where to find the root ca
+	intermediateSignCmd.Flags().StringVar(&csrFile, "csr", "", "Intermediate CA csr file to sign.")
+	intermediateSignCmd.Flags().StringVar(&rootDir, "root-dir", "", "Root CA directory, e.g. on a removable disk. Defaults to the Root CA under the config directory.")
+	intermediateSignCmd.Flags().StringVarP(&signedCrtFile, "output", "o", "", "Output file for the signed crt. Defaults to the csr file name with .crt extension.")
+	intermediateSignCmd.Flags().IntVar(&intermediatePathLen, "pathlen", 0, "Set how many intermediate cas may follow the signed intermediate ca, 0 lets it sign only app certs, -1 sets no limit")
+
+	// Signed crt to install
+	intermediateInstallCmd.Flags().StringVar(&signedCrtFile, "cert", "", "Signed Intermediate CA crt file.")
+	intermediateInstallCmd.Flags().StringVar(&rootCrtFile, "root-cert", "", "Root CA crt file that signed the Intermediate CA.")
+
+	// Leaves to reissue after rotation
+	intermediateRotateCmd.Flags().BoolVar(&reissueLeaves, "reissue", false, "Reissue the leaf certs signed by the old Intermediate CA.")
+	intermediateRotateCmd.Flags().StringSliceVar(&leafDirs, "leaf-dir", nil, "Additional output directories to search for leaf certs to reissue.")
+	intermediateRotateCmd.Flags().StringVar(&nameTemplate, "name-template", "", "Set the go template the leaf files were named with, e.g. {{.App}}-{{.Kind}}.{{.Ext}}")
+	intermediateRotateCmd.Flags().StringVar(&keyPassword, "key-password", "", "Set the password of reissued pkcs8-encrypted keys. Defaults to CRTFORGE_KEY_PASSWORD.")
+	intermediateRotateCmd.Flags().BoolVar(&forceRotate, "force", false, "Rotate although intermediate cas are signed by the Intermediate CA, their new leaves won't validate until they are rotated too.")
+	intermediateRotateCmd.Flags().StringVar(&signatureAlgorithm, "signature-algorithm", "", "Set the signature algorithm of the reissued leaf certs. Defaults to the one of each old leaf cert")
+
+	intermediateCmd.Example = `Rotate the frontend intermediate ca and reissue its leaf certs:
+crtforge intermediate rotate -r corp -i frontend --reissue
+
+Keep the root ca key offline:
+crtforge intermediate csr -r corp -i frontend
+crtforge intermediate sign -r corp --root-dir /media/usb/corp --csr frontend.csr -o frontend.crt
+crtforge intermediate install -r corp -i frontend --cert frontend.crt --root-cert /media/usb/corp/rootCA/rootCA.crt
+crtforge -r corp -i frontend crtforgeapp crtforge.com`
+}
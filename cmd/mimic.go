@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var mimicFrom string
+var mimicServerName string
+
+var mimicCmd = &cobra.Command{
+	Use:   "mimic [appName]",
+	Short: "Issue a lookalike of a real server cert for local mocking",
+	Long: `Issue a lookalike of a real server cert for local mocking.
+The subject, names, key type and extended key usages are copied from the cert
+of a tls endpoint or a crt file, and the lookalike is signed by the selected
+intermediate ca. Without an app name, the cert is named after the first name
+of the source cert.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  mimicRun,
+}
+
+func mimicRun(cmd *cobra.Command, args []string) {
+	if mimicFrom == "" {
+		log.Fatal("--from is required.")
+	}
+	appName := ""
+	if len(args) > 0 {
+		appName = args[0]
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	if outputDir == "" {
+		outputDir = defaultCADir
+	}
+	services.MimicCrt(services.MimicCrtOptions{
+		From:       mimicFrom,
+		ServerName: mimicServerName,
+		AppCrt: services.CreateAppCrtOptions{
+			OutputDir:          outputDir,
+			IntermediateCACnf:  intermediateCA.IntermediateCACnf,
+			IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+			RootCACrt:          defaultCARootCACrt,
+			AppName:            appName,
+			P12:                pfx,
+			Formats:            outputFormats,
+			NameTemplate:       nameTemplate,
+			KeyPassword:        appKeyPassword(),
+			SignatureAlgorithm: signatureAlgorithm,
+		},
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(mimicCmd)
+
+	mimicCmd.Flags().StringVar(&mimicFrom, "from", "", "host:port of a tls endpoint or a crt file to copy the cert of.")
+	mimicCmd.Flags().StringVar(&mimicServerName, "servername", "", "Sni name sent to the tls endpoint. Defaults to its host.")
+	mimicCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	mimicCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	mimicCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
+	mimicCmd.Flags().BoolVarP(&pfx, "pfx", "p", false, "Create pfx file.")
+	addOutputFormatFlags(mimicCmd)
+	addSignatureAlgorithmFlag(mimicCmd)
+	addCaSubjectFlags(mimicCmd)
+
+	mimicCmd.Example = `crtforge mimic --from api.example.com:443 -r mocks
+crtforge mimic payments --from prod.crt -r mocks`
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var mitmListenAddress string
+var mitmIntermediateCaName string
+var mitmUpstreamCaCrtFile string
+var mitmInsecureUpstream bool
+var mitmDumpFile string
+
+var mitmCmd = &cobra.Command{
+	Use:   "mitm",
+	Short: "Serve a debugging proxy that intercepts https traffic",
+	Long: `Serve a debugging proxy that intercepts https traffic.
+Clients use it as http proxy. The tls connections they tunnel with CONNECT are
+terminated with certs forged by a dedicated intermediate ca, and every request
+is logged. Use --dump to write the full requests and responses.
+Only clients that trust the root ca can be intercepted, and roots not created
+by crtforge are refused. Use it for your own services in a lab only.`,
+	Run: mitmRun,
+}
+
+func mitmRun(cmd *cobra.Command, args []string) {
+	// The forged certs come from their own intermediate ca
+	intermediateCaName = mitmIntermediateCaName
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	// Check an existing root before the intermediate ca is created under it
+	if _, err := os.Stat(defaultCADir + "/rootCA/rootCA.crt"); err == nil {
+		if err := services.CheckCrtforgeRootCa(defaultCADir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	services.ServeMitm(services.MitmProxyOptions{
+		Listen:            mitmListenAddress,
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         defaultCARootCACrt,
+		UpstreamCACrt:     mitmUpstreamCaCrtFile,
+		InsecureUpstream:  mitmInsecureUpstream,
+		DumpFile:          mitmDumpFile,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(mitmCmd)
+
+	mitmCmd.Flags().StringVar(&mitmListenAddress, "listen", ":8080", "Address to listen on.")
+	mitmCmd.Flags().StringVar(&mitmDumpFile, "dump", "", "File to append the full requests and responses to, - for stdout.")
+	mitmCmd.Flags().StringVar(&mitmUpstreamCaCrtFile, "upstream-ca", "", "CA crt file trusted for upstream servers next to the system roots.")
+	mitmCmd.Flags().BoolVar(&mitmInsecureUpstream, "insecure-upstream", false, "Don't verify upstream certs.")
+	mitmCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	mitmCmd.Flags().StringVarP(&mitmIntermediateCaName, "intermediate-ca", "i", "mitm", "Set Intermediate CA Name of the forged certs.")
+	addCaSubjectFlags(mitmCmd)
+
+	mitmCmd.Example = `crtforge mitm --listen :8080 -r lab --dump -
+
+Send a request through the proxy:
+curl --proxy http://localhost:8080 --cacert ~/.config/crtforge/lab/rootCA/rootCA.crt https://service.lab.internal/health`
+}
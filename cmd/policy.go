@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var policyIntermediateCaName string
+
+// policyCmd groups the commands that manage issuance policies
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage issuance policies of root and intermediate cas",
+	Long: `Manage issuance policies of root and intermediate cas.
+A policy is the policy.json file in a ca directory. Every leaf cert has to
+satisfy the policy of its root ca and of its intermediate ca.`,
+}
+
+var policyInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a policy file to edit",
+	Run:   policyInitRun,
+}
+
+var policyShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show a policy file",
+	Run:   policyShowRun,
+}
+
+// policyCaCrt returns the crt of the ca selected with --root-ca and
+// --intermediate-ca. Without --intermediate-ca the root ca is selected.
+func policyCaCrt() string {
+	defaultCADir := getConfigDirectory() + "/" + caName
+	if policyIntermediateCaName == "" {
+		return defaultCADir + "/rootCA/rootCA.crt"
+	}
+	return defaultCADir + "/" + policyIntermediateCaName + "/intermediateCA.crt"
+}
+
+func policyInitRun(cmd *cobra.Command, args []string) {
+	caCrt := policyCaCrt()
+	if _, err := os.Stat(caCrt); err != nil {
+		log.Fatal("CA not found: ", err)
+	}
+	services.InitIssuancePolicy(services.PolicyFile(caCrt))
+}
+
+func policyShowRun(cmd *cobra.Command, args []string) {
+	policyFile := services.PolicyFile(policyCaCrt())
+	policy, err := services.LoadIssuancePolicy(policyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policyJSON, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		log.Fatal("Error while encoding policy: ", err)
+	}
+	log.Info("Policy file: ", policyFile)
+	fmt.Println(string(policyJSON))
+}
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(policyInitCmd, policyShowCmd)
+
+	// Select the ca of the policy
+	policyCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	policyCmd.PersistentFlags().StringVarP(&policyIntermediateCaName, "intermediate-ca", "i", "", "Set Intermediate CA Name. The Root CA policy is used when empty.")
+
+	policyCmd.Example = `Restrict what the frontend intermediate ca issues:
+crtforge policy init -r corp -i frontend
+vi ~/.config/crtforge/corp/frontend/policy.json
+crtforge policy show -r corp -i frontend`
+}
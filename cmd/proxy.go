@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var proxyListenAddress string
+var proxyRoutes []string
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Serve a local https reverse proxy with certs issued on demand",
+	Long: `Serve a local https reverse proxy with certs issued on demand.
+Each --route maps a host name to a backend url. The proxy terminates tls with
+a cert minted by the selected intermediate ca for the requested server name
+and forwards the requests, including WebSockets, to the backend. HTTP/2 is
+served to clients that support it.`,
+	Run: proxyRun,
+}
+
+func proxyRun(cmd *cobra.Command, args []string) {
+	if len(proxyRoutes) == 0 {
+		log.Fatal("At least one --route is required.")
+	}
+	routes := map[string]*url.URL{}
+	for _, route := range proxyRoutes {
+		host, backend, found := strings.Cut(route, "=")
+		if !found || host == "" {
+			log.Fatal("Invalid route, use host=url: ", route)
+		}
+		backendUrl, err := url.Parse(backend)
+		if err != nil || (backendUrl.Scheme != "http" && backendUrl.Scheme != "https") || backendUrl.Host == "" {
+			log.Fatal("Invalid backend url of route ", host, ": ", backend)
+		}
+		routes[host] = backendUrl
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	services.ServeProxy(services.ProxyOptions{
+		Listen:            proxyListenAddress,
+		Routes:            routes,
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         defaultCARootCACrt,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+
+	proxyCmd.Flags().StringVar(&proxyListenAddress, "listen", ":443", "Address to listen on.")
+	proxyCmd.Flags().StringArrayVar(&proxyRoutes, "route", nil, "Route as host=url, e.g. app.localhost=http://127.0.0.1:3000. A *.host route matches every subdomain.")
+	proxyCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	proxyCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	addCaSubjectFlags(proxyCmd)
+
+	proxyCmd.Example = `crtforge proxy --route app.localhost=http://127.0.0.1:3000 --route api.localhost=http://127.0.0.1:8080
+
+Serve on an unprivileged port:
+crtforge proxy --listen :8443 --route "*.dev.localhost=http://127.0.0.1:5173"`
+}
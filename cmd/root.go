@@ -7,6 +7,7 @@ import (
 	"crtforge/cmd/services"
 	_ "embed"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 
@@ -24,6 +25,18 @@ var countryName string
 var stateOrProvinceName string
 var localityName string
 var basicConstraints string
+var permittedDNSDomains []string
+var excludedDNSDomains []string
+var permittedIPRanges []string
+var leafSubject services.LeafSubject
+var outputFormats []string
+var nameTemplate string
+var keyPassword string
+var rootSignatureAlgorithm string
+var intermediateSignatureAlgorithm string
+var signatureAlgorithm string
+var parentIntermediateCaName string
+var intermediatePathLen int
 
 var version = "v1.0.0"
 var commitId = "abcd"
@@ -34,8 +47,10 @@ var rootCmd = &cobra.Command{
 	Short:   "Be a local cert authority",
 	Long:    `With crtforge, you can create root, intermediate and application ca.`,
 	Version: version + " " + commitId,
-	PreRun:  toggleDebug,
-	Run:     rootRun,
+	Args:    cobra.ArbitraryArgs,
+	// PersistentPreRun so that subcommands honour the debug flag as well
+	PersistentPreRun: toggleDebug,
+	Run:              rootRun,
 }
 
 func rootRun(cmd *cobra.Command, args []string) {
@@ -47,12 +62,7 @@ func rootRun(cmd *cobra.Command, args []string) {
 	appName := args[0]
 	appDomains := args[1:]
 
-	homeDirectory, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatal("home directory couldn't find", err)
-	}
-	configDirectory := homeDirectory + "/.config/crtforge"
-	createConfigDir(configDirectory)
+	configDirectory := getConfigDirectory()
 	defaultCADir := services.CreateCaDir(configDirectory, caName)
 
 	defaultCARootCACrt, defaultCARootCACnf, defaultCARootCAkey := services.CreateRootCa(services.CreateRootCAOptions{
@@ -62,6 +72,7 @@ func rootRun(cmd *cobra.Command, args []string) {
 		LocalityName:        localityName,
 		CountryName:         countryName,
 		BasicConstraints:    basicConstraints,
+		SignatureAlgorithm:  rootSignatureAlgorithm,
 	})
 	_ = defaultCARootCAkey
 
@@ -78,6 +89,10 @@ func rootRun(cmd *cobra.Command, args []string) {
 		LocalityName:        localityName,
 		CountryName:         countryName,
 		BasicConstraints:    basicConstraints,
+		NameConstraints:     nameConstraints(),
+		SignatureAlgorithm:  intermediateSignatureAlgorithm,
+		Parent:              parentIntermediateCaName,
+		PathLen:             intermediatePathLen,
 	})
 
 	// If output directory is not provided, use the default ca directory
@@ -85,16 +100,63 @@ func rootRun(cmd *cobra.Command, args []string) {
 		outputDir = defaultCADir
 	}
 	services.CreateAppCrt(services.CreateAppCrtOptions{
-		OutputDir:         outputDir,
-		IntermediateCACnf: intermediateCA.IntermediateCACnf,
-		IntermediateCACrt: intermediateCA.IntermediateCACrt,
-		IntermediateCAKey: intermediateCA.IntermediateCAKey,
-		RootCACrt:         defaultCARootCACrt,
-		AppName:           appName,
-		CommonName:        appDomains[0],
-		AltNames:          appDomains,
-		P12:               pfx,
+		OutputDir:          outputDir,
+		IntermediateCACnf:  intermediateCA.IntermediateCACnf,
+		IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+		IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+		RootCACrt:          defaultCARootCACrt,
+		AppName:            appName,
+		CommonName:         appDomains[0],
+		AltNames:           appDomains,
+		Subject:            leafSubject.Name(),
+		P12:                pfx,
+		Formats:            outputFormats,
+		NameTemplate:       nameTemplate,
+		KeyPassword:        appKeyPassword(),
+		SignatureAlgorithm: signatureAlgorithm,
+	})
+}
+
+// createCaChain creates the root ca and the intermediate ca selected with
+// --root-ca and --intermediate-ca if they don't exist, and returns the root
+// ca crt and the intermediate ca.
+func createCaChain(defaultCADir string) (string, services.IntermediateCA) {
+	defaultCARootCACrt, defaultCARootCACnf, _ := services.CreateRootCa(services.CreateRootCAOptions{
+		ConfigDirectory:     defaultCADir,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+		SignatureAlgorithm:  rootSignatureAlgorithm,
 	})
+	intermediateCA := services.CreateIntermediateCa(services.CreateIntermediateCAOptions{
+		ConfigDirectory:     defaultCADir,
+		RootCACnf:           defaultCARootCACnf,
+		IntermediateCAName:  intermediateCaName,
+		EmailAddress:        emailAddress,
+		StateOrProvinceName: stateOrProvinceName,
+		LocalityName:        localityName,
+		CountryName:         countryName,
+		BasicConstraints:    basicConstraints,
+		NameConstraints:     nameConstraints(),
+		SignatureAlgorithm:  intermediateSignatureAlgorithm,
+		Parent:              parentIntermediateCaName,
+		PathLen:             intermediatePathLen,
+	})
+	return defaultCARootCACrt, intermediateCA
+}
+
+// getConfigDirectory returns the crtforge config directory and creates it if
+// it doesn't exist yet.
+func getConfigDirectory() string {
+	homeDirectory, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal("home directory couldn't find", err)
+	}
+	configDirectory := homeDirectory + "/.config/crtforge"
+	createConfigDir(configDirectory)
+	return configDirectory
 }
 
 func createConfigDir(configDir string) {
@@ -107,6 +169,122 @@ func createConfigDir(configDir string) {
 	}
 }
 
+// addCaSubjectFlags registers the flags that end up in the root and
+// intermediate ca cnf files. Shared by every command that may create a ca.
+func addCaSubjectFlags(cmd *cobra.Command) {
+	// Select email ID to use
+	cmd.Flags().StringVarP(&emailAddress, "email", "e", "test@example.com", "Set email ID to use to generate the certs")
+
+	// Select country
+	cmd.Flags().StringVarP(&countryName, "country", "c", "TR", "Set country")
+
+	// Select locality
+	cmd.Flags().StringVarP(&localityName, "locality", "l", "Istanbul", "Set locality")
+
+	// Select state
+	cmd.Flags().StringVarP(&stateOrProvinceName, "state", "s", "Istanbul", "Set state")
+
+	// Add basic contraints to use
+	cmd.Flags().StringVarP(&basicConstraints, "basicconstraints", "b", "CA:FALSE", "Set basic constriants")
+
+	// Signature algorithms of new ca certs
+	cmd.Flags().StringVar(&rootSignatureAlgorithm, "root-signature-algorithm", "", "Set the signature algorithm of a new root ca: "+strings.Join(services.SignatureAlgorithms, ", ")+". Defaults to sha256. New ca keys are always rsa 4096")
+	cmd.Flags().StringVar(&intermediateSignatureAlgorithm, "intermediate-signature-algorithm", "", "Set the signature algorithm of a new intermediate ca signed by the root ca. Defaults to the hash of the root ca cnf. New ca keys are always rsa 4096")
+}
+
+// addSignatureAlgorithmFlag registers the signature algorithm of the app
+// certs signed by the intermediate ca.
+func addSignatureAlgorithmFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&signatureAlgorithm, "signature-algorithm", "", "Set the signature algorithm of the app cert: "+strings.Join(services.SignatureAlgorithms, ", ")+". Defaults to the one of the intermediate ca key")
+}
+
+// addLeafSubjectFlags registers the subject fields of the app certs. Unlike
+// the ca subject flags, they end up in the leaf certs.
+func addLeafSubjectFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&leafSubject.Organization, "subject-organization", nil, "Set the organization (O) of the app cert, may be repeated")
+	cmd.Flags().StringArrayVar(&leafSubject.OrganizationalUnit, "subject-organizational-unit", nil, "Set the organizational unit (OU) of the app cert, may be repeated")
+	cmd.Flags().StringVar(&leafSubject.Country, "subject-country", "", "Set the country (C) of the app cert")
+	cmd.Flags().StringVar(&leafSubject.State, "subject-state", "", "Set the state (ST) of the app cert")
+	cmd.Flags().StringVar(&leafSubject.Locality, "subject-locality", "", "Set the locality (L) of the app cert")
+	cmd.Flags().StringVar(&leafSubject.SerialNumber, "subject-serial-number", "", "Set the serialNumber of the app cert subject")
+}
+
+// addOutputFormatFlags registers the output formats and file names of the
+// app certs.
+func addOutputFormatFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&outputFormats, "format", []string{"pem"}, "Set the output formats of the app cert: "+strings.Join(services.AppCrtFormats, ", "))
+	cmd.Flags().StringVar(&nameTemplate, "name-template", "", "Set a go template of the file names, e.g. {{.App}}-{{.Kind}}.{{.Ext}}")
+	cmd.Flags().StringVar(&keyPassword, "key-password", "", "Set the password of the pkcs8-encrypted key. Defaults to CRTFORGE_KEY_PASSWORD.")
+}
+
+// appKeyPassword returns the password of encrypted app keys.
+func appKeyPassword() string {
+	if keyPassword != "" {
+		return keyPassword
+	}
+	return os.Getenv("CRTFORGE_KEY_PASSWORD")
+}
+
+// addNameConstraintFlags registers the flags that restrict the names a new
+// intermediate ca may sign.
+func addNameConstraintFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&permittedDNSDomains, "permitted-dns", nil, "Set dns domains a new intermediate ca may sign, e.g. example.com or .example.com")
+	cmd.Flags().StringSliceVar(&excludedDNSDomains, "excluded-dns", nil, "Set dns domains a new intermediate ca may not sign")
+	cmd.Flags().StringSliceVar(&permittedIPRanges, "permitted-ip", nil, "Set ip ranges a new intermediate ca may sign, e.g. 10.0.0.0/8")
+}
+
+// addIntermediateHierarchyFlags registers the flags that place a new
+// intermediate ca under another intermediate ca.
+func addIntermediateHierarchyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&parentIntermediateCaName, "parent", "", "Sign a new intermediate ca with this intermediate ca instead of the root ca")
+	cmd.Flags().IntVar(&intermediatePathLen, "pathlen", 0, "Set how many intermediate cas may follow a new intermediate ca, 0 lets it sign only app certs, -1 sets no limit")
+}
+
+// addAppFlags registers the flags of an app cert and the cas above it.
+// Shared by the root command and the app command.
+func addAppFlags(cmd *cobra.Command) {
+	// Select if you want to trust to the root ca
+	cmd.Flags().BoolVarP(&trustRootCrt, "trust", "t", false, "Trust the root ca crt.")
+
+	// Select custom root ca
+	cmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	// Select if you want pfx file
+	cmd.Flags().BoolVarP(&pfx, "pfx", "p", false, "Create pfx file.")
+
+	// Select custom intermediate ca
+	cmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+
+	// Select output directory for the
+	cmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
+
+	// Subject attributes of the root and intermediate ca
+	addCaSubjectFlags(cmd)
+
+	// Name constraints of the intermediate ca
+	addNameConstraintFlags(cmd)
+
+	// Parent and path length of the intermediate ca
+	addIntermediateHierarchyFlags(cmd)
+
+	// Subject fields of the app cert
+	addLeafSubjectFlags(cmd)
+
+	// Output formats of the app cert
+	addOutputFormatFlags(cmd)
+
+	// Signature algorithm of the app cert
+	addSignatureAlgorithmFlag(cmd)
+}
+
+func nameConstraints() services.NameConstraints {
+	return services.NameConstraints{
+		PermittedDNSDomains: permittedDNSDomains,
+		ExcludedDNSDomains:  excludedDNSDomains,
+		PermittedIPRanges:   permittedIPRanges,
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -124,43 +302,29 @@ func init() {
 	// Version Flag
 	rootCmd.Flags().BoolP("version", "v", false, "Print version information.")
 
-	// Select if you want to trust to the root ca
-	rootCmd.Flags().BoolVarP(&trustRootCrt, "trust", "t", false, "Trust the root ca crt.")
-
 	// Select if you want to enable debug mode logging
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "verbose logging")
 
-	// Select custom root ca
-	rootCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
-
-	// Select if you want pfx file
-	rootCmd.Flags().BoolVarP(&pfx, "pfx", "p", false, "Create pfx file.")
-
-	// Select custom intermediate ca
-	rootCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
-
-	// Select output directory for the
-	rootCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
-
-	// Select email ID to use
-	rootCmd.Flags().StringVarP(&emailAddress, "email", "e", "test@example.com", "Set email ID to use to generate the certs")
-
-	// Select country
-	rootCmd.Flags().StringVarP(&countryName, "country", "c", "TR", "Set country")
-
-	// Select locality
-	rootCmd.Flags().StringVarP(&localityName, "locality", "l", "Istanbul", "Set locality")
-
-	// Select state
-	rootCmd.Flags().StringVarP(&stateOrProvinceName, "state", "s", "Istanbul", "Set state")
-
-	// Add basic contraints to use
-	rootCmd.Flags().StringVarP(&basicConstraints, "basicconstraints", "b", "CA:FALSE", "Set basic constriants")
+	// Flags of the app cert and the cas above it
+	addAppFlags(rootCmd)
 
 	// Example usages:
 	rootCmd.Example = `Generate a cert under the default root and the default intermediate ca: 
 ./crtforge crtforgeapp crtforge.com app.crtforge.com api.crtforge.com [flags]
 
 Generate a cert under a root ca named medical and a intermediate ca named frontend:
-./crtforge crtforgeapp -r medical -i frontend crtforge.com app.crtforge.com api.crtforge.com [flags]`
+./crtforge crtforgeapp -r medical -i frontend crtforge.com app.crtforge.com api.crtforge.com [flags]
+
+Generate a cert with subject fields and email, uri and ip alt names:
+./crtforge billing billing.crtforge.com email:billing@crtforge.com uri:spiffe://crtforge.com/billing ip:10.0.0.5 --subject-organization "Crtforge Inc" --subject-country TR [flags]
+
+Generate a cert in the formats of java, windows and haproxy next to the pem files:
+./crtforge crtforgeapp crtforge.com --format pem,der,p7b,pkcs8,combined,ca-bundle [flags]
+
+Generate a cert with an encrypted key and custom file names:
+CRTFORGE_KEY_PASSWORD=secret ./crtforge crtforgeapp crtforge.com --format pem,pkcs8-encrypted --name-template "{{.App}}-{{.Kind}}.{{.Ext}}" [flags]
+
+Generate a cert under root ca -> org -> team intermediate cas:
+./crtforge orgapp -i org --pathlen 1 org.crtforge.com [flags]
+./crtforge teamapp -i team --parent org team.crtforge.com [flags]`
 }
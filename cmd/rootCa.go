@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var forceRolloverFinish bool
+
+// rootCaCmd groups the commands that manage root cas
+var rootCaCmd = &cobra.Command{
+	Use:   "root",
+	Short: "Manage root certificate authorities",
+}
+
+var rootCaRolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Replace a root ca with a new one cross-signed by the old one",
+	Long: `Replace a root ca with a new one.
+The old and the new root ca are cross-signed with each other, and the cross
+signed certs are added to every fullchain created afterwards, so clients that
+trust either root ca keep validating. Rotate the intermediate cas afterwards
+to move them under the new root ca.`,
+	Run: rootCaRolloverRun,
+}
+
+var rootCaRolloverFinishCmd = &cobra.Command{
+	Use:   "finish",
+	Short: "End a root ca rollover",
+	Long: `End a root ca rollover once every client trusts the new root ca.
+The transition certs and the trust bundle are removed, so fullchain, pfx and
+p7b files created afterwards only lead to the new root ca.`,
+	Run: rootCaRolloverFinishRun,
+}
+
+var rootCaStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which root ca signed each intermediate ca",
+	Run:   rootCaStatusRun,
+}
+
+func rootCaRolloverRun(cmd *cobra.Command, args []string) {
+	services.RolloverRootCa(services.RolloverRootCAOptions{
+		RootCA: services.CreateRootCAOptions{
+			ConfigDirectory:     services.CreateCaDir(getConfigDirectory(), caName),
+			RootCAName:          caName,
+			EmailAddress:        emailAddress,
+			StateOrProvinceName: stateOrProvinceName,
+			LocalityName:        localityName,
+			CountryName:         countryName,
+			BasicConstraints:    basicConstraints,
+			SignatureAlgorithm:  rootSignatureAlgorithm,
+		},
+	})
+}
+
+func rootCaRolloverFinishRun(cmd *cobra.Command, args []string) {
+	services.FinishRootRollover(services.FinishRootRolloverOptions{
+		ConfigDirectory: services.CreateCaDir(getConfigDirectory(), caName),
+		Force:           forceRolloverFinish,
+	})
+}
+
+func rootCaStatusRun(cmd *cobra.Command, args []string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	oldRootCount := 0
+	for _, status := range services.RootCaStatus(defaultCADir) {
+		switch {
+		case status.Current && status.Parent != "":
+			log.Info(status.Name, ": signed by ", status.Parent, " under the current Root CA (", status.Issuer, ")")
+		case status.Current:
+			log.Info(status.Name, ": signed by the current Root CA (", status.Issuer, ")")
+		case status.ArchivedRoot != "":
+			oldRootCount++
+			log.Warn(status.Name, ": signed by the old Root CA (", status.Issuer, ") archived at ", status.ArchivedRoot)
+		case status.Parent != "":
+			oldRootCount++
+			log.Warn(status.Name, ": signed by an old Intermediate CA ", status.Parent)
+		default:
+			oldRootCount++
+			log.Warn(status.Name, ": signed by an unknown Root CA (", status.Issuer, ")")
+		}
+	}
+	if oldRootCount > 0 {
+		log.Info(oldRootCount, " intermediate cas are not signed by the current Root CA. Rotate them with crtforge intermediate rotate.")
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(rootCaCmd)
+	rootCaCmd.AddCommand(rootCaRolloverCmd, rootCaStatusCmd)
+	rootCaRolloverCmd.AddCommand(rootCaRolloverFinishCmd)
+
+	// Select custom root ca
+	rootCaCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	// Subject attributes of the new root ca
+	addCaSubjectFlags(rootCaRolloverCmd)
+
+	// End the transition although intermediate cas are under the old root ca
+	rootCaRolloverFinishCmd.Flags().BoolVar(&forceRolloverFinish, "force", false, "End the rollover although intermediate cas are still signed by the old Root CA.")
+
+	rootCaCmd.Example = `Roll over the corp root ca and move its intermediate cas under the new one:
+crtforge root rollover -r corp
+crtforge root status -r corp
+crtforge intermediate rotate -r corp -i frontend --reissue
+crtforge root rollover finish -r corp`
+}
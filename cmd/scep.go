@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var scepListenAddress string
+var scepChallengePasswords []string
+
+// scepCmd groups the SCEP enrollment commands
+var scepCmd = &cobra.Command{
+	Use:   "scep",
+	Short: "Enroll legacy devices with SCEP (RFC 8894)",
+}
+
+var scepServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve SCEP enrollment for an intermediate ca",
+	Long: `Serve SCEP enrollment for an intermediate ca.
+Devices fetch the ca certs with GetCACert and enroll with a PKCSReq carrying
+one of the challenge passwords. A RenewalReq signed with a cert issued by the
+intermediate ca renews that cert. Issued certs are recorded in the
+intermediate ca index like the certs created on the cli.`,
+	Run: scepServeRun,
+}
+
+func scepServeRun(cmd *cobra.Command, args []string) {
+	if len(scepChallengePasswords) == 0 && os.Getenv("CRTFORGE_SCEP_CHALLENGE") != "" {
+		scepChallengePasswords = []string{os.Getenv("CRTFORGE_SCEP_CHALLENGE")}
+	}
+	if len(scepChallengePasswords) == 0 {
+		log.Fatal("--challenge or CRTFORGE_SCEP_CHALLENGE is required.")
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+
+	services.ServeScep(services.ScepServerOptions{
+		Listen:             scepListenAddress,
+		TLSCrt:             tlsCrtFile,
+		TLSKey:             tlsKeyFile,
+		ChallengePasswords: scepChallengePasswords,
+		IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+		IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+		RootCACrt:          defaultCARootCACrt,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(scepCmd)
+	scepCmd.AddCommand(scepServeCmd)
+
+	scepServeCmd.Flags().StringVar(&scepListenAddress, "listen", ":8080", "Address to listen on.")
+	scepServeCmd.Flags().StringSliceVar(&scepChallengePasswords, "challenge", nil, "Accepted challenge passwords. Defaults to CRTFORGE_SCEP_CHALLENGE.")
+
+	// SCEP messages are signed and encrypted, so tls is optional
+	scepServeCmd.Flags().StringVar(&tlsCrtFile, "tls-cert", "", "Server crt file. Plain http is served when empty.")
+	scepServeCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "Server key file.")
+	scepServeCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	scepServeCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	addCaSubjectFlags(scepServeCmd)
+
+	scepCmd.Example = `crtforge scep serve -r lab -i printers --challenge secret
+
+Point the devices to http://<host>:8080/scep`
+}
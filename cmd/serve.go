@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var listenAddress string
+var clientsFile string
+var clientCaCrtFile string
+var auditLogFile string
+var tlsCrtFile string
+var tlsKeyFile string
+var serveHostnames []string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve an https api to issue certs from the local cas",
+	Long: `Serve an https api to issue certs from the local cas.
+Clients authenticate with a bearer token or a client cert, and each client may
+only use the intermediate cas in its scopes. Every call is written to the
+audit log. Without --tls-cert, the api cert is issued by the selected root and
+intermediate ca.`,
+	Run: serveRun,
+}
+
+func serveRun(cmd *cobra.Command, args []string) {
+	if clientsFile == "" {
+		log.Fatal("--clients is required.")
+	}
+	configDirectory := getConfigDirectory()
+
+	if tlsCrtFile == "" || tlsKeyFile == "" {
+		tlsCrtFile, tlsKeyFile = issueServerCrt("crtforge-serve", serveHostnames)
+	}
+
+	if auditLogFile == "" {
+		auditLogFile = configDirectory + "/audit.log"
+	}
+	services.ServeApi(services.ApiServerOptions{
+		ConfigDirectory: configDirectory,
+		Listen:          listenAddress,
+		TLSCrt:          tlsCrtFile,
+		TLSKey:          tlsKeyFile,
+		ClientCACrt:     clientCaCrtFile,
+		ClientsFile:     clientsFile,
+		AuditLogFile:    auditLogFile,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(&listenAddress, "listen", ":8443", "Address to listen on.")
+	serveCmd.Flags().StringVar(&clientsFile, "clients", "", "Json file of the clients allowed to call the api.")
+	serveCmd.Flags().StringVar(&clientCaCrtFile, "client-ca", "", "CA crt file to verify client certs with. Enables mTLS client auth.")
+	serveCmd.Flags().StringVar(&auditLogFile, "audit-log", "", "Audit log file. Defaults to audit.log in the config directory.")
+
+	// Api server cert
+	serveCmd.Flags().StringVar(&tlsCrtFile, "tls-cert", "", "Api server crt file. Issued by the selected ca when empty.")
+	serveCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "Api server key file.")
+	serveCmd.Flags().StringSliceVar(&serveHostnames, "hostname", []string{"localhost", "127.0.0.1"}, "Names of the issued api server cert.")
+	serveCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name of the issued api server cert.")
+	serveCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name of the issued api server cert.")
+	addCaSubjectFlags(serveCmd)
+
+	serveCmd.Example = `crtforge serve --listen :8443 --clients clients.json
+
+Issue a cert from the lab/ci intermediate ca:
+curl --cacert ~/.config/crtforge/default/rootCA/rootCA.crt \
+  -H "Authorization: Bearer $TOKEN" \
+  -d '{"altNames": ["app.lab.internal"]}' \
+  https://localhost:8443/v1/lab/ci/certificates`
+}
+
+// issueServerCrt issues the cert of a crtforge server from the ca selected
+// with --root-ca and --intermediate-ca, and returns its fullchain and key file.
+func issueServerCrt(appName string, hostnames []string) (string, string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	services.CreateAppCrt(services.CreateAppCrtOptions{
+		OutputDir:         defaultCADir,
+		IntermediateCACnf: intermediateCA.IntermediateCACnf,
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         defaultCARootCACrt,
+		AppName:           appName,
+		CommonName:        hostnames[0],
+		AltNames:          hostnames,
+	})
+	// Serve the fullchain so clients only need the root ca
+	return defaultCADir + "/" + appName + "/fullchain.crt", defaultCADir + "/" + appName + "/" + appName + ".key"
+}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ApiServerOptions struct {
+	// ConfigDirectory is the crtforge config directory holding the cas
+	ConfigDirectory string
+	// Listen is the address the api listens on, e.g. :8443
+	Listen string
+	// TLSCrt is the crt file of the api server
+	TLSCrt string
+	// TLSKey is the key file of the api server
+	TLSKey string
+	// ClientCACrt is the ca crt file client certs are verified with, mTLS is disabled when empty
+	ClientCACrt string
+	// ClientsFile is the json file of the clients allowed to call the api
+	ClientsFile string
+	// AuditLogFile is the file every api call is logged to
+	AuditLogFile string
+}
+
+// ApiClient is an entry of the clients file
+type ApiClient struct {
+	// Name identifies the client in the audit log
+	Name string `json:"name"`
+	// Token is the bearer token of the client
+	Token string `json:"token,omitempty"`
+	// ClientCertCommonName is the common name of the client cert of the client
+	ClientCertCommonName string `json:"clientCertCommonName,omitempty"`
+	// Scopes are the intermediate cas the client may use, as root/intermediate or root/*
+	Scopes []string `json:"scopes"`
+}
+
+type apiServer struct {
+	configDirectory string
+	clients         []ApiClient
+	auditLog        *log.Logger
+}
+
+// apiCrtRequest is the body of the certificates endpoint
+type apiCrtRequest struct {
+	CommonName string      `json:"commonName"`
+	AltNames   []string    `json:"altNames"`
+	Subject    LeafSubject `json:"subject"`
+}
+
+// apiCsrRequest is the body of the sign endpoint
+type apiCsrRequest struct {
+	Csr string `json:"csr"`
+}
+
+type apiCrtResponse struct {
+	Serial      string `json:"serial"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"privateKey,omitempty"`
+	Chain       string `json:"chain"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// apiCa is the ca selected by the path of a request
+type apiCa struct {
+	rootCACrt         string
+	intermediateCADir string
+	intermediateCACrt string
+	intermediateCAKey string
+}
+
+// apiResponseWriter records the status for the audit log
+type apiResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *apiResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// ServeApi serves the issuance api until the server fails. Every request is
+// authenticated with a bearer token or a client cert, checked against the
+// scopes of the client and written to the audit log.
+func ServeApi(opts ApiServerOptions) {
+	clients, err := LoadApiClients(opts.ClientsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auditLogFile, err := os.OpenFile(opts.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal("Error while opening audit log: ", err)
+	}
+	defer auditLogFile.Close()
+	auditLog := log.New()
+	auditLog.SetOutput(auditLogFile)
+	auditLog.SetFormatter(&log.JSONFormatter{})
+
+	server := &apiServer{
+		configDirectory: opts.ConfigDirectory,
+		clients:         clients,
+		auditLog:        auditLog,
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.ClientCACrt != "" {
+		clientCAPEM, err := os.ReadFile(opts.ClientCACrt)
+		if err != nil {
+			log.Fatal("Error while reading client CA: ", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(clientCAPEM) {
+			log.Fatal("No certificate found in client CA file: ", opts.ClientCACrt)
+		}
+		// Clients without a cert can still use a token
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	httpServer := &http.Server{
+		Addr:              opts.Listen,
+		Handler:           server.routes(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving the crtforge api on ", opts.Listen)
+	log.Info("Audit log: ", opts.AuditLogFile)
+	log.Fatal(httpServer.ListenAndServeTLS(opts.TLSCrt, opts.TLSKey))
+}
+
+// routes returns the handler of the api endpoints.
+func (s *apiServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/{rootCa}/{intermediateCa}/certificates", s.handle(s.createCrt))
+	mux.HandleFunc("POST /v1/{rootCa}/{intermediateCa}/sign", s.handle(s.signCsr))
+	mux.HandleFunc("GET /v1/{rootCa}/{intermediateCa}/chain", s.handle(s.chain))
+	mux.HandleFunc("GET /v1/{rootCa}/{intermediateCa}/certificates", s.handle(s.listCrts))
+	mux.HandleFunc("POST /v1/{rootCa}/{intermediateCa}/certificates/{serial}/revoke", s.handle(s.revokeCrt))
+	mux.HandleFunc("GET /v1/{rootCa}/{intermediateCa}/crl", s.handle(s.crl))
+	return mux
+}
+
+// LoadApiClients reads the clients file.
+func LoadApiClients(clientsFile string) ([]ApiClient, error) {
+	clientsJSON, err := os.ReadFile(clientsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading clients file: %v", err)
+	}
+	if info, err := os.Stat(clientsFile); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Warn("Clients file is readable by other users, tokens may leak: ", clientsFile)
+	}
+
+	var clients []ApiClient
+	if err := json.Unmarshal(clientsJSON, &clients); err != nil {
+		return nil, fmt.Errorf("error parsing clients file %s: %v", clientsFile, err)
+	}
+	for _, client := range clients {
+		if client.Name == "" {
+			return nil, fmt.Errorf("client without name in %s", clientsFile)
+		}
+		if client.Token == "" && client.ClientCertCommonName == "" {
+			return nil, fmt.Errorf("client %s has neither a token nor a client cert common name", client.Name)
+		}
+	}
+	return clients, nil
+}
+
+// handle authenticates and authorizes a request, resolves its ca and writes
+// the audit log entry once h has handled it.
+func (s *apiServer) handle(h func(http.ResponseWriter, *http.Request, apiCa) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writer := &apiResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		auditEntry := s.auditLog.WithFields(log.Fields{
+			"remote": r.RemoteAddr,
+			"method": r.Method,
+			"path":   r.URL.Path,
+		})
+		detail := ""
+		defer func() {
+			if detail != "" {
+				auditEntry = auditEntry.WithField("detail", detail)
+			}
+			auditEntry.WithField("status", writer.status).Info("api call")
+		}()
+
+		client := s.authenticate(r)
+		if client == nil {
+			detail = "unauthenticated"
+			writeApiError(writer, http.StatusUnauthorized, "missing or invalid credentials")
+			return
+		}
+		auditEntry = auditEntry.WithField("client", client.Name)
+
+		// Path values are unescaped, so an encoded slash would leave the config directory
+		rootCaName, intermediateCaName := r.PathValue("rootCa"), r.PathValue("intermediateCa")
+		for _, name := range []string{rootCaName, intermediateCaName} {
+			if err := checkCaName(name); err != nil {
+				detail = err.Error()
+				writeApiError(writer, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if !client.allows(rootCaName, intermediateCaName) {
+			detail = "out of scope"
+			writeApiError(writer, http.StatusForbidden, "client is not allowed to use "+rootCaName+"/"+intermediateCaName)
+			return
+		}
+
+		ca, err := s.resolveCa(rootCaName, intermediateCaName)
+		if err != nil {
+			detail = err.Error()
+			writeApiError(writer, http.StatusNotFound, err.Error())
+			return
+		}
+
+		r.Body = http.MaxBytesReader(writer, r.Body, 1<<20)
+		detail = h(writer, r, ca)
+	}
+}
+
+// authenticate returns the client of a verified client cert or bearer token.
+func (s *apiServer) authenticate(r *http.Request) *ApiClient {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range s.clients {
+			if s.clients[i].ClientCertCommonName != "" && s.clients[i].ClientCertCommonName == commonName {
+				return &s.clients[i]
+			}
+		}
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil
+	}
+	for i := range s.clients {
+		if s.clients[i].Token != "" && subtle.ConstantTimeCompare([]byte(s.clients[i].Token), []byte(token)) == 1 {
+			return &s.clients[i]
+		}
+	}
+	return nil
+}
+
+func (c *ApiClient) allows(rootCaName, intermediateCaName string) bool {
+	for _, scope := range c.Scopes {
+		if scope == "*" || scope == rootCaName+"/*" || scope == rootCaName+"/"+intermediateCaName {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCa returns the files of an existing ca. The api never creates cas.
+func (s *apiServer) resolveCa(rootCaName, intermediateCaName string) (apiCa, error) {
+	caDir := s.configDirectory + "/" + rootCaName
+	intermediateCADir := caDir + "/" + intermediateCaName
+	ca := apiCa{
+		rootCACrt:         caDir + "/rootCA/rootCA.crt",
+		intermediateCADir: intermediateCADir,
+		intermediateCACrt: intermediateCADir + "/intermediateCA.crt",
+		intermediateCAKey: intermediateCADir + "/intermediateCA.key",
+	}
+	for _, file := range []string{ca.rootCACrt, ca.intermediateCACrt, ca.intermediateCAKey} {
+		if _, err := os.Stat(file); err != nil {
+			return apiCa{}, fmt.Errorf("ca %s/%s not found", rootCaName, intermediateCaName)
+		}
+	}
+	return ca, nil
+}
+
+func (s *apiServer) createCrt(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	var request apiCrtRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeApiError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return err.Error()
+	}
+	if len(request.AltNames) == 0 {
+		writeApiError(w, http.StatusBadRequest, "altNames is required")
+		return "no alt names"
+	}
+	// Like the cli, the first domain is the common name unless one is given
+	if request.CommonName == "" {
+		request.CommonName = request.AltNames[0]
+	}
+	subject := request.Subject
+	if err := checkSubjectValues(append([]string{request.CommonName, subject.Country, subject.State, subject.Locality, subject.SerialNumber},
+		append(subject.Organization, subject.OrganizationalUnit...)...)...); err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return err.Error()
+	}
+
+	appCrt, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: ca.intermediateCACrt,
+		IntermediateCAKey: ca.intermediateCAKey,
+		RootCACrt:         ca.rootCACrt,
+		CommonName:        request.CommonName,
+		AltNames:          request.AltNames,
+		Subject:           request.Subject.Name(),
+	})
+	if err != nil {
+		writeIssuanceError(w, err)
+		return err.Error()
+	}
+	response, err := crtResponse(appCrt.Cert, ca)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	keyPEM, err := appKeyPEM(appCrt.PrivateKey)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	response.PrivateKey = string(keyPEM)
+	writeApiJSON(w, http.StatusCreated, response)
+	return "issued " + response.Serial + " for " + strings.Join(request.AltNames, ",")
+}
+
+func (s *apiServer) signCsr(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	var request apiCsrRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeApiError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return err.Error()
+	}
+	if err := checkCsrSubject([]byte(request.Csr)); err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return err.Error()
+	}
+
+	cert, err := SignAppCsr(CreateAppCrtOptions{
+		IntermediateCACrt: ca.intermediateCACrt,
+		IntermediateCAKey: ca.intermediateCAKey,
+		RootCACrt:         ca.rootCACrt,
+	}, []byte(request.Csr))
+	if err != nil {
+		writeIssuanceError(w, err)
+		return err.Error()
+	}
+	response, err := crtResponse(cert, ca)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	writeApiJSON(w, http.StatusCreated, response)
+	return "signed " + response.Serial + " for " + cert.Subject.CommonName
+}
+
+func (s *apiServer) chain(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	chainPEM, err := ChainPEM(ca.intermediateCACrt, ca.rootCACrt)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chainPEM)
+	return ""
+}
+
+func (s *apiServer) listCrts(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	issuedCrts, err := ListIssuedCrts(ca.intermediateCADir)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	if issuedCrts == nil {
+		issuedCrts = []IssuedCrt{}
+	}
+	writeApiJSON(w, http.StatusOK, issuedCrts)
+	return ""
+}
+
+func (s *apiServer) revokeCrt(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	issuedCrt, err := RevokeCrt(ca.intermediateCADir, r.PathValue("serial"))
+	if err != nil {
+		writeApiError(w, http.StatusNotFound, err.Error())
+		return err.Error()
+	}
+	writeApiJSON(w, http.StatusOK, issuedCrt)
+	return "revoked " + issuedCrt.Serial
+}
+
+func (s *apiServer) crl(w http.ResponseWriter, r *http.Request, ca apiCa) string {
+	crlDER, err := CreateCrl(ca.intermediateCACrt, ca.intermediateCAKey)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return err.Error()
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crlDER)
+	return ""
+}
+
+func crtResponse(cert *x509.Certificate, ca apiCa) (*apiCrtResponse, error) {
+	chainPEM, err := ChainPEM(ca.intermediateCACrt, ca.rootCACrt)
+	if err != nil {
+		return nil, err
+	}
+	return &apiCrtResponse{
+		Serial:      serialHex(cert.SerialNumber),
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		Chain:       string(chainPEM),
+	}, nil
+}
+
+// checkCsrSubject refuses a csr whose subject can't be written to the index.
+func checkCsrSubject(csrPEM []byte) error {
+	csrBlock, _ := pem.Decode(csrPEM)
+	if csrBlock == nil || csrBlock.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("failed to decode csr PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing csr: %v", err)
+	}
+	var values []string
+	for _, attribute := range csr.Subject.Names {
+		values = append(values, fmt.Sprint(attribute.Value))
+	}
+	return checkSubjectValues(values...)
+}
+
+// checkSubjectValues refuses subject values with control characters, they
+// would break the lines of the index.
+func checkSubjectValues(values ...string) error {
+	for _, value := range values {
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("subject value %q contains control characters", value)
+		}
+	}
+	return nil
+}
+
+// writeIssuanceError answers refused requests with 403 and broken ones with 400.
+func writeIssuanceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrRequestRefused) {
+		writeApiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	writeApiError(w, http.StatusBadRequest, err.Error())
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeApiJSON(w, status, apiErrorResponse{Error: message})
+}
+
+func writeApiJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestApiServerScopes(t *testing.T) {
+	configDir := t.TempDir()
+	createTestCaChain(t, configDir, "corp", "frontend")
+	createTestCaChain(t, configDir, "other", "team")
+
+	auditLog := log.New()
+	auditLog.SetOutput(io.Discard)
+	server := &apiServer{
+		configDirectory: configDir,
+		clients:         []ApiClient{{Name: "ci", Token: "secret", Scopes: []string{"corp/*"}}},
+		auditLog:        auditLog,
+	}
+	api := httptest.NewServer(server.routes())
+	defer api.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"issue in scope", "POST", "/v1/corp/frontend/certificates", "secret", `{"altNames":["app.example.com"]}`, http.StatusCreated},
+		{"list in scope", "GET", "/v1/corp/frontend/certificates", "secret", "", http.StatusOK},
+		{"missing token", "GET", "/v1/corp/frontend/certificates", "", "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/v1/corp/frontend/certificates", "guess", "", http.StatusUnauthorized},
+		{"out of scope", "GET", "/v1/other/team/certificates", "secret", "", http.StatusForbidden},
+		{"unknown ca", "GET", "/v1/corp/missing/certificates", "secret", "", http.StatusNotFound},
+		{"encoded traversal", "POST", "/v1/corp/..%2F..%2Fother%2Fteam/certificates", "secret", `{"altNames":["app.example.com"]}`, http.StatusBadRequest},
+		{"encoded traversal crl", "GET", "/v1/corp/..%2Fother%2Fteam/crl", "secret", "", http.StatusBadRequest},
+		{"encoded backslash", "GET", "/v1/corp/..%5Cother/certificates", "secret", "", http.StatusBadRequest},
+		{"dot dot", "GET", "/v1/corp/%2E%2E/certificates", "secret", "", http.StatusBadRequest},
+		{"control character", "POST", "/v1/corp/frontend/certificates", "secret", `{"commonName":"app\nR","altNames":["app.example.com"]}`, http.StatusBadRequest},
+		{"no alt names", "POST", "/v1/corp/frontend/certificates", "secret", `{}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(test.method, api.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.token != "" {
+				request.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			if response.StatusCode != test.status {
+				t.Errorf("status %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+		})
+	}
+}
+
+func TestCheckCaName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"frontend", true},
+		{"team-2.corp_a", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../other", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{".hidden", false},
+		{"a b", false},
+	}
+	for _, test := range tests {
+		if err := checkCaName(test.name); (err == nil) != test.valid {
+			t.Errorf("checkCaName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
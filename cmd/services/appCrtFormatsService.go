@@ -0,0 +1,382 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AppCrtFormats are the output formats of app certs:
+//   - pem: the cert, the key and the fullchain, the default
+//   - der: the DER encoded cert
+//   - pkcs8: the PKCS#8 key
+//   - pkcs8-encrypted: the password protected PKCS#8 key
+//   - chain: the chain of the cert without the cert itself
+//   - ca-bundle: the root cas to trust
+//   - p7b: the cert and its chain as a PKCS#7 certs-only file
+//   - combined: the cert, its chain and the key in one pem file, e.g. for HAProxy
+//   - pfx: the key and the cert with its chain as a PKCS#12 file
+var AppCrtFormats = []string{"pem", "der", "pkcs8", "pkcs8-encrypted", "chain", "ca-bundle", "p7b", "combined", "pfx"}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+)
+
+// pkcs8Iterations is the pbkdf2 iteration count of encrypted keys
+const pkcs8Iterations = 100000
+
+// AppCrtFileName are the fields of the file name template
+type AppCrtFileName struct {
+	// App is the app name
+	App string
+	// Kind is the file: crt, key, fullchain, der, pkcs8, pkcs8-encrypted,
+	// chain, ca-bundle, p7b, combined or pfx
+	Kind string
+	// Ext is the usual extension of the file, without the dot
+	Ext string
+	// Default is the file name without a template
+	Default string
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+// formats returns the selected output formats, pem when none is selected.
+func (opts CreateAppCrtOptions) formats() []string {
+	formats := opts.Formats
+	if len(formats) == 0 {
+		formats = []string{"pem"}
+	}
+	if opts.P12 && !slices.Contains(formats, "pfx") {
+		formats = append(slices.Clone(formats), "pfx")
+	}
+	return formats
+}
+
+// checkAppCrtFormats returns an error for unknown formats, invalid or
+// clashing file names and missing key passwords, before any cert is issued.
+func checkAppCrtFormats(opts CreateAppCrtOptions) error {
+	if slices.Contains(opts.formats(), "pkcs8-encrypted") && opts.KeyPassword == "" {
+		return fmt.Errorf("the pkcs8-encrypted format needs a key password")
+	}
+	_, err := appCrtFileNames(opts)
+	return err
+}
+
+// appCrtFiles returns the files of an output format with their default names.
+func appCrtFiles(format, app string) []AppCrtFileName {
+	switch format {
+	case "pem":
+		return []AppCrtFileName{
+			{App: app, Kind: "key", Ext: "key", Default: app + ".key"},
+			{App: app, Kind: "crt", Ext: "crt", Default: app + ".crt"},
+			{App: app, Kind: "fullchain", Ext: "crt", Default: "fullchain.crt"},
+		}
+	case "der":
+		return []AppCrtFileName{{App: app, Kind: "der", Ext: "der", Default: app + ".der"}}
+	case "pkcs8":
+		return []AppCrtFileName{{App: app, Kind: "pkcs8", Ext: "key", Default: app + ".pkcs8.key"}}
+	case "pkcs8-encrypted":
+		return []AppCrtFileName{{App: app, Kind: "pkcs8-encrypted", Ext: "key", Default: app + ".encrypted.key"}}
+	case "chain":
+		return []AppCrtFileName{{App: app, Kind: "chain", Ext: "crt", Default: "chain.crt"}}
+	case "ca-bundle":
+		return []AppCrtFileName{{App: app, Kind: "ca-bundle", Ext: "crt", Default: "ca-bundle.crt"}}
+	case "p7b":
+		return []AppCrtFileName{{App: app, Kind: "p7b", Ext: "p7b", Default: app + ".p7b"}}
+	case "combined":
+		return []AppCrtFileName{{App: app, Kind: "combined", Ext: "pem", Default: app + ".pem"}}
+	case "pfx":
+		return []AppCrtFileName{{App: app, Kind: "pfx", Ext: "pfx", Default: app + ".pfx"}}
+	}
+	return nil
+}
+
+// appCrtFileNames returns the file names of the selected formats by kind.
+func appCrtFileNames(opts CreateAppCrtOptions) (map[string]string, error) {
+	names := map[string]string{}
+	for _, format := range opts.formats() {
+		if !slices.Contains(AppCrtFormats, format) {
+			return nil, fmt.Errorf("unknown output format %s, use %s", format, strings.Join(AppCrtFormats, ", "))
+		}
+		for _, file := range appCrtFiles(format, opts.AppName) {
+			name, err := appCrtFileName(opts.NameTemplate, file)
+			if err != nil {
+				return nil, err
+			}
+			for otherKind, otherName := range names {
+				if otherName == name {
+					return nil, fmt.Errorf("the %s and %s files are both named %s", otherKind, file.Kind, name)
+				}
+			}
+			names[file.Kind] = name
+		}
+	}
+	return names, nil
+}
+
+// writeAppCrtFiles writes an issued app cert in the selected formats to
+// appCrtDir and returns the written files by kind.
+func writeAppCrtFiles(opts CreateAppCrtOptions, appCrtDir string, appCrt *AppCrt) (map[string]string, error) {
+	names, err := appCrtFileNames(opts)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for kind, name := range names {
+		files[kind] = appCrtDir + "/" + name
+	}
+	writeFile := func(kind string, data []byte, perm os.FileMode) error {
+		if err := os.WriteFile(files[kind], data, perm); err != nil {
+			return fmt.Errorf("error writing %s file: %v", kind, err)
+		}
+		return nil
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: appCrt.Cert.Raw})
+	chainPEM, err := ChainPEM(opts.IntermediateCACrt, opts.RootCACrt)
+	if err != nil {
+		return nil, err
+	}
+	chainCerts, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing chain: %v", err)
+	}
+	keyPEM, err := appKeyPEM(appCrt.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %v", err)
+	}
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(appCrt.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %v", err)
+	}
+
+	writeFormat := func(format string) error {
+		switch format {
+		case "pem":
+			if err := writeFile("key", keyPEM, 0600); err != nil {
+				return err
+			}
+			if err := writeFile("crt", certPEM, 0644); err != nil {
+				return err
+			}
+			return createFullchainCert(opts, certPEM, files["fullchain"])
+		case "der":
+			return writeFile("der", appCrt.Cert.Raw, 0644)
+		case "pkcs8":
+			return writeFile("pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Key}), 0600)
+		case "pkcs8-encrypted":
+			encryptedKey, err := encryptPKCS8(pkcs8Key, opts.KeyPassword)
+			if err != nil {
+				return fmt.Errorf("error encrypting private key: %v", err)
+			}
+			return writeFile("pkcs8-encrypted", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encryptedKey}), 0600)
+		case "chain":
+			return writeFile("chain", chainPEM, 0644)
+		case "ca-bundle":
+			caBundlePEM, err := caBundlePEM(opts.RootCACrt)
+			if err != nil {
+				return err
+			}
+			return writeFile("ca-bundle", caBundlePEM, 0644)
+		case "p7b":
+			p7b, err := encodeCertsOnlyPKCS7(append([]*x509.Certificate{appCrt.Cert}, chainCerts...))
+			if err != nil {
+				return fmt.Errorf("error encoding p7b: %v", err)
+			}
+			return writeFile("p7b", p7b, 0644)
+		case "combined":
+			// HAProxy reads the cert, its chain and the key from one file
+			combinedPEM := bytes.Join([][]byte{certPEM, chainPEM, keyPEM}, nil)
+			return writeFile("combined", combinedPEM, 0600)
+		case "pfx":
+			password := opts.P12Password
+			if password == "" {
+				password = "changeit"
+			}
+			if err := createPFX(appCrt.PrivateKey, appCrt.Cert, chainCerts, files["pfx"], password); err != nil {
+				return fmt.Errorf("error creating PFX file: %v", err)
+			}
+		}
+		return nil
+	}
+	for _, format := range opts.formats() {
+		if err := writeFormat(format); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// appCrtFileName returns the name of an app cert file from the file name
+// template, the default name when there is no template.
+func appCrtFileName(nameTemplate string, name AppCrtFileName) (string, error) {
+	if nameTemplate == "" {
+		return name.Default, nil
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %v", err)
+	}
+	var fileName strings.Builder
+	if err := tmpl.Execute(&fileName, name); err != nil {
+		return "", fmt.Errorf("invalid name template: %v", err)
+	}
+	// Files stay in the app dir
+	if fileName.Len() == 0 || fileName.String() != filepath.Base(fileName.String()) || strings.HasPrefix(fileName.String(), ".") {
+		return "", fmt.Errorf("invalid file name %q from the name template for the %s file", fileName.String(), name.Kind)
+	}
+	return fileName.String(), nil
+}
+
+// caBundlePEM returns the root cas to trust, the old and the new root ca
+// during a rollover.
+func caBundlePEM(rootCACrt string) ([]byte, error) {
+	trustBundleFile := filepath.Dir(rootCACrt) + "/trust-bundle.crt"
+	if trustBundlePEM, err := os.ReadFile(trustBundleFile); err == nil {
+		return trustBundlePEM, nil
+	}
+	rootCACertPEM, err := os.ReadFile(rootCACrt)
+	if err != nil {
+		return nil, fmt.Errorf("error reading root CA certificate: %v", err)
+	}
+	return rootCACertPEM, nil
+}
+
+// encryptPKCS8 encrypts a PKCS#8 key with PBES2, using pbkdf2 with
+// hmac-sha256 and aes-256-cbc like openssl does by default.
+func encryptPKCS8(pkcs8Key []byte, password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(password), salt, pkcs8Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(pkcs8Key)%aes.BlockSize
+	encrypted := append(slices.Clone(pkcs8Key), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pkcs8Iterations,
+		Prf:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       encrypted,
+	})
+}
+
+// decryptPKCS8 decrypts a PBES2 encrypted PKCS#8 key, as written by
+// encryptPKCS8 and openssl.
+func decryptPKCS8(der []byte, password string) ([]byte, error) {
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &keyInfo); err != nil {
+		return nil, fmt.Errorf("error parsing encrypted key: %v", err)
+	}
+	if !keyInfo.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s, only PBES2 is supported", keyInfo.EncryptionAlgorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(keyInfo.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("error parsing PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("error parsing pbkdf2 parameters: %v", err)
+	}
+	prf := sha1.New
+	switch algorithm := kdfParams.Prf.Algorithm; {
+	case len(algorithm) == 0, algorithm.Equal(oidHMACWithSHA1):
+	case algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported pbkdf2 prf %s", algorithm)
+	}
+	newCipher, keySize, err := pkcs7Cipher(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("error parsing iv: %v", err)
+	}
+	block, err := newCipher(pbkdf2.Key([]byte(password), kdfParams.Salt, kdfParams.IterationCount, keySize, prf))
+	if err != nil {
+		return nil, err
+	}
+	encrypted := keyInfo.EncryptedData
+	if len(iv) != block.BlockSize() || len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted key")
+	}
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("wrong key password")
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
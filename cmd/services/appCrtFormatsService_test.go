@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+func TestAppCrtFileNames(t *testing.T) {
+	tests := []struct {
+		name         string
+		formats      []string
+		nameTemplate string
+		keyPassword  string
+		files        map[string]string
+	}{
+		{"default", nil, "", "", map[string]string{"key": "web.key", "crt": "web.crt", "fullchain": "fullchain.crt"}},
+		{"der and pkcs8", []string{"der", "pkcs8"}, "", "", map[string]string{"der": "web.der", "pkcs8": "web.pkcs8.key"}},
+		{"template", []string{"pem", "chain"}, "{{.App}}-{{.Kind}}.{{.Ext}}", "", map[string]string{"key": "web-key.key", "crt": "web-crt.crt", "fullchain": "web-fullchain.crt", "chain": "web-chain.crt"}},
+		{"unknown format", []string{"jks"}, "", "", nil},
+		{"clashing names", []string{"pem"}, "{{.App}}.{{.Ext}}", "", nil},
+		{"template traversal", []string{"pem"}, "../{{.Kind}}", "", nil},
+		{"hidden file", []string{"der"}, ".{{.Kind}}", "", nil},
+		{"unknown field", []string{"der"}, "{{.Name}}", "", nil},
+		{"encrypted key without password", []string{"pkcs8-encrypted"}, "", "", nil},
+		{"encrypted key", []string{"pkcs8-encrypted"}, "", "secret", map[string]string{"pkcs8-encrypted": "web.encrypted.key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := CreateAppCrtOptions{AppName: "web", Formats: test.formats, NameTemplate: test.nameTemplate, KeyPassword: test.keyPassword}
+			err := checkAppCrtFormats(opts)
+			if test.files == nil {
+				if err == nil {
+					t.Error("invalid formats were accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := appCrtFileNames(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(test.files) {
+				t.Errorf("files %v, want %v", files, test.files)
+			}
+			for kind, name := range test.files {
+				if files[kind] != name {
+					t.Errorf("%s file is %q, want %q", kind, files[kind], name)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAppCrtFiles(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	opts := CreateAppCrtOptions{
+		AppName:           "web",
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		AltNames:          []string{"web.example.com"},
+		Formats:           AppCrtFormats,
+		KeyPassword:       "secret",
+		P12Password:       "changeme",
+	}
+	appCrt, err := IssueAppCrt(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appCrtDir := t.TempDir()
+	files, err := writeAppCrtFiles(opts, appCrtDir, appCrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFile := func(kind string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(files[kind])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(appCrt.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err := x509.ParseCertificate(readFile("der")); err != nil || !cert.Equal(appCrt.Cert) {
+		t.Errorf("der file isn't the cert: %v", err)
+	}
+	if chain, err := parseCertsPEM(readFile("chain")); err != nil || len(chain) != 2 || chain[0].Equal(appCrt.Cert) {
+		t.Errorf("chain file has %d certs, want the intermediate and the root ca: %v", len(chain), err)
+	}
+	if p7b, err := parsePKCS7Certs(readFile("p7b")); err != nil || len(p7b) != 3 || !p7b[0].Equal(appCrt.Cert) {
+		t.Errorf("p7b file has %d certs, want the cert and its chain: %v", len(p7b), err)
+	}
+	if combined := readFile("combined"); !bytes.Contains(combined, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: appCrt.Cert.Raw})) || !bytes.Contains(combined, []byte("PRIVATE KEY")) {
+		t.Error("combined file lacks the cert or the key")
+	}
+	if pkcs8Block, _ := pem.Decode(readFile("pkcs8")); pkcs8Block == nil || !bytes.Equal(pkcs8Block.Bytes, pkcs8Key) {
+		t.Error("pkcs8 file isn't the key")
+	}
+
+	encryptedBlock, _ := pem.Decode(readFile("pkcs8-encrypted"))
+	if encryptedBlock == nil || encryptedBlock.Type != "ENCRYPTED PRIVATE KEY" {
+		t.Fatal("pkcs8-encrypted file isn't an encrypted key")
+	}
+	if decrypted, err := decryptPKCS8(encryptedBlock.Bytes, "secret"); err != nil || !bytes.Equal(decrypted, pkcs8Key) {
+		t.Errorf("encrypted key doesn't decrypt to the key: %v", err)
+	}
+	if _, err := decryptPKCS8(encryptedBlock.Bytes, "guess"); err == nil {
+		t.Error("encrypted key decrypted with a wrong password")
+	}
+
+	if _, certs, err := readConvertPKCS12(readFile("pfx"), "changeme"); err != nil || len(certs) == 0 || !certs[0].Equal(appCrt.Cert) {
+		t.Errorf("pfx file doesn't hold the cert: %v", err)
+	}
+	for kind, perm := range map[string]os.FileMode{"key": 0600, "pkcs8": 0600, "pkcs8-encrypted": 0600, "combined": 0600, "crt": 0644} {
+		info, err := os.Stat(files[kind])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Errorf("%s file mode %v, want %v", kind, info.Mode().Perm(), perm)
+		}
+	}
+}
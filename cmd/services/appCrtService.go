@@ -1,19 +1,30 @@
 package services
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
 	"software.sslmate.com/src/go-pkcs12"
 )
 
@@ -36,225 +47,507 @@ type CreateAppCrtOptions struct {
 	AltNames []string
 	// P12 is the flag for creating p12 files
 	P12 bool
+	// P12Password is the password of the p12 file, changeit when empty
+	P12Password string
+	// Formats are the output formats of the cert, see AppCrtFormats. pem when empty
+	Formats []string
+	// NameTemplate is a text/template of the file names with the fields of
+	// AppCrtFileName, the default names when empty
+	NameTemplate string
+	// KeyPassword is the password of the pkcs8-encrypted key
+	KeyPassword string
+	// SignatureAlgorithm is the signature algorithm of the cert signed by the
+	// intermediate ca, see SignatureAlgorithms. The default of its key when empty
+	SignatureAlgorithm string
+	// ExtKeyUsages are the extended key usages of the cert, serverAuth when empty
+	ExtKeyUsages []x509.ExtKeyUsage
+	// CriticalExtKeyUsages marks the extended key usage extension critical
+	CriticalExtKeyUsages bool
+	// Subject is the subject of the cert, CommonName is used when its common name is empty
+	Subject pkix.Name
+	// KeyType is the key type of the cert: rsa, ecdsa or ed25519, rsa when empty
+	KeyType string
+	// KeySize is the rsa key size or the ecdsa curve size, 2048 and 256 when zero
+	KeySize int
+	// Validity is the validity of the cert, one year when zero
+	Validity time.Duration
+}
+
+// LeafSubject are the subject fields of an app cert next to the common name
+type LeafSubject struct {
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizationalUnit,omitempty"`
+	Country            string   `json:"country,omitempty"`
+	State              string   `json:"state,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	SerialNumber       string   `json:"serialNumber,omitempty"`
+}
+
+// Name returns the subject with the given fields.
+func (s LeafSubject) Name() pkix.Name {
+	name := pkix.Name{
+		Organization:       s.Organization,
+		OrganizationalUnit: s.OrganizationalUnit,
+		SerialNumber:       s.SerialNumber,
+	}
+	if s.Country != "" {
+		name.Country = []string{s.Country}
+	}
+	if s.State != "" {
+		name.Province = []string{s.State}
+	}
+	if s.Locality != "" {
+		name.Locality = []string{s.Locality}
+	}
+	return name
+}
+
+// ErrRequestRefused is wrapped by the errors of requests the name constraints
+// or the issuance policies refuse.
+var ErrRequestRefused = errors.New("request refused")
+
+// AppCrt is an issued app cert with its private key
+type AppCrt struct {
+	// Cert is the app certificate
+	Cert *x509.Certificate
+	// PrivateKey is the private key of the app certificate
+	PrivateKey crypto.Signer
 }
 
 func CreateAppCrt(opts CreateAppCrtOptions) {
+	if err := checkAppCrtFormats(opts); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create app directory if not exists
 	appCrtDir := fmt.Sprintf("%s/%s", opts.OutputDir, opts.AppName)
 	if err := os.MkdirAll(appCrtDir, 0700); err != nil {
 		log.Fatal("Error while creating App dir: ", err)
 	}
 
-	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	appCrt, err := IssueAppCrt(opts)
 	if err != nil {
-		log.Fatal("Error generating private key: ", err)
+		log.Fatal(err)
 	}
 
-	// Create app key file
-	applicationKeyFile := fmt.Sprintf("%s/%s.key", appCrtDir, opts.AppName)
-	keyOut, err := os.OpenFile(applicationKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	// Write the files only once the certificate is created so a refused
+	// request doesn't replace the key of an existing cert
+	files, err := writeAppCrtFiles(opts, appCrtDir, appCrt)
 	if err != nil {
-		log.Fatal("Error creating key file: ", err)
+		log.Fatal("Error while writing app cert files: ", err)
+	}
+	if pfxOutputFile, ok := files["pfx"]; ok {
+		log.Info("PFX file created successfully.")
+		log.Info("PFX file path: ", pfxOutputFile)
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-	keyOut.Close()
 
-	// Load CA certificate and key
-	caCert, caKey, err := loadCACertAndKey(opts.IntermediateCACrt, opts.IntermediateCAKey)
+	log.Info("App certs created successfully.")
+	log.Info("App name: ", opts.AppName)
+	log.Info("Domains: ", opts.AltNames)
+	log.Info("To see your cert files, please check the dir: ", appCrtDir)
+}
+
+// IssueAppCrt creates an app key and cert signed by the intermediate ca
+// without writing them to files.
+func IssueAppCrt(opts CreateAppCrtOptions) (*AppCrt, error) {
+	// Generate private key
+	privateKey, err := generateAppKey(opts.KeyType, opts.KeySize)
 	if err != nil {
-		log.Fatal("Error loading CA certificate and key: ", err)
+		return nil, fmt.Errorf("error generating private key: %v", err)
 	}
 
-	// Prepare certificate template
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	template, err := appCrtTemplate(opts, privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := signLeafCrt(&template, privateKey.Public(), opts.IntermediateCACrt, opts.IntermediateCAKey, opts.RootCACrt, opts.SignatureAlgorithm)
 	if err != nil {
-		log.Fatal("Error generating serial number: ", err)
+		return nil, err
 	}
+	return &AppCrt{Cert: cert, PrivateKey: privateKey}, nil
+}
 
+// appCrtTemplate returns the template of an app cert for publicKey valid for
+// one year.
+func appCrtTemplate(opts CreateAppCrtOptions, publicKey crypto.PublicKey) (x509.Certificate, error) {
+	subject := opts.Subject
+	if subject.CommonName == "" {
+		// The common name may be given like an alt name
+		commonName, err := parseAltName(opts.CommonName)
+		if err != nil {
+			return x509.Certificate{}, err
+		}
+		subject.CommonName = commonName.value
+	}
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if opts.Validity != 0 {
+		notAfter = time.Now().Add(opts.Validity)
+	}
 	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName: opts.CommonName,
-		},
+		Subject:               subject,
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotAfter:              notAfter,
+		KeyUsage:              appKeyUsage(publicKey),
+		ExtKeyUsage:           opts.extKeyUsages(),
 		BasicConstraintsValid: true,
 	}
+	if opts.CriticalExtKeyUsages {
+		extension, err := criticalExtKeyUsageExtension(template.ExtKeyUsage)
+		if err != nil {
+			return x509.Certificate{}, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, extension)
+	}
 
 	for _, altName := range opts.AltNames {
-		if ip := net.ParseIP(altName); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, altName)
+		name, err := parseAltName(altName)
+		if err != nil {
+			return x509.Certificate{}, err
+		}
+		switch name.kind {
+		case "dns":
+			template.DNSNames = append(template.DNSNames, name.value)
+		case "ip":
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(name.value))
+		case "email":
+			template.EmailAddresses = append(template.EmailAddresses, name.value)
+		case "uri":
+			uri, _ := url.Parse(name.value)
+			template.URIs = append(template.URIs, uri)
 		}
 	}
+	return template, nil
+}
 
-	// Create certificate
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, &privateKey.PublicKey, caKey)
-	if err != nil {
-		log.Fatal("Error creating certificate: ", err)
+// altName is a subject alternative name of a kind: dns, ip, email or uri
+type altName struct {
+	kind  string
+	value string
+}
+
+// parseAltName parses an alt name argument. Arguments are dns names or ip
+// addresses unless they have a dns:, ip:, email: or uri: prefix.
+// Internationalized domain names are converted to punycode.
+func parseAltName(argument string) (altName, error) {
+	kind, value, found := strings.Cut(argument, ":")
+	if !found || !slices.Contains([]string{"dns", "ip", "email", "uri"}, strings.ToLower(kind)) {
+		// Ipv6 addresses contain colons too
+		kind, value = "dns", argument
+		if net.ParseIP(argument) != nil {
+			kind = "ip"
+		}
 	}
+	kind = strings.ToLower(kind)
 
-	// Write certificate to file
-	applicationCrtFile := fmt.Sprintf("%s/%s.crt", appCrtDir, opts.AppName)
-	certOut, err := os.Create(applicationCrtFile)
-	if err != nil {
-		log.Fatal("Error creating certificate file: ", err)
+	switch kind {
+	case "dns":
+		dnsName, err := punycodeDomain(value)
+		if err != nil {
+			return altName{}, fmt.Errorf("invalid dns name %s: %v", value, err)
+		}
+		return altName{kind, dnsName}, nil
+	case "ip":
+		if net.ParseIP(value) == nil {
+			return altName{}, fmt.Errorf("invalid ip address %s", value)
+		}
+	case "email":
+		local, domain, found := strings.Cut(value, "@")
+		if !found || local == "" || domain == "" {
+			return altName{}, fmt.Errorf("invalid email address %s", value)
+		}
+		domain, err := punycodeDomain(domain)
+		if err != nil {
+			return altName{}, fmt.Errorf("invalid email address %s: %v", value, err)
+		}
+		return altName{kind, local + "@" + domain}, nil
+	case "uri":
+		uri, err := url.Parse(value)
+		if err != nil || uri.Scheme == "" {
+			return altName{}, fmt.Errorf("invalid uri %s, e.g. spiffe://example.org/service", value)
+		}
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
+	return altName{kind, value}, nil
+}
 
-	// Create fullchain certificate file
-	err = createFullchainCert(opts, applicationCrtFile, appCrtDir)
+// punycodeDomain converts an internationalized domain name to punycode. Ascii
+// names are kept as they are, so wildcards and underscores still work.
+func punycodeDomain(domain string) (string, error) {
+	if strings.IndexFunc(domain, func(r rune) bool { return r > unicode.MaxASCII }) == -1 {
+		return domain, nil
+	}
+	prefix := ""
+	if strings.HasPrefix(domain, "*.") {
+		prefix, domain = "*.", domain[2:]
+	}
+	asciiName, err := idna.Lookup.ToASCII(domain)
 	if err != nil {
-		log.Fatal("Error creating fullchain certificate: ", err)
+		return "", err
 	}
+	return prefix + asciiName, nil
+}
 
-	// Conditionally create PFX file
-	if opts.P12 {
-		pfxOutputFile := fmt.Sprintf("%s/%s.pfx", appCrtDir, opts.AppName)
-		err := createPFX(applicationKeyFile, applicationCrtFile, opts.IntermediateCACrt, opts.RootCACrt, pfxOutputFile, "changeit")
-		if err != nil {
-			// Use Fatalf for consistency with other error handling in this function
-			log.Fatalf("Error creating PFX file: %v", err)
+// generateAppKey generates an app key of keyType: rsa, ecdsa or ed25519.
+func generateAppKey(keyType string, keySize int) (crypto.Signer, error) {
+	switch keyType {
+	case "", "rsa":
+		if keySize == 0 {
+			keySize = 2048
 		}
-		// Add log message about PFX creation
-		log.Info("PFX file created successfully.")
-		log.Info("PFX file path: ", pfxOutputFile)
+		return rsa.GenerateKey(rand.Reader, keySize)
+	case "ecdsa":
+		switch keySize {
+		case 0, 256:
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		return nil, fmt.Errorf("unsupported ecdsa curve size %d, use 256, 384 or 521", keySize)
+	case "ed25519":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
 	}
-
-	log.Info("App certs created successfully.")
-	log.Info("App name: ", opts.AppName)
-	log.Info("Domains: ", opts.AltNames)
-	log.Info("To see your cert files, please check the dir: ", appCrtDir)
+	return nil, fmt.Errorf("unknown key type %s, use rsa, ecdsa or ed25519", keyType)
 }
 
-func loadCACertAndKey(caCertFile, caKeyFile string) (*x509.Certificate, interface{}, error) {
-	// Read CA certificate
-	caCertPEM, err := os.ReadFile(caCertFile)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error reading CA certificate: %v", err)
+// appKeyPEM encodes rsa app keys as PKCS#1 like they always were, and other
+// keys as PKCS#8.
+func appKeyPEM(key crypto.Signer) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), nil
 	}
-	caCertBlock, _ := pem.Decode(caCertPEM)
-	caCert, err := x509.ParseCertificate(caCertBlock.Bytes)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error parsing CA certificate: %v", err)
+		return nil, err
 	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
 
-	// Read CA private key
-	caKeyPEM, err := os.ReadFile(caKeyFile)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error reading CA private key: %v", err)
+// SignAppCsr signs a csr with the intermediate ca. Only the subject and SANs
+// of the csr are used, the validity and usages are the ones of IssueAppCrt.
+func SignAppCsr(opts CreateAppCrtOptions, csrPEM []byte) (*x509.Certificate, error) {
+	csrBlock, _ := pem.Decode(csrPEM)
+	if csrBlock == nil || csrBlock.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("failed to decode csr PEM")
 	}
-	caKeyBlock, _ := pem.Decode(caKeyPEM)
-	caKey, err := x509.ParsePKCS8PrivateKey(caKeyBlock.Bytes)
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error parsing CA private key: %v", err)
+		return nil, fmt.Errorf("error parsing csr: %v", err)
 	}
-
-	return caCert, caKey, nil
+	return signAppCsr(opts, csr)
 }
 
-func createFullchainCert(opts CreateAppCrtOptions, appCertFile, appCrtDir string) error {
-	// Read application certificate
-	appCertPEM, err := os.ReadFile(appCertFile)
-	if err != nil {
-		return fmt.Errorf("error reading application certificate: %v", err)
+func signAppCsr(opts CreateAppCrtOptions, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %v", err)
 	}
 
-	// Read intermediate CA certificate
-	intermediateCACertPEM, err := os.ReadFile(opts.IntermediateCACrt)
-	if err != nil {
-		return fmt.Errorf("error reading intermediate CA certificate: %v", err)
+	template := x509.Certificate{
+		Subject:               csr.Subject,
+		RawSubject:            csr.RawSubject,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		EmailAddresses:        csr.EmailAddresses,
+		URIs:                  csr.URIs,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              appKeyUsage(csr.PublicKey),
+		ExtKeyUsage:           opts.extKeyUsages(),
+		BasicConstraintsValid: true,
 	}
+	return signLeafCrt(&template, csr.PublicKey, opts.IntermediateCACrt, opts.IntermediateCAKey, opts.RootCACrt, opts.SignatureAlgorithm)
+}
 
-	// Read root CA certificate
-	rootCACertPEM, err := os.ReadFile(opts.RootCACrt)
-	if err != nil {
-		return fmt.Errorf("error reading root CA certificate: %v", err)
+// appKeyUsage returns the key usage of an app cert, key encipherment is
+// only used with rsa keys.
+func appKeyUsage(publicKey crypto.PublicKey) x509.KeyUsage {
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
 	}
+	return x509.KeyUsageDigitalSignature
+}
 
-	// Create fullchain certificate file
-	fullchainFile := fmt.Sprintf("%s/fullchain.crt", appCrtDir)
-	out, err := os.Create(fullchainFile)
-	if err != nil {
-		return fmt.Errorf("error creating fullchain certificate file: %v", err)
+func (opts CreateAppCrtOptions) extKeyUsages() []x509.ExtKeyUsage {
+	if len(opts.ExtKeyUsages) == 0 {
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
 	}
-	defer out.Close()
+	return opts.ExtKeyUsages
+}
 
-	// Write certificates to fullchain file
-	out.Write(appCertPEM)
-	out.Write(intermediateCACertPEM)
-	out.Write(rootCACertPEM)
+// Oids of the extended key usages
+var extKeyUsageOids = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageServerAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
 
-	log.Debug("Fullchain certificate created at ", fullchainFile)
-	return nil
+// criticalExtKeyUsageExtension returns a critical extended key usage
+// extension, which replaces the one x509 creates from ExtKeyUsage.
+func criticalExtKeyUsageExtension(extKeyUsages []x509.ExtKeyUsage) (pkix.Extension, error) {
+	var oids []asn1.ObjectIdentifier
+	for _, extKeyUsage := range extKeyUsages {
+		oid, ok := extKeyUsageOids[extKeyUsage]
+		if !ok {
+			return pkix.Extension{}, fmt.Errorf("unsupported extended key usage %d", extKeyUsage)
+		}
+		oids = append(oids, oid)
+	}
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Critical: true, Value: value}, nil
 }
 
-func createPFX(privateKeyFile, certificateFile, intermediateCACertFile, rootCACertFile, pfxOutputFile, password string) error {
-	// Read and parse the private key
-	keyPEM, err := os.ReadFile(privateKeyFile)
+// ChainPEM returns the intermediate ca, the intermediate cas above it, the
+// transition certs of a root ca rollover if any and the root ca, in the order
+// of a fullchain file.
+func ChainPEM(intermediateCACrt, rootCACrt string) ([]byte, error) {
+	intermediateCACertPEM, err := os.ReadFile(intermediateCACrt)
 	if err != nil {
-		return fmt.Errorf("failed to read private key file: %v", err)
+		return nil, fmt.Errorf("error reading intermediate CA certificate: %v", err)
 	}
-	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return fmt.Errorf("failed to decode private key PEM")
+	intermediateCACert, err := readCert(intermediateCACrt)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing intermediate CA certificate: %v", err)
 	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	rootCACertPEM, err := os.ReadFile(rootCACrt)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %v", err)
+		return nil, fmt.Errorf("error reading root CA certificate: %v", err)
+	}
+	chainPEM := intermediateCACertPEM
+	for _, parent := range parentIntermediateCas(filepath.Dir(filepath.Dir(intermediateCACrt)), intermediateCACert) {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parent.Cert.Raw})...)
+	}
+	// During a root ca rollover, the cross-signed roots let clients that trust
+	// either the old or the new root ca build a path
+	if transitionPEM, err := os.ReadFile(filepath.Dir(rootCACrt) + "/transition.crt"); err == nil {
+		chainPEM = append(chainPEM, transitionPEM...)
 	}
+	return append(chainPEM, rootCACertPEM...), nil
+}
 
-	// Read and parse the certificate
-	certPEM, err := os.ReadFile(certificateFile)
+// signLeafCrt signs template with the intermediate ca after checking it
+// against the name constraints and issuance policies, and records the cert
+// in the intermediate ca index. Every leaf cert is issued through it.
+func signLeafCrt(template *x509.Certificate, publicKey crypto.PublicKey, intermediateCACrt, intermediateCAKey, rootCACrt, signatureAlgorithm string) (*x509.Certificate, error) {
+	// Load CA certificate and key
+	caCert, caKey, err := loadCACertAndKey(intermediateCACrt, intermediateCAKey)
 	if err != nil {
-		return fmt.Errorf("failed to read certificate file: %v", err)
+		return nil, fmt.Errorf("error loading CA certificate and key: %v", err)
 	}
-	certBlock, _ := pem.Decode(certPEM)
-	if certBlock == nil {
-		return fmt.Errorf("failed to decode certificate PEM")
+	if signatureAlgorithm != "" {
+		if template.SignatureAlgorithm, err = x509SignatureAlgorithm(signatureAlgorithm, caCert.PublicKey); err != nil {
+			return nil, fmt.Errorf("error checking the signature algorithm of the intermediate ca: %v", err)
+		}
 	}
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+
+	cert, err := createLeafCrt(template, publicKey, caCert, caKey, intermediateCACrt, rootCACrt)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordIssuedCrt(filepath.Dir(intermediateCACrt), cert); err != nil {
+		return nil, fmt.Errorf("error recording certificate in the index: %v", err)
+	}
+	return cert, nil
+}
+
+// createLeafCrt signs template with an already loaded intermediate ca after
+// checking it against the name constraints and issuance policies.
+func createLeafCrt(template *x509.Certificate, publicKey crypto.PublicKey, caCert *x509.Certificate, caKey interface{}, intermediateCACrt, rootCACrt string) (*x509.Certificate, error) {
+	// Prepare certificate serial
+	serialNumber, err := randomSerial()
 	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %v", err)
+		return nil, err
 	}
+	template.SerialNumber = serialNumber
 
-	// Read and parse the intermediate CA certificate
-	intermediatePEM, err := os.ReadFile(intermediateCACertFile)
+	// Refuse names the intermediate ca isn't allowed to sign, clients would reject the cert
+	if err := checkNameConstraints(caCert, template); err != nil {
+		return nil, fmt.Errorf("%w by the name constraints: %v", ErrRequestRefused, err)
+	}
+	// The name constraints and issuance policies of the intermediate cas above it apply as well
+	caDir := filepath.Dir(filepath.Dir(intermediateCACrt))
+	policyCrtFiles := []string{rootCACrt, intermediateCACrt}
+	for _, parent := range parentIntermediateCas(caDir, caCert) {
+		if err := checkNameConstraints(parent.Cert, template); err != nil {
+			return nil, fmt.Errorf("%w by the name constraints of %s: %v", ErrRequestRefused, parent.Name, err)
+		}
+		policyCrtFiles = append(policyCrtFiles, caDir+"/"+parent.Name+"/intermediateCA.crt")
+	}
+	if err := checkIssuancePolicies(template, publicKey, policyCrtFiles...); err != nil {
+		return nil, fmt.Errorf("%w by the issuance policy: %v", ErrRequestRefused, err)
+	}
+
+	// Create certificate
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, publicKey, caKey)
 	if err != nil {
-		return fmt.Errorf("failed to read intermediate CA certificate file: %v", err)
+		return nil, fmt.Errorf("error creating certificate: %v", err)
 	}
-	intermediateBlock, _ := pem.Decode(intermediatePEM)
-	if intermediateBlock == nil {
-		return fmt.Errorf("failed to decode intermediate CA certificate PEM")
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
 	}
-	intermediateCert, err := x509.ParseCertificate(intermediateBlock.Bytes)
+	return cert, nil
+}
+
+// randomSerial returns a random 128 bit certificate serial.
+func randomSerial() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return fmt.Errorf("failed to parse intermediate CA certificate: %v", err)
+		return nil, fmt.Errorf("error generating serial number: %v", err)
 	}
+	return serialNumber, nil
+}
 
-	// Read and parse the root CA certificate
-	rootPEM, err := os.ReadFile(rootCACertFile)
+func loadCACertAndKey(caCertFile, caKeyFile string) (*x509.Certificate, interface{}, error) {
+	// Read CA certificate
+	caCertPEM, err := os.ReadFile(caCertFile)
 	if err != nil {
-		return fmt.Errorf("failed to read root CA certificate file: %v", err)
+		return nil, nil, fmt.Errorf("error reading CA certificate: %v", err)
 	}
-	rootBlock, _ := pem.Decode(rootPEM)
-	if rootBlock == nil {
-		return fmt.Errorf("failed to decode root CA certificate PEM")
+	caCertBlock, _ := pem.Decode(caCertPEM)
+	caCert, err := x509.ParseCertificate(caCertBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing CA certificate: %v", err)
 	}
-	rootCert, err := x509.ParseCertificate(rootBlock.Bytes)
+
+	// Read CA private key
+	caKeyPEM, err := os.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading CA private key: %v", err)
+	}
+	caKeyBlock, _ := pem.Decode(caKeyPEM)
+	caKey, err := x509.ParsePKCS8PrivateKey(caKeyBlock.Bytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse root CA certificate: %v", err)
+		return nil, nil, fmt.Errorf("error parsing CA private key: %v", err)
 	}
 
-	// Create a CA certificates chain
-	caCerts := []*x509.Certificate{intermediateCert, rootCert}
+	return caCert, caKey, nil
+}
+
+// createFullchainCert writes the app cert followed by its chain, the order
+// tls servers send them in.
+func createFullchainCert(opts CreateAppCrtOptions, appCertPEM []byte, fullchainFile string) error {
+	chainPEM, err := ChainPEM(opts.IntermediateCACrt, opts.RootCACrt)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fullchainFile, append(appCertPEM, chainPEM...), 0644); err != nil {
+		return fmt.Errorf("error creating fullchain certificate file: %v", err)
+	}
+	log.Debug("Fullchain certificate created at ", fullchainFile)
+	return nil
+}
 
+// createPFX writes the key and the cert with its ca certs to a password
+// protected PKCS#12 file.
+func createPFX(privateKey crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, pfxOutputFile, password string) error {
 	// Use Modern encoder to create PKCS#12 data with strong encryption
 	pfxData, err := pkcs12.Modern.Encode(privateKey, cert, caCerts, password)
 	if err != nil {
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestSignAppCsrKeepsSubjectAltNames(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+	}
+	createCsr := func(emails []string, uris []string) *x509.CertificateRequest {
+		template := x509.CertificateRequest{
+			Subject:        pkix.Name{CommonName: "app.example.com"},
+			DNSNames:       []string{"app.example.com"},
+			IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+			EmailAddresses: emails,
+		}
+		for _, rawURL := range uris {
+			uri, err := url.Parse(rawURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template.URIs = append(template.URIs, uri)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+
+	csr := createCsr([]string{"ops@example.com"}, []string{"spiffe://example.com/app"})
+	cert, err := signAppCsr(opts, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameSubjectAltNames(csr, cert) {
+		t.Errorf("cert has the SANs %v %v %v %v, want the ones of the csr", cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs)
+	}
+
+	// The email and uri SANs go through the issuance policy like the dns names
+	if err := os.WriteFile(configDir+"/lab/frontend/policy.json", []byte(`{"allowedDomains": ["example.com"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		csr     *x509.CertificateRequest
+		allowed bool
+	}{
+		{"names in domain", createCsr([]string{"ops@example.com"}, []string{"spiffe://example.com/app"}), true},
+		{"email outside domain", createCsr([]string{"ops@attacker.test"}, nil), false},
+		{"uri outside domain", createCsr(nil, []string{"spiffe://attacker.test/app"}), false},
+	} {
+		if _, err := signAppCsr(opts, test.csr); (err == nil) != test.allowed {
+			t.Errorf("%s: signAppCsr() = %v, want allowed %v", test.name, err, test.allowed)
+		}
+	}
+}
+
+func TestAppCrtKeyUsage(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		AltNames:          []string{"app.example.com"},
+	}
+
+	tests := []struct {
+		name     string
+		keyType  string
+		csrKey   crypto.Signer
+		keyUsage x509.KeyUsage
+	}{
+		{"rsa key", "rsa", nil, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{"ecdsa key", "ecdsa", nil, x509.KeyUsageDigitalSignature},
+		{"ed25519 key", "ed25519", nil, x509.KeyUsageDigitalSignature},
+		{"rsa csr", "", rsaKey, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{"ecdsa csr", "", ecdsaKey, x509.KeyUsageDigitalSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cert *x509.Certificate
+			if test.csrKey == nil {
+				opts.KeyType = test.keyType
+				appCrt, err := IssueAppCrt(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert = appCrt.Cert
+			} else {
+				der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: opts.AltNames}, test.csrKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				csr, err := x509.ParseCertificateRequest(der)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cert, err = signAppCsr(opts, csr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if cert.KeyUsage != test.keyUsage {
+				t.Errorf("key usage %b, want %b", cert.KeyUsage, test.keyUsage)
+			}
+		})
+	}
+}
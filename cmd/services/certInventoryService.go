@@ -0,0 +1,268 @@
+package services
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The index of an intermediate ca uses the openssl ca database format, so
+// openssl ca -revoke and -gencrl keep working on it.
+const indexTimeFormat = "060102150405Z"
+
+// indexMutex serializes the index updates of concurrent api requests
+var indexMutex sync.Mutex
+
+// IssuedCrt is an entry of the intermediate ca index
+type IssuedCrt struct {
+	// Serial is the serial number in upper case hex
+	Serial string `json:"serial"`
+	// Subject is the subject in the openssl format, e.g. /CN=crtforge.com
+	Subject string `json:"subject"`
+	// NotAfter is the expiry of the cert
+	NotAfter time.Time `json:"notAfter"`
+	// Revoked is true when the cert is revoked
+	Revoked bool `json:"revoked"`
+	// RevokedAt is the revocation time of a revoked cert
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// recordIssuedCrt adds cert to the index of the intermediate ca in caDir and
+// keeps a copy of it in the newcerts dir.
+func recordIssuedCrt(caDir string, cert *x509.Certificate) error {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	serial := serialHex(cert.SerialNumber)
+	if err := os.MkdirAll(caDir+"/newcerts", 0700); err != nil {
+		return err
+	}
+	if err := writeCertPEM(caDir+"/newcerts/"+serial+".pem", cert); err != nil {
+		return err
+	}
+
+	indexFile, err := os.OpenFile(caDir+"/index.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	_, err = fmt.Fprintf(indexFile, "V\t%s\t\t%s\tunknown\t%s\n", cert.NotAfter.UTC().Format(indexTimeFormat), serial, opensslSubject(cert.Subject))
+	return err
+}
+
+// ListIssuedCrts returns the certs in the index of the intermediate ca in caDir.
+func ListIssuedCrts(caDir string) ([]IssuedCrt, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+	return readIndex(caDir + "/index.txt")
+}
+
+// RevokeCrt marks the cert with the given serial as revoked in the index of
+// the intermediate ca in caDir.
+func RevokeCrt(caDir string, serial string) (*IssuedCrt, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	serialNumber, ok := new(big.Int).SetString(strings.TrimPrefix(serial, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial %s", serial)
+	}
+	serial = serialHex(serialNumber)
+	indexFile := caDir + "/index.txt"
+	indexData, err := os.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(indexData), "\n"), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 || fields[3] != serial {
+			continue
+		}
+		if fields[0] == "R" {
+			return nil, fmt.Errorf("certificate %s is already revoked", serial)
+		}
+		fields[0] = "R"
+		fields[2] = time.Now().UTC().Format(indexTimeFormat)
+		lines[i] = strings.Join(fields, "\t")
+		if err := os.WriteFile(indexFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return parseIndexLine(lines[i])
+	}
+	return nil, fmt.Errorf("certificate %s not found", serial)
+}
+
+// CreateCrl signs a crl with the revoked certs of the intermediate ca index
+// and writes it to the crl dir of the intermediate ca.
+func CreateCrl(intermediateCACrt, intermediateCAKey string) ([]byte, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	caCert, caKey, err := loadCACertAndKey(intermediateCACrt, intermediateCAKey)
+	if err != nil {
+		return nil, err
+	}
+	caDir := filepath.Dir(intermediateCACrt)
+	issuedCrts, err := readIndex(caDir + "/index.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []x509.RevocationListEntry
+	for _, issuedCrt := range issuedCrts {
+		if !issuedCrt.Revoked {
+			continue
+		}
+		serialNumber, ok := new(big.Int).SetString(issuedCrt.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %s in the index", issuedCrt.Serial)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serialNumber, RevocationTime: *issuedCrt.RevokedAt})
+	}
+
+	// The crl number has to grow with every crl
+	crlNumber := big.NewInt(1)
+	crlNumberFile := caDir + "/crlnumber"
+	if crlNumberHex, err := os.ReadFile(crlNumberFile); err == nil {
+		if previous, ok := new(big.Int).SetString(strings.TrimSpace(string(crlNumberHex)), 16); ok {
+			crlNumber = previous
+		}
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    crlNumber,
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().AddDate(0, 0, 30),
+		RevokedCertificateEntries: revoked,
+	}, caCert, caKey.(crypto.Signer))
+	if err != nil {
+		return nil, err
+	}
+	// Only a signed crl uses up its number
+	if err := os.WriteFile(crlNumberFile, []byte(fmt.Sprintf("%X\n", new(big.Int).Add(crlNumber, big.NewInt(1)))), 0600); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(caDir+"/crl", 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(caDir+"/crl/intermediate.crl.pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0644); err != nil {
+		return nil, err
+	}
+	return crlDER, nil
+}
+
+func readIndex(indexFile string) ([]IssuedCrt, error) {
+	file, err := os.Open(indexFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var issuedCrts []IssuedCrt
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		issuedCrt, err := parseIndexLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		issuedCrts = append(issuedCrts, *issuedCrt)
+	}
+	return issuedCrts, scanner.Err()
+}
+
+func parseIndexLine(line string) (*IssuedCrt, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid index line: %s", line)
+	}
+	notAfter, err := time.Parse(indexTimeFormat, fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry in index line: %s", line)
+	}
+	issuedCrt := &IssuedCrt{
+		Serial:   fields[3],
+		Subject:  fields[5],
+		NotAfter: notAfter,
+		Revoked:  fields[0] == "R",
+	}
+	if issuedCrt.Revoked {
+		// openssl may append the revocation reason after a comma
+		revokedAt, err := time.Parse(indexTimeFormat, strings.Split(fields[2], ",")[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid revocation date in index line: %s", line)
+		}
+		issuedCrt.RevokedAt = &revokedAt
+	}
+	return issuedCrt, nil
+}
+
+func serialHex(serialNumber *big.Int) string {
+	serial := fmt.Sprintf("%X", serialNumber)
+	// openssl writes an even number of hex digits
+	if len(serial)%2 == 1 {
+		serial = "0" + serial
+	}
+	return serial
+}
+
+// opensslSubject formats name like openssl does in its index, most
+// significant attribute first.
+func opensslSubject(name pkix.Name) string {
+	var subject strings.Builder
+	for _, attribute := range name.ToRDNSequence() {
+		for _, value := range attribute {
+			key := value.Type.String()
+			switch {
+			case value.Type.Equal([]int{2, 5, 4, 3}):
+				key = "CN"
+			case value.Type.Equal([]int{2, 5, 4, 6}):
+				key = "C"
+			case value.Type.Equal([]int{2, 5, 4, 7}):
+				key = "L"
+			case value.Type.Equal([]int{2, 5, 4, 8}):
+				key = "ST"
+			case value.Type.Equal([]int{2, 5, 4, 10}):
+				key = "O"
+			case value.Type.Equal([]int{2, 5, 4, 11}):
+				key = "OU"
+			case value.Type.Equal(oidEmailAddress):
+				key = "emailAddress"
+			}
+			fmt.Fprintf(&subject, "/%s=%s", key, escapeOpensslValue(fmt.Sprint(value.Value)))
+		}
+	}
+	return subject.String()
+}
+
+// escapeOpensslValue escapes the bytes outside printable ascii as \xHH like
+// openssl, so a value can't add fields or lines to the index.
+func escapeOpensslValue(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' || value[i] > '~' {
+			fmt.Fprintf(&escaped, "\\x%02X", value[i])
+			continue
+		}
+		escaped.WriteByte(value[i])
+	}
+	return escaped.String()
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOpensslSubject(t *testing.T) {
+	tests := []struct {
+		name    pkix.Name
+		subject string
+	}{
+		{pkix.Name{CommonName: "app.example.com"}, "/CN=app.example.com"},
+		{pkix.Name{Organization: []string{"Example Corp"}, CommonName: "app"}, "/O=Example Corp/CN=app"},
+		{pkix.Name{CommonName: "app\nR\t991231235959Z"}, `/CN=app\x0AR\x09991231235959Z`},
+		{pkix.Name{CommonName: "bücher"}, `/CN=b\xC3\xBCcher`},
+	}
+	for _, test := range tests {
+		if subject := opensslSubject(test.name); subject != test.subject {
+			t.Errorf("opensslSubject(%v) = %q, want %q", test.name, subject, test.subject)
+		}
+	}
+}
+
+func TestRevokeAndCreateCrl(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	caDir := configDir + "/lab/frontend"
+
+	var serials []string
+	for _, commonName := range []string{"a.example.com", "b.example.com\nR\t991231235959Z\t\t01\tunknown\t/CN=evil"} {
+		appCrt, err := IssueAppCrt(CreateAppCrtOptions{
+			IntermediateCACrt: intermediateCA.IntermediateCACrt,
+			IntermediateCAKey: intermediateCA.IntermediateCAKey,
+			RootCACrt:         rootCACrt,
+			CommonName:        commonName,
+			AltNames:          []string{"a.example.com"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		serials = append(serials, serialHex(appCrt.Cert.SerialNumber))
+	}
+	issuedCrts, err := ListIssuedCrts(caDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuedCrts) != 2 {
+		t.Fatalf("index has %d certs, want 2", len(issuedCrts))
+	}
+
+	if _, err := RevokeCrt(caDir, serials[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevokeCrt(caDir, serials[1]); err == nil {
+		t.Error("revoked a cert twice")
+	}
+	if _, err := RevokeCrt(caDir, "ABCDEF"); err == nil {
+		t.Error("revoked an unknown cert")
+	}
+
+	for i, number := range []int64{1, 2} {
+		crlDER, err := CreateCrl(intermediateCA.IntermediateCACrt, intermediateCA.IntermediateCAKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseRevocationList(crlDER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if crl.Number.Cmp(big.NewInt(number)) != 0 {
+			t.Errorf("crl %d has number %v, want %d", i, crl.Number, number)
+		}
+		if len(crl.RevokedCertificateEntries) != 1 || serialHex(crl.RevokedCertificateEntries[0].SerialNumber) != serials[1] {
+			t.Errorf("crl %d doesn't list the revoked cert %s", i, serials[1])
+		}
+	}
+
+	// A failed signature doesn't use up a crl number, a leaf cert can't sign crls
+	leaf, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		KeyType:           "ecdsa",
+		AltNames:          []string{"leaf.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDir := t.TempDir()
+	leafKeyDER, err := x509.MarshalPKCS8PrivateKey(leaf.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCertPEM(leafDir+"/leaf.crt", leaf.Cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(leafDir+"/leaf.key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: leafKeyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(leafDir+"/crlnumber", []byte("07\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCrl(leafDir+"/leaf.crt", leafDir+"/leaf.key"); err == nil {
+		t.Fatal("crl signed by a leaf cert")
+	}
+	crlNumber, err := os.ReadFile(leafDir + "/crlnumber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(crlNumber)) != "07" {
+		t.Errorf("crlnumber is %s after a failed crl, want 07", crlNumber)
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type BuildChainOptions struct {
+	// Leaf is the file with the leaf cert. It may be a whole bundle, the
+	// leaf is then the only cert that issued none of the others
+	Leaf string
+	// Pool are files and dirs with candidate issuer certs
+	Pool []string
+	// CADir is the crtforge ca dir, its intermediate cas are added to the pool
+	CADir string
+	// RootCACrt is the root ca crt file, or trust bundle, the chain has to reach
+	RootCACrt string
+	// Output is the chain file, stdout when empty
+	Output string
+}
+
+// BuildChain writes the chain of a leaf cert in the order createFullchainCert
+// writes it, with the issuers found in the pool. Duplicates and unrelated
+// certs are dropped.
+func BuildChain(opts BuildChainOptions) {
+	leafCerts, err := readChainCerts(opts.Leaf)
+	if err != nil {
+		log.Fatal("Error while reading leaf: ", err)
+	}
+	leafCerts = uniqueCerts(leafCerts)
+	if len(leafCerts) == 0 {
+		log.Fatal("No certificate found in ", opts.Leaf)
+	}
+	leaf := leafCerts[0]
+	if len(leafCerts) > 1 {
+		if leaf = chainLeaf(leafCerts); leaf == nil {
+			log.Fatal("Found no single leaf cert in ", opts.Leaf, ", pass only the leaf cert.")
+		}
+	}
+
+	// The certs of the leaf file come first, then the pool and the crtforge
+	// cas to repair missing intermediates
+	pool := leafCerts
+	for _, path := range opts.Pool {
+		err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			certs, err := readChainCerts(file)
+			if err != nil {
+				log.Debug("Skipping ", file, ": ", err)
+				return nil
+			}
+			pool = append(pool, certs...)
+			return nil
+		})
+		if err != nil {
+			log.Fatal("Error while reading pool: ", err)
+		}
+	}
+	roots, err := readChainCerts(opts.RootCACrt)
+	if err != nil {
+		log.Warn("No crtforge root ca to trust: ", err)
+	}
+	if entries, err := os.ReadDir(opts.CADir); err == nil {
+		for _, entry := range entries {
+			if intermediateCert, err := readCert(opts.CADir + "/" + entry.Name() + "/intermediateCA.crt"); err == nil {
+				pool = append(pool, intermediateCert)
+			}
+		}
+	}
+	pool = uniqueCerts(append(pool, roots...))
+
+	chain, others := buildChain(leaf, pool)
+	for _, cert := range others {
+		if slices.ContainsFunc(leafCerts, cert.Equal) {
+			log.Warn("Dropped unrelated cert ", cert.Subject.String())
+		}
+	}
+
+	var chainPEM []byte
+	for _, cert := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if opts.Output == "" {
+		os.Stdout.Write(chainPEM)
+	} else if err := os.WriteFile(opts.Output, chainPEM, 0644); err != nil {
+		log.Fatal("Error while writing chain: ", err)
+	}
+
+	for i, cert := range chain {
+		log.Info(fmt.Sprintf("  %d: %s", i, cert.Subject.String()))
+	}
+	last := chain[len(chain)-1]
+	if !slices.ContainsFunc(roots, last.Equal) {
+		if isSelfSigned(last) {
+			log.Warn("The chain ends at a root that is not a trusted crtforge root: ", last.Subject.String())
+		} else {
+			log.Warn("The chain is incomplete, no issuer found for ", last.Subject.String())
+		}
+		return
+	}
+	rootPool := x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		log.Warn("The chain reaches the crtforge root but does not verify: ", err)
+		return
+	}
+	log.Info("The chain reaches the trusted crtforge root ", last.Subject.String())
+}
+
+// readChainCerts returns the certs of a pem, der or PKCS#7 file.
+func readChainCerts(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	format := detectConvertFormat(data)
+	if format == "pkcs12" || format == "jks" {
+		return nil, fmt.Errorf("%s files are not read as chain certs", format)
+	}
+	_, certs, err := readConvertInput(data, format, "", "")
+	return certs, err
+}
+
+// uniqueCerts drops duplicate certs, keeping the first one.
+func uniqueCerts(certs []*x509.Certificate) []*x509.Certificate {
+	var unique []*x509.Certificate
+	for _, cert := range certs {
+		if !slices.ContainsFunc(unique, cert.Equal) {
+			unique = append(unique, cert)
+		}
+	}
+	return unique
+}
+
+// chainLeaf returns the only cert that issued none of the others, preferring
+// the only one that is not a ca. It returns nil when there is no such cert.
+func chainLeaf(certs []*x509.Certificate) *x509.Certificate {
+	var leaves []*x509.Certificate
+	for _, cert := range certs {
+		if !slices.ContainsFunc(certs, func(other *x509.Certificate) bool { return other != cert && issuedBy(other, cert) }) {
+			leaves = append(leaves, cert)
+		}
+	}
+	// Bundles may have unrelated roots next to the leaf
+	if len(leaves) > 1 {
+		leaves = slices.DeleteFunc(leaves, func(cert *x509.Certificate) bool { return cert.IsCA })
+	}
+	if len(leaves) != 1 {
+		return nil
+	}
+	return leaves[0]
+}
+
+// buildChain returns the leaf followed by its issuers from pool, in the
+// order createFullchainCert writes them, and the certs of pool that are not
+// part of the chain.
+func buildChain(leaf *x509.Certificate, pool []*x509.Certificate) ([]*x509.Certificate, []*x509.Certificate) {
+	chain := []*x509.Certificate{leaf}
+	for last := leaf; !isSelfSigned(last); {
+		index := slices.IndexFunc(pool, func(cert *x509.Certificate) bool {
+			return !slices.ContainsFunc(chain, cert.Equal) && issuedBy(last, cert)
+		})
+		if index < 0 {
+			break
+		}
+		last = pool[index]
+		chain = append(chain, last)
+	}
+	var others []*x509.Certificate
+	for _, cert := range pool {
+		if !slices.ContainsFunc(chain, cert.Equal) {
+			others = append(others, cert)
+		}
+	}
+	return chain, others
+}
+
+// issuedBy reports whether issuer signed cert, matching the authority key id
+// of cert with the subject key id of issuer when both are set.
+func issuedBy(cert, issuer *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 && !bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId) {
+		return false
+	}
+	return cert.CheckSignatureFrom(issuer) == nil
+}
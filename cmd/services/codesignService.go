@@ -0,0 +1,168 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type CreateCodesignCrtOptions struct {
+	// Name is the common name of the cert, e.g. the publisher
+	Name string
+	// AppCrt are the options of the cert. The names and usages are set for
+	// code signing
+	AppCrt CreateAppCrtOptions
+}
+
+type SignFileOptions struct {
+	// File is the file to sign
+	File string
+	// Output is the detached signature file, File with a .p7s suffix when empty
+	Output string
+	// SignerCrt is the crt file of the code signing cert
+	SignerCrt string
+	// SignerKey is the key file of the code signing cert
+	SignerKey string
+	// ChainCrt is a pem file with the intermediate ca certs added to the
+	// signature, e.g. the fullchain of the signer. Root certs are left out
+	ChainCrt string
+}
+
+type VerifyFileOptions struct {
+	// File is the signed file
+	File string
+	// Signature is the detached signature file, File with a .p7s suffix when empty
+	Signature string
+	// RootCACrt is the root ca crt file, or trust bundle, the signer has to chain to
+	RootCACrt string
+}
+
+// CreateCodesignCrt issues a cert that is only valid for code signing.
+func CreateCodesignCrt(opts CreateCodesignCrtOptions) {
+	appCrtOpts := opts.AppCrt
+	appCrtOpts.Subject.CommonName = opts.Name
+	appCrtOpts.AltNames = nil
+	appCrtOpts.ExtKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	if appCrtOpts.AppName == "" {
+		appCrtOpts.AppName = opts.Name
+	}
+	CreateAppCrt(appCrtOpts)
+	log.Info("Sign files with: crtforge sign-file <file> --signer ", appCrtOpts.AppName)
+}
+
+// SignFile writes a detached CMS signature of a file, DER encoded.
+func SignFile(opts SignFileOptions) {
+	content, err := os.ReadFile(opts.File)
+	if err != nil {
+		log.Fatal("Error while reading file: ", err)
+	}
+	signerCert, signerKey, err := readCertAndKey(opts.SignerCrt, opts.SignerKey)
+	if err != nil {
+		log.Fatal("Error while reading signer: ", err)
+	}
+	if !hasExtKeyUsage(signerCert, x509.ExtKeyUsageCodeSigning) {
+		log.Warn("The signer cert is not valid for code signing: ", signerCert.Subject.String())
+	}
+
+	var chain []*x509.Certificate
+	if opts.ChainCrt != "" {
+		chainPEM, err := os.ReadFile(opts.ChainCrt)
+		if err != nil {
+			log.Fatal("Error while reading chain: ", err)
+		}
+		certs, err := parseCertsPEM(chainPEM)
+		if err != nil {
+			log.Fatal("Error while parsing chain: ", err)
+		}
+		for _, cert := range certs {
+			if !cert.Equal(signerCert) && !isSelfSigned(cert) {
+				chain = append(chain, cert)
+			}
+		}
+	}
+
+	signature, err := signDetachedPKCS7(content, signerCert, signerKey, chain)
+	if err != nil {
+		log.Fatal("Error while signing file: ", err)
+	}
+	output := opts.Output
+	if output == "" {
+		output = opts.File + ".p7s"
+	}
+	if err := os.WriteFile(output, signature, 0644); err != nil {
+		log.Fatal("Error while writing signature: ", err)
+	}
+	log.Info("File signed by ", signerCert.Subject.String())
+	log.Info("SHA-256: ", sha256Hex(content))
+	log.Info("Signature: ", output)
+}
+
+// VerifyFile checks a detached signature of a file and that its signer is a
+// code signing cert issued under the root ca. It returns the signer cert.
+func VerifyFile(opts VerifyFileOptions) (*x509.Certificate, error) {
+	content, err := os.ReadFile(opts.File)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	signatureFile := opts.Signature
+	if signatureFile == "" {
+		signatureFile = opts.File + ".p7s"
+	}
+	signature, err := os.ReadFile(signatureFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %v", err)
+	}
+	// Signatures converted by other tools may be pem encoded
+	if block, _ := pem.Decode(signature); block != nil {
+		signature = block.Bytes
+	}
+	signed, err := parseDetachedPKCS7Signed(signature, content)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying signature: %v", err)
+	}
+	// An attached signature verifies its own content, not the file next to it
+	if !bytes.Equal(signed.Content, content) {
+		return nil, fmt.Errorf("error verifying signature: the signature carries content that differs from %s", opts.File)
+	}
+
+	rootsPEM, err := os.ReadFile(opts.RootCACrt)
+	if err != nil {
+		return nil, fmt.Errorf("error reading root CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificate found in root CA file %s", opts.RootCACrt)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range signed.Certs {
+		intermediates.AddCert(cert)
+	}
+	if _, err := signed.Signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return signed.Signer, fmt.Errorf("signer %s is not trusted for code signing: %v", signed.Signer.Subject.String(), err)
+	}
+	return signed.Signer, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, extKeyUsage := range cert.ExtKeyUsage {
+		if extKeyUsage == usage || extKeyUsage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func sha256Hex(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+func TestVerifyFile(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "signing")
+	signer, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		CommonName:        "Example Corp",
+		ExtKeyUsages:      []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateCert, err := readCert(intermediateCA.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []*x509.Certificate{intermediateCert}
+
+	file := configDir + "/release.tar.gz"
+	if err := os.WriteFile(file, []byte("release"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	detached, err := signDetachedPKCS7([]byte("release"), signer.Cert, signer.PrivateKey, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file+".p7s", detached, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(VerifyFileOptions{File: file, RootCACrt: rootCACrt}); err != nil {
+		t.Errorf("detached signature of the file was refused: %v", err)
+	}
+
+	// An attached signature of other content next to the file
+	attached, err := signPKCS7([]byte("something else"), signer.Cert, signer.PrivateKey, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file+".p7s", attached, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(VerifyFileOptions{File: file, RootCACrt: rootCACrt}); err == nil {
+		t.Error("attached signature of other content verified the file")
+	}
+
+	// An attached signature of the file itself is still a signature of it
+	attached, err = signPKCS7([]byte("release"), signer.Cert, signer.PrivateKey, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file+".p7s", attached, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(VerifyFileOptions{File: file, RootCACrt: rootCACrt}); err != nil {
+		t.Errorf("attached signature of the file was refused: %v", err)
+	}
+}
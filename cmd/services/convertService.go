@@ -0,0 +1,484 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ConvertFormats are the formats convert reads and writes:
+//   - pem: certs and keys in any pem encoding, encrypted PKCS#8 keys too
+//   - der: a single DER encoded cert, and a DER PKCS#8 key file
+//   - pkcs12: a pfx with a key and its chain, or a trust store
+//   - pkcs7: a certs-only PKCS#7 file like .p7b
+//   - jks: a Java keystore with a key and its chain, or trusted certs
+var ConvertFormats = []string{"pem", "der", "pkcs12", "pkcs7", "jks"}
+
+// defaultKeystorePassword is the password of written keystores when none is set
+const defaultKeystorePassword = "changeit"
+
+type ConvertOptions struct {
+	// Input is the file to convert
+	Input string
+	// From is the format of Input, detected from its content when empty
+	From string
+	// Key is an extra key file for the certs of Input, e.g. for a pem cert
+	Key string
+	// Password is the password of Input and Key
+	Password string
+	// Output is the converted file
+	Output string
+	// To is the format of Output, derived from its extension when empty
+	To string
+	// KeyOutput is a separate file for the key. Formats without keys need it
+	// to keep the key
+	KeyOutput string
+	// OutPassword is the password of Output and KeyOutput. Keystores keep
+	// Password when it is empty, pem and der keys are only encrypted when it
+	// is set
+	OutPassword string
+	// Alias is the alias of the key in JKS keystores
+	Alias string
+}
+
+// convertBundle is the content of a converted file
+type convertBundle struct {
+	// Key is the private key, if any
+	Key crypto.Signer
+	// Chain is the leaf cert followed by its issuers up to the root
+	Chain []*x509.Certificate
+	// Others are the certs that are not part of the chain, e.g. trusted certs
+	Others []*x509.Certificate
+}
+
+func (bundle convertBundle) certs() []*x509.Certificate {
+	return append(slices.Clone(bundle.Chain), bundle.Others...)
+}
+
+// Convert converts certs and keys between pem, der, PKCS#12, PKCS#7 and JKS.
+// The key has to match one of the certs, which is written first followed by
+// its chain in issuing order.
+func Convert(opts ConvertOptions) {
+	if opts.Output == "" {
+		log.Fatal("The output file is required.")
+	}
+	if inputPath, err := filepath.Abs(opts.Input); err == nil {
+		if outputPath, err := filepath.Abs(opts.Output); err == nil && inputPath == outputPath {
+			log.Fatal("The output file has to differ from the input file.")
+		}
+	}
+	data, err := os.ReadFile(opts.Input)
+	if err != nil {
+		log.Fatal("Error while reading input: ", err)
+	}
+	from := opts.From
+	if from == "" {
+		from = detectConvertFormat(data)
+	}
+	to := opts.To
+	if to == "" {
+		to = convertFormatFromExt(opts.Output)
+		if to == "" {
+			log.Fatal("Unknown output format of ", opts.Output, ", set it with --to: ", strings.Join(ConvertFormats, ", "))
+		}
+	}
+	for _, format := range []string{from, to} {
+		if !slices.Contains(ConvertFormats, format) {
+			log.Fatal("Unknown format ", format, ", use one of: ", strings.Join(ConvertFormats, ", "))
+		}
+	}
+
+	key, certs, err := readConvertInput(data, from, opts.Password, opts.Alias)
+	if err != nil {
+		log.Fatal("Error while reading ", from, " input: ", err)
+	}
+	if opts.Key != "" {
+		if key != nil {
+			log.Fatal("The input already has a private key.")
+		}
+		keyData, err := os.ReadFile(opts.Key)
+		if err != nil {
+			log.Fatal("Error while reading key: ", err)
+		}
+		if key, _, err = readConvertInput(keyData, detectConvertFormat(keyData), opts.Password, opts.Alias); err != nil {
+			log.Fatal("Error while reading key: ", err)
+		}
+		if key == nil {
+			log.Fatal("No private key found in ", opts.Key)
+		}
+	}
+	bundle, err := orderConvertBundle(key, certs)
+	if err != nil {
+		log.Fatal("Error while ordering certs: ", err)
+	}
+
+	if err := writeConvertOutput(opts, to, bundle); err != nil {
+		log.Fatal("Error while writing ", to, " output: ", err)
+	}
+
+	log.Info("Converted ", from, " to ", to, ": ", opts.Output)
+	for i, cert := range bundle.certs() {
+		log.Info(fmt.Sprintf("  %d: %s", i, cert.Subject.String()))
+	}
+	if bundle.Key != nil && len(bundle.Chain) > 0 {
+		log.Info("The private key matches ", bundle.Chain[0].Subject.String())
+	}
+}
+
+// detectConvertFormat guesses the format of a file from its content.
+func detectConvertFormat(data []byte) string {
+	if len(data) >= 4 {
+		if magic := binary.BigEndian.Uint32(data); magic == jksMagic || magic == jceksMagic {
+			return "jks"
+		}
+	}
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		return "pem"
+	}
+	if _, err := parsePKCS7Certs(data); err == nil {
+		return "pkcs7"
+	}
+	if _, err := x509.ParseCertificate(data); err == nil {
+		return "der"
+	}
+	if _, err := parsePrivateKey(data); err == nil {
+		return "der"
+	}
+	return "pkcs12"
+}
+
+// convertFormatFromExt returns the format of the usual extension of a file.
+func convertFormatFromExt(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".pem", ".crt", ".cer", ".key":
+		return "pem"
+	case ".der":
+		return "der"
+	case ".p12", ".pfx":
+		return "pkcs12"
+	case ".p7b", ".p7c":
+		return "pkcs7"
+	case ".jks", ".keystore", ".truststore":
+		return "jks"
+	}
+	return ""
+}
+
+// readConvertInput returns the key and the certs of a file.
+func readConvertInput(data []byte, format, password, alias string) (crypto.Signer, []*x509.Certificate, error) {
+	switch format {
+	case "pem":
+		return readConvertPEM(data, password)
+	case "der":
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			return nil, []*x509.Certificate{cert}, nil
+		}
+		if password != "" {
+			if decrypted, err := decryptPKCS8(data, password); err == nil {
+				data = decrypted
+			}
+		}
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("neither a DER cert nor a DER key")
+		}
+		return key, nil, nil
+	case "pkcs7":
+		certs, err := parsePKCS7Certs(data)
+		return nil, certs, err
+	case "pkcs12":
+		return readConvertPKCS12(data, password)
+	case "jks":
+		return readConvertJKS(data, password, alias)
+	}
+	return nil, nil, fmt.Errorf("unknown format %s", format)
+}
+
+func readConvertPEM(data []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error parsing certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		case block.Type == "PKCS7":
+			pkcs7Certs, err := parsePKCS7Certs(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, pkcs7Certs...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if key != nil {
+				return nil, nil, fmt.Errorf("found more than one private key")
+			}
+			if _, ok := block.Headers["Proc-Type"]; ok {
+				return nil, nil, fmt.Errorf("legacy encrypted pem keys are not supported, convert the key with openssl pkcs8 -topk8")
+			}
+			der := block.Bytes
+			if block.Type == "ENCRYPTED PRIVATE KEY" {
+				if password == "" {
+					return nil, nil, fmt.Errorf("the private key is encrypted, set its password")
+				}
+				decrypted, err := decryptPKCS8(der, password)
+				if err != nil {
+					return nil, nil, err
+				}
+				der = decrypted
+			}
+			parsedKey, err := parsePrivateKey(der)
+			if err != nil {
+				return nil, nil, err
+			}
+			key = parsedKey
+		default:
+			log.Debug("Skipping pem block ", block.Type)
+		}
+	}
+	if key == nil && len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate or private key found")
+	}
+	return key, certs, nil
+}
+
+func readConvertPKCS12(data []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	privateKey, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	// Keystores written without a password have the default password
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) && password == "" {
+		password = defaultKeystorePassword
+		privateKey, cert, caCerts, err = pkcs12.DecodeChain(data, password)
+	}
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return nil, nil, fmt.Errorf("wrong PKCS#12 password")
+	}
+	if err != nil {
+		// Java trust stores have no key
+		certs, trustStoreErr := pkcs12.DecodeTrustStore(data, password)
+		if trustStoreErr != nil {
+			return nil, nil, fmt.Errorf("%v, PKCS#12 files without a key are only read as Java trust stores", err)
+		}
+		return nil, certs, nil
+	}
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	return key, append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+func readConvertJKS(data []byte, password, alias string) (crypto.Signer, []*x509.Certificate, error) {
+	if password == "" {
+		password = defaultKeystorePassword
+	}
+	entries, err := decodeJKS(data, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keyAliases []string
+	for _, entry := range entries {
+		if entry.Key != nil {
+			keyAliases = append(keyAliases, entry.Alias)
+		}
+	}
+	if alias == "" && len(keyAliases) > 1 {
+		return nil, nil, fmt.Errorf("the keystore has %d keys, select one with the alias: %s", len(keyAliases), strings.Join(keyAliases, ", "))
+	}
+	if alias != "" && !slices.Contains(keyAliases, alias) {
+		return nil, nil, fmt.Errorf("no key with alias %s in the keystore", alias)
+	}
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if entry.Key != nil && alias != "" && entry.Alias != alias {
+			continue
+		}
+		if entry.Key != nil {
+			key = entry.Key
+		}
+		certs = append(certs, entry.Certs...)
+	}
+	return key, certs, nil
+}
+
+// orderConvertBundle finds the cert of the key, or the only leaf of the certs,
+// and orders its chain. Duplicates are dropped.
+func orderConvertBundle(key crypto.Signer, certs []*x509.Certificate) (convertBundle, error) {
+	unique := uniqueCerts(certs)
+	// A key alone can be converted between pem and der
+	if len(unique) == 0 {
+		return convertBundle{Key: key}, nil
+	}
+
+	var leaf *x509.Certificate
+	if key != nil {
+		for _, cert := range unique {
+			if checkKeyMatchesCert(cert, key) == nil {
+				leaf = cert
+				break
+			}
+		}
+		if leaf == nil {
+			return convertBundle{}, fmt.Errorf("the private key does not match any of the %d certificates", len(unique))
+		}
+	} else if leaf = chainLeaf(unique); leaf == nil {
+		// Trust stores have several unrelated certs, they keep their order
+		return convertBundle{Others: unique}, nil
+	}
+
+	chain, others := buildChain(leaf, unique)
+	if len(others) > 0 {
+		log.Warn(len(others), " certs are not part of the chain of ", leaf.Subject.String(), " and are written after it.")
+	}
+	return convertBundle{Key: key, Chain: chain, Others: others}, nil
+}
+
+func writeConvertOutput(opts ConvertOptions, to string, bundle convertBundle) error {
+	certs := bundle.certs()
+	// Keystores keep the password of the input, pem and der keys are only
+	// encrypted with an output password
+	password := opts.OutPassword
+	keystorePassword := opts.OutPassword
+	if keystorePassword == "" {
+		keystorePassword = opts.Password
+	}
+	if keystorePassword == "" {
+		keystorePassword = defaultKeystorePassword
+	}
+	if bundle.Key != nil && opts.KeyOutput == "" && (to == "der" || to == "pkcs7") {
+		log.Warn("The ", to, " format has no private key, set --key-out to keep it.")
+	}
+
+	var data []byte
+	var err error
+	if len(certs) == 0 {
+		if to != "pem" && to != "der" {
+			return fmt.Errorf("no certificate found, a key alone can only be written as pem or der")
+		}
+		if data, err = convertKey(bundle.Key, to == "der", password); err != nil {
+			return err
+		}
+		return os.WriteFile(opts.Output, data, 0600)
+	}
+	switch to {
+	case "pem":
+		for _, cert := range certs {
+			data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		if bundle.Key != nil && opts.KeyOutput == "" {
+			keyPEM, err := convertKey(bundle.Key, false, password)
+			if err != nil {
+				return err
+			}
+			data = append(data, keyPEM...)
+		}
+	case "der":
+		if len(certs) > 1 {
+			log.Warn("The der format has a single cert, the other ", len(certs)-1, " certs are left out.")
+		}
+		data = certs[0].Raw
+	case "pkcs7":
+		data, err = encodeCertsOnlyPKCS7(certs)
+	case "pkcs12":
+		if bundle.Key != nil {
+			data, err = pkcs12.Modern.Encode(bundle.Key, certs[0], certs[1:], keystorePassword)
+		} else {
+			data, err = pkcs12.Modern.EncodeTrustStore(certs, keystorePassword)
+		}
+	case "jks":
+		data, err = encodeJKS(convertJKSEntries(opts.Alias, bundle), keystorePassword)
+	}
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if bundle.Key != nil && (to == "pem" && opts.KeyOutput == "" || to == "pkcs12" || to == "jks") {
+		mode = 0600
+	}
+	if err := os.WriteFile(opts.Output, data, mode); err != nil {
+		return err
+	}
+	if (to == "pkcs12" || to == "jks") && keystorePassword == defaultKeystorePassword {
+		log.Info("Keystore password: ", defaultKeystorePassword)
+	}
+
+	if bundle.Key != nil && opts.KeyOutput != "" {
+		keyData, err := convertKey(bundle.Key, to == "der", password)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(opts.KeyOutput, keyData, 0600); err != nil {
+			return err
+		}
+		log.Info("Private key: ", opts.KeyOutput)
+	}
+	return nil
+}
+
+// convertKey encodes a key as PKCS#8, encrypted when a password is set.
+func convertKey(key crypto.Signer, der bool, password string) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	blockType := "PRIVATE KEY"
+	if password != "" {
+		if keyDER, err = encryptPKCS8(keyDER, password); err != nil {
+			return nil, err
+		}
+		blockType = "ENCRYPTED PRIVATE KEY"
+	}
+	if der {
+		return keyDER, nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: keyDER}), nil
+}
+
+// convertJKSEntries returns the key with its chain and the other certs as
+// trusted certs, with lower case aliases like keytool.
+func convertJKSEntries(alias string, bundle convertBundle) []jksEntry {
+	var entries []jksEntry
+	aliases := map[string]bool{}
+	uniqueAlias := func(alias string, cert *x509.Certificate) string {
+		if alias == "" {
+			alias = cert.Subject.CommonName
+		}
+		if alias == "" {
+			alias = serialHex(cert.SerialNumber)
+		}
+		alias = strings.ToLower(alias)
+		unique := alias
+		for i := 2; aliases[unique]; i++ {
+			unique = fmt.Sprintf("%s-%d", alias, i)
+		}
+		aliases[unique] = true
+		return unique
+	}
+	trusted := bundle.certs()
+	if bundle.Key != nil {
+		entries = append(entries, jksEntry{Alias: uniqueAlias(alias, bundle.Chain[0]), Key: bundle.Key, Certs: bundle.Chain})
+		trusted = bundle.Others
+	}
+	for _, cert := range trusted {
+		entries = append(entries, jksEntry{Alias: uniqueAlias("", cert), Certs: []*x509.Certificate{cert}})
+	}
+	return entries
+}
@@ -1,10 +1,26 @@
 package services
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 )
 
+// caNamePattern matches the root and intermediate ca names that are safe to
+// use as a single directory name.
+var caNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// checkCaName refuses a ca name that would leave its directory, e.g. one
+// with a path separator or a dot segment.
+func checkCaName(name string) error {
+	if !caNamePattern.MatchString(name) || filepath.Base(name) != name || name == "." || name == ".." {
+		return fmt.Errorf("invalid ca name %q", name)
+	}
+	return nil
+}
+
 func CreateCaDir(configDir string, caName string) string {
 	defaultCADir := configDir + "/" + caName
 	if _, err := os.Stat(defaultCADir); os.IsNotExist(err) {
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// createTestCaChain creates a root and an intermediate ca in configDir/name
+// like the cli does.
+func createTestCaChain(t *testing.T, configDir, name, intermediateCaName string) (string, IntermediateCA) {
+	t.Helper()
+	caDir := CreateCaDir(configDir, name)
+	rootCACrt, rootCACnf, _ := CreateRootCa(CreateRootCAOptions{
+		ConfigDirectory:     caDir,
+		RootCAName:          name,
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+	})
+	intermediateCA := CreateIntermediateCa(CreateIntermediateCAOptions{
+		ConfigDirectory:     caDir,
+		RootCACnf:           rootCACnf,
+		IntermediateCAName:  intermediateCaName,
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+	})
+	return rootCACrt, intermediateCA
+}
+
+var errTestFatal = errors.New("log.Fatal called")
+
+// expectFatal runs f and fails the test unless f ends with log.Fatal.
+func expectFatal(t *testing.T, f func()) {
+	t.Helper()
+	logger := log.StandardLogger()
+	exitFunc := logger.ExitFunc
+	logger.ExitFunc = func(int) { panic(errTestFatal) }
+	defer func() {
+		logger.ExitFunc = exitFunc
+		recovered := recover()
+		if recovered == nil {
+			t.Error("expected a fatal error")
+		} else if recovered != errTestFatal {
+			panic(recovered)
+		}
+	}()
+	f()
+}
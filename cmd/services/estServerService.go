@@ -0,0 +1,225 @@
+package services
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type EstServerOptions struct {
+	// Listen is the address the est server listens on, e.g. :9443
+	Listen string
+	// TLSCrt is the crt file of the est server
+	TLSCrt string
+	// TLSKey is the key file of the est server
+	TLSKey string
+	// ClientCACrt is the ca crt file client certs are verified with
+	ClientCACrt string
+	// Username is the http basic auth username, basic auth is disabled when empty
+	Username string
+	// Password is the http basic auth password
+	Password string
+	// IntermediateCACrt is the crt file of the intermediate ca that signs the enrollments
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that signs the enrollments
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file
+	RootCACrt string
+}
+
+type estServer struct {
+	opts EstServerOptions
+}
+
+// ServeEst serves the RFC 7030 cacerts, simpleenroll and simplereenroll
+// operations for an intermediate ca until the server fails.
+func ServeEst(opts EstServerOptions) {
+	server := &estServer{opts: opts}
+
+	clientCAPEM, err := os.ReadFile(opts.ClientCACrt)
+	if err != nil {
+		log.Fatal("Error while reading client CA: ", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(clientCAPEM) {
+		log.Fatal("No certificate found in client CA file: ", opts.ClientCACrt)
+	}
+
+	httpServer := &http.Server{
+		Addr:    opts.Listen,
+		Handler: server.routes(),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// Devices without a cert enroll with basic auth
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving EST on ", opts.Listen, "/.well-known/est")
+	log.Fatal(httpServer.ListenAndServeTLS(opts.TLSCrt, opts.TLSKey))
+}
+
+// routes returns the handler of the est operations.
+func (s *estServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/est/cacerts", s.caCerts)
+	mux.HandleFunc("GET /.well-known/est/csrattrs", s.csrAttrs)
+	mux.HandleFunc("POST /.well-known/est/simpleenroll", s.simpleEnroll)
+	mux.HandleFunc("POST /.well-known/est/simplereenroll", s.simpleReenroll)
+	return mux
+}
+
+func (s *estServer) caCerts(w http.ResponseWriter, r *http.Request) {
+	chainPEM, err := ChainPEM(s.opts.IntermediateCACrt, s.opts.RootCACrt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	certs, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEstCerts(w, "application/pkcs7-mime", certs)
+}
+
+// csrAttrs tells clients that no particular csr attributes are required.
+func (s *estServer) csrAttrs(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *estServer) simpleEnroll(w http.ResponseWriter, r *http.Request) {
+	client := s.authenticate(r)
+	if client == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="crtforge est"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	s.enroll(w, r, client, nil)
+}
+
+// simpleReenroll renews the cert the client authenticated with. The new cert
+// has to keep the subject of the current one.
+func (s *estServer) simpleReenroll(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "reenrollment requires the current client cert", http.StatusUnauthorized)
+		return
+	}
+	currentCert := r.TLS.VerifiedChains[0][0]
+	s.enroll(w, r, "cert "+currentCert.Subject.CommonName, currentCert)
+}
+
+// authenticate returns who made the request, or an empty string.
+func (s *estServer) authenticate(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert " + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	username, password, ok := r.BasicAuth()
+	if ok && s.opts.Username != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.opts.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.opts.Password)) == 1 {
+		return "user " + username
+	}
+	return ""
+}
+
+func (s *estServer) enroll(w http.ResponseWriter, r *http.Request, client string, currentCert *x509.Certificate) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// EST bodies are base64, but some clients send plain DER
+	csrDER, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+	if err != nil {
+		csrDER = body
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		http.Error(w, "invalid csr: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if currentCert != nil && csr.Subject.String() != currentCert.Subject.String() {
+		http.Error(w, "reenrollment has to keep the subject of the current cert", http.StatusBadRequest)
+		return
+	}
+	// A reenrollment csr without SANs keeps the SANs of the current cert
+	if currentCert != nil && len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 && len(csr.EmailAddresses) == 0 && len(csr.URIs) == 0 {
+		csr.DNSNames = currentCert.DNSNames
+		csr.IPAddresses = currentCert.IPAddresses
+		csr.EmailAddresses = currentCert.EmailAddresses
+		csr.URIs = currentCert.URIs
+	}
+	// RFC 7030 4.2.2, the SANs of a reenrollment are those of the current cert
+	if currentCert != nil && !sameSubjectAltNames(csr, currentCert) {
+		http.Error(w, "reenrollment has to keep the subject alt names of the current cert", http.StatusBadRequest)
+		return
+	}
+
+	cert, err := signAppCsr(CreateAppCrtOptions{
+		IntermediateCACrt: s.opts.IntermediateCACrt,
+		IntermediateCAKey: s.opts.IntermediateCAKey,
+		RootCACrt:         s.opts.RootCACrt,
+		ExtKeyUsages:      []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, csr)
+	if err != nil {
+		log.Warn("EST enrollment of ", csr.Subject.CommonName, " by ", client, " failed: ", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrRequestRefused) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Info("EST enrolled ", csr.Subject.CommonName, " for ", client, ", serial ", serialHex(cert.SerialNumber))
+	writeEstCerts(w, "application/pkcs7-mime; smime-type=certs-only", []*x509.Certificate{cert})
+}
+
+// sameSubjectAltNames reports whether csr asks for the SANs of cert, in any order.
+func sameSubjectAltNames(csr *x509.CertificateRequest, cert *x509.Certificate) bool {
+	var csrIPs, certIPs, csrURIs, certURIs []string
+	for _, ip := range csr.IPAddresses {
+		csrIPs = append(csrIPs, ip.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		certIPs = append(certIPs, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		csrURIs = append(csrURIs, uri.String())
+	}
+	for _, uri := range cert.URIs {
+		certURIs = append(certURIs, uri.String())
+	}
+	return sameNames(csr.DNSNames, cert.DNSNames) && sameNames(csrIPs, certIPs) &&
+		sameNames(csr.EmailAddresses, cert.EmailAddresses) && sameNames(csrURIs, certURIs)
+}
+
+func sameNames(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// writeEstCerts answers with a base64 encoded certs-only PKCS#7.
+func writeEstCerts(w http.ResponseWriter, contentType string, certs []*x509.Certificate) {
+	pkcs7DER, err := encodeCertsOnlyPKCS7(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(pkcs7DER) + "\n"))
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEstServer(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "devices")
+	if err := os.WriteFile(configDir+"/lab/devices/policy.json", []byte(`{"allowedDomains": ["example.com"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := readCert(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateCert, err := readCert(intermediateCA.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	est := &estServer{opts: EstServerOptions{
+		Username:          "device",
+		Password:          "secret",
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+	}}
+	server := httptest.NewUnstartedServer(est.routes())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(rootCert)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	// The current cert of a device that reenrolls
+	current, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		CommonName:        "sensor.example.com",
+		AltNames:          []string{"sensor.example.com", "email:ops@example.com"},
+		ExtKeyUsages:      []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := tls.Certificate{Certificate: [][]byte{current.Cert.Raw, intermediateCert.Raw}, PrivateKey: current.PrivateKey}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBody := func(commonName string, dnsNames []string, emails []string, uris ...string) string {
+		template := x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames, EmailAddresses: emails}
+		for _, rawURL := range uris {
+			uri, err := url.Parse(rawURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template.URIs = append(template.URIs, uri)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(der)
+	}
+
+	tests := []struct {
+		name       string
+		operation  string
+		body       string
+		username   string
+		password   string
+		clientCert bool
+		status     int
+		// commonName and sans are expected in the enrolled cert
+		commonName string
+		sans       int
+	}{
+		{"enroll with basic auth", "simpleenroll", csrBody("app.example.com", []string{"app.example.com"}, []string{"app@example.com"}, "spiffe://example.com/app"), "device", "secret", false, http.StatusOK, "app.example.com", 3},
+		{"enroll with client cert", "simpleenroll", csrBody("app.example.com", []string{"app.example.com"}, nil), "", "", true, http.StatusOK, "app.example.com", 1},
+		{"enroll without auth", "simpleenroll", csrBody("app.example.com", []string{"app.example.com"}, nil), "", "", false, http.StatusUnauthorized, "", 0},
+		{"enroll with wrong password", "simpleenroll", csrBody("app.example.com", []string{"app.example.com"}, nil), "device", "guess", false, http.StatusUnauthorized, "", 0},
+		{"enroll invalid csr", "simpleenroll", "bm90IGEgY3Ny", "device", "secret", false, http.StatusBadRequest, "", 0},
+		{"enroll refused by policy", "simpleenroll", csrBody("app.attacker.test", []string{"app.attacker.test"}, nil), "device", "secret", false, http.StatusForbidden, "", 0},
+		{"enroll email refused by policy", "simpleenroll", csrBody("app.example.com", []string{"app.example.com"}, []string{"ops@attacker.test"}), "device", "secret", false, http.StatusForbidden, "", 0},
+		{"reenroll without client cert", "simplereenroll", csrBody("sensor.example.com", nil, nil), "device", "secret", false, http.StatusUnauthorized, "", 0},
+		{"reenroll keeps the sans", "simplereenroll", csrBody("sensor.example.com", nil, nil), "", "", true, http.StatusOK, "sensor.example.com", 2},
+		{"reenroll with the same sans", "simplereenroll", csrBody("sensor.example.com", []string{"sensor.example.com"}, []string{"ops@example.com"}), "", "", true, http.StatusOK, "sensor.example.com", 2},
+		{"reenroll with other subject", "simplereenroll", csrBody("other.example.com", nil, nil), "", "", true, http.StatusBadRequest, "", 0},
+		{"reenroll with other sans", "simplereenroll", csrBody("sensor.example.com", []string{"other.example.com"}, nil), "", "", true, http.StatusBadRequest, "", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			if test.clientCert {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+			}
+			request, err := http.NewRequest("POST", server.URL+"/.well-known/est/"+test.operation, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/pkcs10")
+			if test.username != "" {
+				request.SetBasicAuth(test.username, test.password)
+			}
+			response, err := (&http.Client{Transport: transport}).Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			if response.StatusCode != test.status {
+				t.Fatalf("status %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			pkcs7DER, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs, err := parsePKCS7Certs(pkcs7DER)
+			if err != nil || len(certs) != 1 {
+				t.Fatalf("response has %d certs: %v", len(certs), err)
+			}
+			cert := certs[0]
+			if cert.Subject.CommonName != test.commonName {
+				t.Errorf("enrolled %s, want %s", cert.Subject.CommonName, test.commonName)
+			}
+			if sans := len(cert.DNSNames) + len(cert.EmailAddresses) + len(cert.URIs); sans != test.sans {
+				t.Errorf("enrolled cert has %d SANs, want %d", sans, test.sans)
+			}
+			if !issuedBy(cert, intermediateCert) {
+				t.Error("enrolled cert isn't signed by the intermediate ca")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type CreateFixturesOptions struct {
+	// OutputDir is the directory the fixtures and the manifest are written to
+	OutputDir string
+	// Hostname is the name clients connect to when testing the fixtures
+	Hostname string
+	// IntermediateCACrt is the crt file of the intermediate ca that signs the fixtures
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that signs the fixtures
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file clients trust
+	RootCACrt string
+}
+
+// FixturesManifest describes the fixtures and what a correct client does with them
+type FixturesManifest struct {
+	Hostname string    `json:"hostname"`
+	RootCA   string    `json:"rootCA"`
+	CRL      string    `json:"crl"`
+	Fixtures []Fixture `json:"fixtures"`
+}
+
+type Fixture struct {
+	Name string `json:"name"`
+	// Expect is accept or reject
+	Expect    string `json:"expect"`
+	Reason    string `json:"reason"`
+	Crt       string `json:"crt"`
+	Key       string `json:"key"`
+	Fullchain string `json:"fullchain"`
+}
+
+// fixture is a deliberately wrong app cert
+type fixture struct {
+	name   string
+	reason string
+	// modify breaks the app cert template
+	modify  func(template *x509.Certificate)
+	keyBits int
+	// selfSigned signs the leaf with its own key
+	selfSigned bool
+	// withoutIntermediate leaves the intermediate ca out of the fullchain
+	withoutIntermediate bool
+	// revoke revokes the leaf in the intermediate ca index
+	revoke bool
+}
+
+// CreateFixtures writes a labelled set of broken certs for hostname and a
+// manifest.json of what each one should cause a correct client to reject.
+// The valid fixture is the control that has to be accepted.
+func CreateFixtures(opts CreateFixturesOptions) {
+	fixtures := []fixture{
+		{name: "valid"},
+		{name: "expired", reason: "the certificate has expired", modify: func(template *x509.Certificate) {
+			template.NotBefore = time.Now().AddDate(-1, 0, -1)
+			template.NotAfter = time.Now().AddDate(0, 0, -1)
+		}},
+		{name: "not-yet-valid", reason: "the certificate is not valid yet", modify: func(template *x509.Certificate) {
+			template.NotBefore = time.Now().AddDate(0, 0, 1)
+			template.NotAfter = time.Now().AddDate(1, 0, 1)
+		}},
+		{name: "wrong-hostname", reason: "the certificate is valid for wrong-hostname.invalid, not " + opts.Hostname, modify: func(template *x509.Certificate) {
+			template.Subject.CommonName = "wrong-hostname.invalid"
+			template.DNSNames = []string{"wrong-hostname.invalid"}
+			template.IPAddresses = nil
+		}},
+		{name: "missing-intermediate", reason: "the chain lacks the intermediate ca, so no path to the root ca can be built", withoutIntermediate: true},
+		{name: "self-signed", reason: "the certificate is self-signed and not issued by a trusted ca", selfSigned: true},
+		{name: "revoked", reason: "the certificate is revoked in the crl of the intermediate ca, rejected by clients that check revocation", revoke: true},
+		{name: "weak-key", reason: "the certificate has a 1024 bit rsa key", keyBits: 1024},
+		{name: "wrong-eku", reason: "the certificate is only valid for client authentication, not server authentication", modify: func(template *x509.Certificate) {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}},
+		{name: "ca-leaf", reason: "the leaf certificate has the ca flag set", modify: func(template *x509.Certificate) {
+			template.IsCA = true
+			template.KeyUsage |= x509.KeyUsageCertSign
+		}},
+	}
+
+	if err := os.MkdirAll(opts.OutputDir, 0700); err != nil {
+		log.Fatal("Error while creating fixtures dir: ", err)
+	}
+	manifest := FixturesManifest{Hostname: opts.Hostname, RootCA: "rootCA.crt"}
+	rootCACertPEM, err := os.ReadFile(opts.RootCACrt)
+	if err != nil {
+		log.Fatal("Error while reading Root CA: ", err)
+	}
+	if err := os.WriteFile(opts.OutputDir+"/rootCA.crt", rootCACertPEM, 0644); err != nil {
+		log.Fatal("Error while writing Root CA: ", err)
+	}
+
+	for _, f := range fixtures {
+		entry, err := createFixture(opts, f)
+		if err != nil {
+			log.Fatal("Error while creating fixture ", f.name, ": ", err)
+		}
+		manifest.Fixtures = append(manifest.Fixtures, *entry)
+		log.Debug("Fixture created: ", f.name)
+	}
+
+	// The crl lists the revoked fixture
+	crlDER, err := CreateCrl(opts.IntermediateCACrt, opts.IntermediateCAKey)
+	if err != nil {
+		log.Fatal("Error while creating CRL: ", err)
+	}
+	manifest.CRL = "intermediateCA.crl.pem"
+	if err := os.WriteFile(opts.OutputDir+"/"+manifest.CRL, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0644); err != nil {
+		log.Fatal("Error while writing CRL: ", err)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatal("Error while encoding manifest: ", err)
+	}
+	if err := os.WriteFile(opts.OutputDir+"/manifest.json", append(manifestJSON, '\n'), 0644); err != nil {
+		log.Fatal("Error while writing manifest: ", err)
+	}
+
+	log.Info("Fixtures created successfully.")
+	log.Info("Hostname: ", opts.Hostname)
+	log.Info("To see the fixtures and the manifest, please check the dir: ", opts.OutputDir)
+}
+
+// signFixtureCrt signs a fixture with the intermediate ca without checking
+// the name constraints and issuance policies, the fixtures break them on
+// purpose. The fixture is still recorded in the index to be revocable.
+func signFixtureCrt(opts CreateFixturesOptions, template *x509.Certificate, publicKey *rsa.PublicKey) (*x509.Certificate, error) {
+	caCert, caKey, err := loadCACertAndKey(opts.IntermediateCACrt, opts.IntermediateCAKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading CA certificate and key: %v", err)
+	}
+	if template.SerialNumber, err = randomSerial(); err != nil {
+		return nil, err
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, publicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	if err := recordIssuedCrt(filepath.Dir(opts.IntermediateCACrt), cert); err != nil {
+		return nil, fmt.Errorf("error recording certificate in the index: %v", err)
+	}
+	return cert, nil
+}
+
+func createFixture(opts CreateFixturesOptions, f fixture) (*Fixture, error) {
+	keyBits := f.keyBits
+	if keyBits == 0 {
+		keyBits = 2048
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, fmt.Errorf("error generating private key: %v", err)
+	}
+
+	// Fixtures start from the app cert template and break one thing
+	template, err := appCrtTemplate(CreateAppCrtOptions{
+		CommonName: opts.Hostname,
+		AltNames:   []string{opts.Hostname},
+	}, &privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if f.modify != nil {
+		f.modify(&template)
+	}
+
+	var cert *x509.Certificate
+	if f.selfSigned {
+		template.SerialNumber, err = randomSerial()
+		if err != nil {
+			return nil, err
+		}
+		derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error creating certificate: %v", err)
+		}
+		cert, err = x509.ParseCertificate(derBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate: %v", err)
+		}
+	} else {
+		cert, err = signFixtureCrt(opts, &template, &privateKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.revoke {
+		if _, err := RevokeCrt(filepath.Dir(opts.IntermediateCACrt), serialHex(cert.SerialNumber)); err != nil {
+			return nil, err
+		}
+	}
+
+	fixtureDir := opts.OutputDir + "/" + f.name
+	if err := os.MkdirAll(fixtureDir, 0700); err != nil {
+		return nil, err
+	}
+	entry := &Fixture{
+		Name:      f.name,
+		Expect:    "reject",
+		Reason:    f.reason,
+		Crt:       f.name + "/" + f.name + ".crt",
+		Key:       f.name + "/" + f.name + ".key",
+		Fullchain: f.name + "/fullchain.crt",
+	}
+	if f.reason == "" {
+		entry.Expect = "accept"
+		entry.Reason = "the certificate is valid for " + opts.Hostname
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(opts.OutputDir+"/"+entry.Crt, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	keyPEM, err := appKeyPEM(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(opts.OutputDir+"/"+entry.Key, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	fullchainPEM := certPEM
+	if !f.selfSigned && !f.withoutIntermediate {
+		chainPEM, err := ChainPEM(opts.IntermediateCACrt, opts.RootCACrt)
+		if err != nil {
+			return nil, err
+		}
+		fullchainPEM = append(fullchainPEM, chainPEM...)
+	}
+	if err := os.WriteFile(opts.OutputDir+"/"+entry.Fullchain, fullchainPEM, 0644); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
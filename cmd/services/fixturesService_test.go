@@ -0,0 +1,68 @@
+package services
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+func TestCreateFixturesSkipsPolicies(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "testing", "fixtures")
+	// A root ca policy the fixtures break on purpose
+	policy := `{"allowedDomains": ["example.com"], "minRSAKeySize": 2048, "maxValidityDays": 90}`
+	if err := os.WriteFile(configDir+"/testing/rootCA/policy.json", []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	CreateFixtures(CreateFixturesOptions{
+		OutputDir:         outputDir,
+		Hostname:          "localhost",
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+	})
+
+	manifestJSON, err := os.ReadFile(outputDir + "/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest FixturesManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Fixtures) != 10 {
+		t.Errorf("manifest lists %d fixtures, want 10", len(manifest.Fixtures))
+	}
+	issuedCrts, err := ListIssuedCrts(configDir + "/testing/fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every fixture but the self-signed one is in the index
+	if len(issuedCrts) != 9 {
+		t.Errorf("index has %d fixtures, want 9", len(issuedCrts))
+	}
+
+	crlPEM, err := os.ReadFile(outputDir + "/" + manifest.CRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlBlock, _ := pem.Decode(crlPEM)
+	revoked, err := readCert(outputDir + "/revoked/revoked.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crlBlock == nil {
+		t.Fatal("crl isn't PEM")
+	}
+	crl, err := x509.ParseRevocationList(crlBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(revoked.SerialNumber) != 0 {
+		t.Error("crl doesn't list the revoked fixture")
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ImportCAOptions struct {
+	// ConfigDirectory is the config directory for crtforge
+	ConfigDirectory string
+	// CACrt is the certificate file to import
+	CACrt string
+	// CAKey is the private key file to import
+	CAKey string
+	// Name is the name of the imported ca. Used as the root ca name for
+	// self-signed certificates and as the intermediate ca name otherwise.
+	Name string
+	// RootCAName is the root ca an imported intermediate is placed under
+	RootCAName string
+	// CountryName is short hand name of the country
+	CountryName string
+	// StateOrProvinceName is the name of the country/state in the country
+	StateOrProvinceName string
+	// LocalityName
+	LocalityName string
+	// EmailAddress is the email address of the user
+	EmailAddress string
+	// BasicConstraints
+	BasicConstraints string
+}
+
+// ImportCa copies an existing ca certificate and key into the crtforge
+// layout. Self-signed certificates become a root ca named opts.Name, anything
+// else becomes an intermediate ca under the opts.RootCAName root ca.
+func ImportCa(opts ImportCAOptions) {
+	caCert, caKey, err := readCertAndKey(opts.CACrt, opts.CAKey)
+	if err != nil {
+		log.Fatal("Error while reading the CA to import: ", err)
+	}
+
+	if !caCert.BasicConstraintsValid || !caCert.IsCA {
+		log.Fatal("The certificate is not a CA certificate: ", opts.CACrt)
+	}
+	if caCert.KeyUsage != 0 && caCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		log.Fatal("The certificate is not allowed to sign certificates: ", opts.CACrt)
+	}
+	if err := checkKeyMatchesCert(caCert, caKey); err != nil {
+		log.Fatal("Error while matching the key with the certificate: ", err)
+	}
+
+	if isSelfSigned(caCert) {
+		importRootCa(opts, caCert, caKey)
+	} else {
+		importIntermediateCa(opts, caCert, caKey)
+	}
+}
+
+func importRootCa(opts ImportCAOptions, caCert *x509.Certificate, caKey crypto.Signer) {
+	if caCert.MaxPathLenZero {
+		log.Warn("The imported root ca has pathlen:0, intermediates signed by it won't be trusted by clients.")
+	}
+
+	caDir := CreateCaDir(opts.ConfigDirectory, opts.Name)
+	rootCaDir := caDir + "/rootCA"
+	if _, err := os.Stat(rootCaDir + "/rootCA.crt"); err == nil {
+		log.Fatal("Root CA already exists, refusing to overwrite: ", rootCaDir)
+	}
+	if err := os.MkdirAll(rootCaDir, 0700); err != nil {
+		log.Fatal("Error while creating Root CA dir: ", err)
+	}
+
+	if err := writeCaKey(rootCaDir+"/rootCA.key", caKey, true); err != nil {
+		log.Fatal("Error while writing Root CA Key: ", err)
+	}
+	if err := writeCertPEM(rootCaDir+"/rootCA.crt", caCert); err != nil {
+		log.Fatal("Error while writing Root CA Crt: ", err)
+	}
+
+	// Key and crt are in place, the rest of the layout is created as usual.
+	// Imported roots rarely share the subject fields of our intermediates,
+	// so the loose policy is used for signing.
+	CreateRootCa(CreateRootCAOptions{
+		ConfigDirectory:     caDir,
+		RootCAName:          opts.Name,
+		CountryName:         opts.CountryName,
+		StateOrProvinceName: opts.StateOrProvinceName,
+		LocalityName:        opts.LocalityName,
+		EmailAddress:        opts.EmailAddress,
+		BasicConstraints:    opts.BasicConstraints,
+		Policy:              "policy_loose",
+	})
+
+	log.Info("Root CA imported successfully.")
+	log.Info("Root CA name: ", opts.Name)
+	log.Info("Subject: ", caCert.Subject.String())
+}
+
+func importIntermediateCa(opts ImportCAOptions, caCert *x509.Certificate, caKey crypto.Signer) {
+	caDir := opts.ConfigDirectory + "/" + opts.RootCAName
+	rootCert, err := readCert(caDir + "/rootCA/rootCA.crt")
+	if err != nil {
+		log.Fatal("Error while reading the parent Root CA, import it first: ", err)
+	}
+	if err := caCert.CheckSignatureFrom(rootCert); err != nil {
+		log.Fatal("The certificate is not signed by the Root CA ", opts.RootCAName, ": ", err)
+	}
+
+	intermediateCaDir := caDir + "/" + opts.Name
+	if _, err := os.Stat(intermediateCaDir + "/intermediateCA.crt"); err == nil {
+		log.Fatal("Intermediate CA already exists, refusing to overwrite: ", intermediateCaDir)
+	}
+	if err := os.MkdirAll(intermediateCaDir, 0700); err != nil {
+		log.Fatal("Error while creating Intermediate CA dir: ", err)
+	}
+
+	if err := writeCaKey(intermediateCaDir+"/intermediateCA.key", caKey, false); err != nil {
+		log.Fatal("Error while writing Intermediate CA Key: ", err)
+	}
+	if err := writeCertPEM(intermediateCaDir+"/intermediateCA.crt", caCert); err != nil {
+		log.Fatal("Error while writing Intermediate CA Crt: ", err)
+	}
+
+	intermediateCaCnfFile := intermediateCaDir + "/intermediateCA.cnf"
+	intermediateCaCnf, err := prepareIntermediateCnf(intermediateCaDir, CreateIntermediateCAOptions{
+		IntermediateCAName:  opts.Name,
+		CountryName:         opts.CountryName,
+		StateOrProvinceName: opts.StateOrProvinceName,
+		LocalityName:        opts.LocalityName,
+		EmailAddress:        opts.EmailAddress,
+		BasicConstraints:    opts.BasicConstraints,
+	})
+	if err != nil {
+		log.Fatal("Error while creating Intermediate CA Cnf from template: ", err)
+	}
+	if err := os.WriteFile(intermediateCaCnfFile, intermediateCaCnf, os.ModePerm); err != nil {
+		log.Fatal("Error while writing Intermediate CA Cnf to file: ", err)
+	}
+	if err := createIntermediateCaDatabase(intermediateCaDir); err != nil {
+		log.Fatal("Error while creating Intermediate CA index: ", err)
+	}
+
+	log.Info("Intermediate CA imported successfully.")
+	log.Info("Intermediate CA name: ", opts.Name)
+	log.Info("Subject: ", caCert.Subject.String())
+}
+
+func readCert(certFile string) (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate: %v", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("failed to decode certificate PEM: %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func readCertAndKey(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCert(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func readPrivateKey(keyFile string) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %v", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM: %s", keyFile)
+	}
+	return parsePrivateKey(keyBlock.Bytes)
+}
+
+// parsePrivateKey parses a PKCS#1, PKCS#8 or SEC 1 encoded private key.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to parse private key")
+}
+
+func checkKeyMatchesCert(cert *x509.Certificate, key crypto.Signer) error {
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certPub, keyPub) {
+		return fmt.Errorf("private key does not match the certificate %s", cert.Subject.String())
+	}
+	return nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func writeCertPEM(certFile string, cert *x509.Certificate) error {
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+}
+
+// writeCaKey writes the key the way crtforge generates it. Root keys are
+// PKCS#1 when possible, intermediate keys are always PKCS#8 since that is what
+// loadCACertAndKey expects.
+func writeCaKey(keyFile string, key crypto.Signer, pkcs1 bool) error {
+	var block *pem.Block
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok && pkcs1 {
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+}
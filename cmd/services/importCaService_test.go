@@ -0,0 +1,60 @@
+package services
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestImportIntermediateCa(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	importOpts := ImportCAOptions{
+		ConfigDirectory:     configDir,
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+	}
+	rootOpts := importOpts
+	rootOpts.CACrt, rootOpts.CAKey, rootOpts.Name = rootCACrt, configDir+"/lab/rootCA/rootCA.key", "corp"
+	ImportCa(rootOpts)
+	teamOpts := importOpts
+	teamOpts.CACrt, teamOpts.CAKey, teamOpts.Name, teamOpts.RootCAName = intermediateCA.IntermediateCACrt, intermediateCA.IntermediateCAKey, "team", "corp"
+	ImportCa(teamOpts)
+
+	teamDir := configDir + "/corp/team"
+	for _, file := range []string{"intermediateCA.crt", "intermediateCA.key", "intermediateCA.cnf", "index.txt", "serial", "newcerts"} {
+		if _, err := os.Stat(teamDir + "/" + file); err != nil {
+			t.Errorf("imported intermediate ca lacks %s: %v", file, err)
+		}
+	}
+	if serial, err := os.ReadFile(teamDir + "/serial"); err != nil || strings.TrimSpace(string(serial)) != "1000" {
+		t.Errorf("serial is %q, want 1000: %v", serial, err)
+	}
+
+	// The imported intermediate ca issues, revokes and lists certs
+	appCrt, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: teamDir + "/intermediateCA.crt",
+		IntermediateCAKey: teamDir + "/intermediateCA.key",
+		RootCACrt:         configDir + "/corp/rootCA/rootCA.crt",
+		AltNames:          []string{"app.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevokeCrt(teamDir, serialHex(appCrt.Cert.SerialNumber)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCrl(teamDir+"/intermediateCA.crt", teamDir+"/intermediateCA.key"); err != nil {
+		t.Fatal(err)
+	}
+	issuedCrts, err := ListIssuedCrts(teamDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuedCrts) != 1 || !issuedCrts[0].Revoked {
+		t.Errorf("index lists %v, want the revoked app cert", issuedCrts)
+	}
+}
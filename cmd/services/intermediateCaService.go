@@ -7,9 +7,12 @@ import (
 	"crypto/x509"
 	_ "embed"
 	"encoding/pem"
+	"fmt"
 	"html/template"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +20,9 @@ import (
 //go:embed intermediateCaCnf.tmpl
 var intermediateCACnfTmpl []byte
 
+//go:embed intermediateCaExt.tmpl
+var intermediateCAExtTmpl []byte
+
 type CreateIntermediateCAOptions struct {
 	// ConfigDirectory is the config directory for crtforge
 	ConfigDirectory string
@@ -34,6 +40,17 @@ type CreateIntermediateCAOptions struct {
 	EmailAddress string
 	// BasicConstraints
 	BasicConstraints string
+	// NameConstraints restrict the names the intermediate ca may sign
+	NameConstraints NameConstraints
+	// SignatureAlgorithm is the signature algorithm of the intermediate ca
+	// crt signed by the root ca, the default_md of the root ca cnf when empty
+	SignatureAlgorithm string
+	// Parent is the name of the intermediate ca that signs the intermediate
+	// ca, the root ca signs it when empty
+	Parent string
+	// PathLen is the number of intermediate cas that may follow the
+	// intermediate ca, 0 lets it sign only leaf certs and -1 sets no limit
+	PathLen int
 }
 
 type IntermediateCA struct {
@@ -43,21 +60,87 @@ type IntermediateCA struct {
 	IntermediateCACnf string
 	// IntermediateCaKey is the intermediate ca key file
 	IntermediateCAKey string
+	// IntermediateCaCsr is the intermediate ca csr file
+	IntermediateCACsr string
 }
 
 func CreateIntermediateCa(opts CreateIntermediateCAOptions) IntermediateCA {
+	intermediateCA, err := createIntermediateCa(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return intermediateCA
+}
+
+// createIntermediateCa creates the intermediate ca files that don't exist
+// yet and signs its csr with the parent intermediate ca or the root ca.
+func createIntermediateCa(opts CreateIntermediateCAOptions) (IntermediateCA, error) {
+	// Fail before creating the key and csr if the parent can't sign them
+	parentDir := opts.ConfigDirectory + "/" + opts.Parent
+	if _, err := os.Stat(opts.ConfigDirectory + "/" + opts.IntermediateCAName + "/intermediateCA.crt"); os.IsNotExist(err) && opts.Parent != "" {
+		if err := checkParentIntermediateCa(opts.Parent, parentDir, opts.PathLen); err != nil {
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA: %v", err)
+		}
+	}
+
+	intermediateCA, err := createIntermediateCsr(opts)
+	if err != nil {
+		return IntermediateCA{}, err
+	}
+
+	// Create intermediate ca crt file
+	if _, err := os.Stat(intermediateCA.IntermediateCACrt); os.IsNotExist(err) && opts.Parent != "" {
+		log.Debug("Intermediate CA Crt being created by ", opts.Parent)
+		err = signIntermediateCsrWithParent(parentDir, intermediateCA.IntermediateCACsr, intermediateCA.IntermediateCACrt, opts.PathLen, opts.SignatureAlgorithm)
+		if err != nil {
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA Crt: %v", err)
+		}
+		log.Debug("Intermediate CA Crt generated at ", intermediateCA.IntermediateCACrt)
+	} else if os.IsNotExist(err) {
+		log.Debug("Intermediate CA Crt being created")
+		rootCaKeyFile := filepath.Dir(opts.RootCACnf) + "/rootCA.key"
+		if _, err := os.Stat(rootCaKeyFile); os.IsNotExist(err) {
+			return IntermediateCA{}, fmt.Errorf("Root CA Key not found, the Root CA seems to be offline: %s. Please use crtforge intermediate csr and crtforge intermediate install instead.", rootCaKeyFile)
+		}
+		err = signIntermediateCsr(opts.RootCACnf, intermediateCA.IntermediateCACsr, intermediateCA.IntermediateCACrt, opts.PathLen, opts.SignatureAlgorithm)
+		if err != nil {
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA Crt: %v", err)
+		}
+		log.Debug("Intermediate CA Crt generated at ", intermediateCA.IntermediateCACrt)
+	} else if opts.SignatureAlgorithm != "" {
+		log.Warn("Intermediate CA ", opts.IntermediateCAName, " already exists, its signature algorithm is not changed.")
+	}
+
+	log.Debug("Intermediate CA created.")
+	return intermediateCA, nil
+}
+
+// CreateIntermediateCsr creates the intermediate ca key, cnf and csr but
+// doesn't sign it, so the csr can be signed by an offline root ca.
+func CreateIntermediateCsr(opts CreateIntermediateCAOptions) IntermediateCA {
+	intermediateCA, err := createIntermediateCsr(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return intermediateCA
+}
+
+func createIntermediateCsr(opts CreateIntermediateCAOptions) (IntermediateCA, error) {
 	// Create intermediate ca folder
 	intermediateCaDir := opts.ConfigDirectory + "/" + opts.IntermediateCAName
 	if _, err := os.Stat(intermediateCaDir); os.IsNotExist(err) {
 		log.Debug("Intermediate CA dir is being created", intermediateCaDir)
 		err := os.Mkdir(intermediateCaDir, 0700)
 		if err != nil {
-			log.Fatal("Error while creating Intermediate CA dir: ", err)
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA dir: %v", err)
 		}
 		log.Debug("Intermediate CA dir generated at ", intermediateCaDir)
 	} else {
 		log.Debug("Intermediate CA dir already exists, skipping.")
 	}
+	if err := createIntermediateCaDatabase(intermediateCaDir); err != nil {
+		return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA index: %v", err)
+	}
 
 	// Create intermediate ca key file
 	intermediateCaKeyFile := intermediateCaDir + "/intermediateCA.key"
@@ -65,7 +148,7 @@ func CreateIntermediateCa(opts CreateIntermediateCAOptions) IntermediateCA {
 		log.Debug("Intermediate CA Key is being created.")
 		caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
 		if err != nil {
-			log.Error(err)
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA Key: %v", err)
 		}
 
 		// Encode the private key to PEM format
@@ -74,15 +157,8 @@ func CreateIntermediateCa(opts CreateIntermediateCAOptions) IntermediateCA {
 			Type:  "RSA PRIVATE KEY",
 			Bytes: privKeyBytes,
 		}
-
-		file, err := os.Create(intermediateCaKeyFile)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		err = pem.Encode(file, privKeyPEM)
-		if err != nil {
-			panic(err)
+		if err := os.WriteFile(intermediateCaKeyFile, pem.EncodeToMemory(privKeyPEM), 0600); err != nil {
+			return IntermediateCA{}, fmt.Errorf("Error while writing Intermediate CA Key: %v", err)
 		}
 
 		log.Debug("Intermediate CA Key generated at ", intermediateCaKeyFile)
@@ -97,68 +173,351 @@ func CreateIntermediateCa(opts CreateIntermediateCAOptions) IntermediateCA {
 		log.Debug("Intermediate CA Cnf being created.")
 		intermediateCaCnf, err := prepareIntermediateCnf(intermediateCaDir, opts)
 		if err != nil {
-			log.Fatal("Error while creating Intermediate CA Cnf from template: ", err)
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA Cnf from template: %v", err)
 		}
 		err = os.WriteFile(intermediateCaCnfFile, intermediateCaCnf, os.ModePerm)
 		if err != nil {
-			log.Fatal("Error while writing Intermediate CA Cnf to file: ", err)
+			return IntermediateCA{}, fmt.Errorf("Error while writing Intermediate CA Cnf to file: %v", err)
 		}
 		log.Debug("Intermediate CA Cnf generated at ", intermediateCaCnfFile)
 	} else {
 		log.Debug("Intermediate CA Cnf already exists, skipping.")
 	}
 
-	// Create intermediate ca csr file
+	// Create intermediate ca csr file. Imported intermediate cas have no csr,
+	// regenerating it would replace their key so it is skipped once the crt exists.
 	intermediateCaCsrFile := intermediateCaDir + "/intermediateCA.csr"
-	if _, err := os.Stat(intermediateCaCsrFile); os.IsNotExist(err) {
+	intermediateCaCrtFile := intermediateCaDir + "/intermediateCA.crt"
+	_, crtErr := os.Stat(intermediateCaCrtFile)
+	if _, err := os.Stat(intermediateCaCsrFile); os.IsNotExist(err) && os.IsNotExist(crtErr) {
 		log.Debug("Intermediate CA Csr being created.")
 		crtSubject := "/C=" + opts.CountryName + "/ST=" + opts.StateOrProvinceName + "/L=" + opts.LocalityName + "/O=Crtforge/OU=" + opts.IntermediateCAName + "/CN=Crtforge Intermediate CA/emailAddress=" + opts.EmailAddress
-		createIntermediateCaCsrCmd := exec.Command(
-			"openssl", "req", "-nodes",
+		csrArgs := []string{
+			"req", "-nodes",
 			"-config", intermediateCaCnfFile,
 			"-new", "-sha256",
 			"-keyout", intermediateCaKeyFile,
 			"-out", intermediateCaCsrFile,
 			"-subj", crtSubject,
-		)
+		}
+		// Name constraints are requested in the csr, so that they are kept
+		// when the csr is signed by an offline root ca
+		if !opts.NameConstraints.isEmpty() {
+			nameConstraints, err := opts.NameConstraints.opensslValue()
+			if err != nil {
+				return IntermediateCA{}, fmt.Errorf("Error while preparing Intermediate CA name constraints: %v", err)
+			}
+			csrArgs = append(csrArgs, "-addext", "nameConstraints=critical,"+nameConstraints)
+		}
+		createIntermediateCaCsrCmd := exec.Command("openssl", csrArgs...)
 		createIntermediateCaCsrCmd.Dir = intermediateCaDir
 		err = createIntermediateCaCsrCmd.Run()
 		if err != nil {
-			log.Fatal("Error while creating Intermediate CA Csr: ", err)
+			return IntermediateCA{}, fmt.Errorf("Error while creating Intermediate CA Csr: %v", err)
 		}
 		log.Debug("Intermediate CA Csr generated at ", intermediateCaCsrFile)
 	} else {
 		log.Debug("Intermediate CA Csr already exists, skipping.")
-	}
-
-	// Create intermediate ca crt file
-	intermediateCaCrtFile := intermediateCaDir + "/intermediateCA.crt"
-	if _, err := os.Stat(intermediateCaCrtFile); os.IsNotExist(err) {
-		log.Debug("Intermediate CA Crt being created")
-		createIntermediateCaCrtCmd := exec.Command(
-			"openssl", "ca", "-batch",
-			"-config", opts.RootCACnf,
-			"-extensions", "v3_intermediate_ca",
-			"-days", "3650",
-			"-notext", "-md", "sha256",
-			"-in", intermediateCaCsrFile,
-			"-out", intermediateCaCrtFile,
-		)
-		createIntermediateCaCrtCmd.Dir = intermediateCaDir
-		err = createIntermediateCaCrtCmd.Run()
-		if err != nil {
-			log.Fatal("Error while creating Intermediate CA Crt: ", err)
+		if !opts.NameConstraints.isEmpty() {
+			log.Warn("Intermediate CA ", opts.IntermediateCAName, " already exists, its name constraints are not changed.")
 		}
-		log.Debug("Intermediate CA Crt generated at ", intermediateCaCrtFile)
 	}
 
-	log.Debug("Intermediate CA created.")
-
 	return IntermediateCA{
 		IntermediateCACrt: intermediateCaCrtFile,
 		IntermediateCACnf: intermediateCaCnfFile,
 		IntermediateCAKey: intermediateCaKeyFile,
+		IntermediateCACsr: intermediateCaCsrFile,
+	}, nil
+}
+
+// createIntermediateCaDatabase creates the newcerts dir, index and serial
+// files of the intermediate ca cnf that don't exist yet.
+func createIntermediateCaDatabase(intermediateCaDir string) error {
+	if err := os.MkdirAll(intermediateCaDir+"/newcerts", 0700); err != nil {
+		return err
+	}
+	indexFile, err := os.OpenFile(intermediateCaDir+"/index.txt", os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	indexFile.Close()
+	serialFile, err := os.OpenFile(intermediateCaDir+"/serial", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	defer serialFile.Close()
+	_, err = serialFile.WriteString("1000\n")
+	return err
+}
+
+func signIntermediateCsr(rootCaCnfFile, intermediateCaCsrFile, intermediateCaCrtFile string, pathLen int, signatureAlgorithm string) error {
+	if pathLen < -1 {
+		return fmt.Errorf("invalid pathlen %d", pathLen)
+	}
+	rootCaKey, err := readPrivateKey(filepath.Dir(rootCaCnfFile) + "/rootCA.key")
+	if err != nil {
+		return err
+	}
+	if err := checkSignatureAlgorithm(signatureAlgorithm, rootCaKey.Public()); err != nil {
+		return err
+	}
+
+	csrPEM, err := os.ReadFile(intermediateCaCsrFile)
+	if err != nil {
+		return err
+	}
+	csrBlock, _ := pem.Decode(csrPEM)
+	if csrBlock == nil {
+		return fmt.Errorf("failed to decode csr PEM: %s", intermediateCaCsrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	// The extensions of the intermediate ca crt, including the name
+	// constraints requested by the csr
+	nameConstraints, err := csrNameConstraints(csr)
+	if err != nil {
+		return err
+	}
+	intermediateCaExt, err := prepareIntermediateExt(nameConstraints, pathLen)
+	if err != nil {
+		return err
+	}
+	extFile, err := os.CreateTemp("", "intermediateCA-*.ext")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(extFile.Name())
+	_, err = extFile.Write(intermediateCaExt)
+	extFile.Close()
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"ca", "-batch",
+		"-config", rootCaCnfFile,
+		"-extfile", extFile.Name(),
+		"-extensions", "v3_intermediate_ca",
+		"-days", "3650",
+		"-notext",
+		"-in", intermediateCaCsrFile,
+		"-out", intermediateCaCrtFile,
+	}
+	// Without a signature algorithm the default_md of the root ca cnf is used
+	if signatureAlgorithm != "" {
+		args = append(args, "-md", opensslSignatureDigest(signatureAlgorithm))
+		args = append(args, opensslSignatureOpts(signatureAlgorithm)...)
+	}
+	createIntermediateCaCrtCmd := exec.Command("openssl", args...)
+	createIntermediateCaCrtCmd.Dir = filepath.Dir(intermediateCaCrtFile)
+	output, err := createIntermediateCaCrtCmd.CombinedOutput()
+	if err != nil {
+		log.Debug(string(output))
+		return err
+	}
+	return nil
+}
+
+// signIntermediateCsrWithParent signs an intermediate ca csr with the
+// intermediate ca in parentDir, which needs a pathlen above pathLen. The crt
+// is recorded in the index of the parent like its leaf certs.
+func signIntermediateCsrWithParent(parentDir, intermediateCaCsrFile, intermediateCaCrtFile string, pathLen int, signatureAlgorithm string) error {
+	parentCert, err := readCert(parentDir + "/intermediateCA.crt")
+	if err != nil {
+		return err
+	}
+	parentKey, err := readPrivateKey(parentDir + "/intermediateCA.key")
+	if err != nil {
+		return err
+	}
+	if err := checkParentPathLen(filepath.Base(parentDir), parentCert, pathLen); err != nil {
+		return err
+	}
+
+	csrPEM, err := os.ReadFile(intermediateCaCsrFile)
+	if err != nil {
+		return err
+	}
+	csrBlock, _ := pem.Decode(csrPEM)
+	if csrBlock == nil {
+		return fmt.Errorf("failed to decode csr PEM: %s", intermediateCaCsrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid csr signature: %v", err)
+	}
+
+	serialNumber, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	// Same validity as the intermediate cas signed by the root ca, but not
+	// beyond the parent
+	notAfter := time.Now().AddDate(10, 0, 0)
+	if notAfter.After(parentCert.NotAfter) {
+		notAfter = parentCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               csr.Subject,
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            pathLen,
+		MaxPathLenZero:        pathLen == 0,
+	}
+	// Keep the name constraints requested by the csr
+	if _, err := csrNameConstraints(csr); err != nil {
+		return err
+	}
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidNameConstraints) {
+			ext.Critical = true
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+	if template.SignatureAlgorithm, err = x509SignatureAlgorithm(signatureAlgorithm, parentKey.Public()); err != nil {
+		return err
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parentCert, csr.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return err
+	}
+	if err := writeCertPEM(intermediateCaCrtFile, cert); err != nil {
+		return err
+	}
+	return recordIssuedCrt(parentDir, cert)
+}
+
+// checkParentPathLen rejects intermediate cas the parent can't sign with
+// their pathlen, clients would reject the certs they sign.
+func checkParentPathLen(parentName string, parentCert *x509.Certificate, pathLen int) error {
+	if pathLen < -1 {
+		return fmt.Errorf("invalid pathlen %d", pathLen)
+	}
+	// MaxPathLen is -1 when the parent has no path length limit
+	if parentCert.MaxPathLen == 0 {
+		return fmt.Errorf("intermediate ca %s has pathlen 0 and can only sign leaf certs, recreate it with a pathlen above %d", parentName, pathLen)
+	}
+	if parentCert.MaxPathLen > 0 && pathLen == -1 {
+		return fmt.Errorf("an intermediate ca without a pathlen can't be below intermediate ca %s with pathlen %d", parentName, parentCert.MaxPathLen)
+	}
+	if parentCert.MaxPathLen > 0 && pathLen >= parentCert.MaxPathLen {
+		return fmt.Errorf("pathlen %d is not below the pathlen %d of intermediate ca %s", pathLen, parentCert.MaxPathLen, parentName)
+	}
+	return nil
+}
+
+// checkParentIntermediateCa checks that the intermediate ca in parentDir
+// exists with its key and may sign an intermediate ca with pathLen.
+func checkParentIntermediateCa(parentName, parentDir string, pathLen int) error {
+	parentCert, err := readCert(parentDir + "/intermediateCA.crt")
+	if err != nil {
+		return fmt.Errorf("parent intermediate ca %s not found, create it first with a pathlen above %d: %v", parentName, pathLen, err)
+	}
+	if _, err := os.Stat(parentDir + "/intermediateCA.key"); err != nil {
+		return fmt.Errorf("key of the parent intermediate ca %s not found: %v", parentName, err)
+	}
+	return checkParentPathLen(parentName, parentCert, pathLen)
+}
+
+// parentIntermediateCa is an intermediate ca that signed another one
+type parentIntermediateCa struct {
+	// Name is the name of the intermediate ca
+	Name string
+	// Cert is the intermediate ca crt
+	Cert *x509.Certificate
+}
+
+// parentIntermediateCas returns the intermediate cas above cert, nearest
+// first. They are found by their signatures among the intermediate cas in
+// caDir, so the list ends below the root ca.
+func parentIntermediateCas(caDir string, cert *x509.Certificate) []parentIntermediateCa {
+	entries, err := os.ReadDir(caDir)
+	if err != nil {
+		return nil
+	}
+	var candidates []parentIntermediateCa
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if candidate, err := readCert(caDir + "/" + entry.Name() + "/intermediateCA.crt"); err == nil {
+			candidates = append(candidates, parentIntermediateCa{Name: entry.Name(), Cert: candidate})
+		}
+	}
+
+	var parents []parentIntermediateCa
+	seen := map[string]bool{string(cert.Raw): true}
+	for {
+		var found *parentIntermediateCa
+		for i, candidate := range candidates {
+			if !seen[string(candidate.Cert.Raw)] && issuedBy(cert, candidate.Cert) {
+				found = &candidates[i]
+				break
+			}
+		}
+		if found == nil {
+			return parents
+		}
+		parents = append(parents, *found)
+		seen[string(found.Cert.Raw)] = true
+		cert = found.Cert
+	}
+}
+
+// issuingIntermediateCaName returns the name of the intermediate ca in caDir
+// whose subject is the issuer of cert. Unlike parentIntermediateCas it finds
+// parents that were rotated since they signed cert.
+func issuingIntermediateCaName(caDir string, cert *x509.Certificate) string {
+	entries, err := os.ReadDir(caDir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		candidate, err := readCert(caDir + "/" + entry.Name() + "/intermediateCA.crt")
+		if !entry.IsDir() || err != nil || bytes.Equal(candidate.Raw, cert.Raw) {
+			continue
+		}
+		if bytes.Equal(cert.RawIssuer, candidate.RawSubject) {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+func prepareIntermediateExt(nameConstraints string, pathLen int) ([]byte, error) {
+	tmpl, err := template.New("intermediateCaExt").Parse(string(intermediateCAExtTmpl))
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]interface{})
+	vars["nameConstraints"] = nameConstraints
+	vars["pathLen"] = pathLen
+
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, vars); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
 }
 
 func prepareIntermediateCnf(intermediateCaDir string, opts CreateIntermediateCAOptions) ([]byte, error) {
@@ -173,6 +532,7 @@ func prepareIntermediateCnf(intermediateCaDir string, opts CreateIntermediateCAO
 	vars["localityName"] = opts.LocalityName
 	vars["emailAddress"] = opts.EmailAddress
 	vars["basicConstr"] = opts.BasicConstraints
+	vars["defaultMd"] = opensslSignatureDigest(opts.SignatureAlgorithm)
 
 	var output bytes.Buffer
 	if err := tmpl.Execute(&output, vars); err != nil {
@@ -0,0 +1,348 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RotateIntermediateCAOptions struct {
+	// IntermediateCA holds the options used to create the new intermediate ca
+	IntermediateCA CreateIntermediateCAOptions
+	// RootCACrt is the root ca crt file
+	RootCACrt string
+	// Reissue is the flag for reissuing the leaves signed by the old intermediate ca
+	Reissue bool
+	// LeafDirectories are searched for leaves to reissue in addition to the ca directory
+	LeafDirectories []string
+	// Leaf holds the file name template, the key password and the signature
+	// algorithm of the reissued leaves. The other options are taken from the
+	// old leaves and their files
+	Leaf CreateAppCrtOptions
+	// Force rotates an intermediate ca that signed other intermediate cas.
+	// They stay signed by the archived key until they are rotated as well
+	Force bool
+}
+
+// RotateIntermediateCa archives the current intermediate ca and creates a new
+// one under the same root ca. The old intermediate ca crt is neither revoked
+// nor touched, so fullchain files that embed it stay valid until they are
+// reissued.
+func RotateIntermediateCa(opts RotateIntermediateCAOptions) IntermediateCA {
+	intermediateCaDir := opts.IntermediateCA.ConfigDirectory + "/" + opts.IntermediateCA.IntermediateCAName
+	oldIntermediateCert, err := readCert(intermediateCaDir + "/intermediateCA.crt")
+	if err != nil {
+		log.Fatal("Error while reading the Intermediate CA to rotate: ", err)
+	}
+
+	// Keep the subject and the name constraints of the old intermediate ca
+	opts.IntermediateCA = keepCaSubject(opts.IntermediateCA, oldIntermediateCert)
+	if opts.IntermediateCA.NameConstraints.isEmpty() {
+		opts.IntermediateCA.NameConstraints = certNameConstraints(oldIntermediateCert)
+	}
+
+	// Keep the place of the old intermediate ca in the hierarchy
+	opts.IntermediateCA.PathLen = oldIntermediateCert.MaxPathLen
+	opts.IntermediateCA.Parent = issuingIntermediateCaName(opts.IntermediateCA.ConfigDirectory, oldIntermediateCert)
+	children := childIntermediateCas(opts.IntermediateCA.ConfigDirectory, oldIntermediateCert)
+	// New leaves of the children would get fullchains that don't validate, and
+	// the children would no longer find this intermediate ca by its signature
+	if len(children) > 0 && !opts.Force {
+		log.Fatal("Intermediate CA ", opts.IntermediateCA.IntermediateCAName, " signed the intermediate cas ", strings.Join(children, ", "), ", rotate it with --force and rotate them afterwards.")
+	}
+
+	// Fail before archiving anything if the new intermediate ca can't be signed
+	rootCaDir := filepath.Dir(opts.IntermediateCA.RootCACnf)
+	if opts.IntermediateCA.Parent != "" {
+		parentDir := opts.IntermediateCA.ConfigDirectory + "/" + opts.IntermediateCA.Parent
+		if err := checkParentIntermediateCa(opts.IntermediateCA.Parent, parentDir, opts.IntermediateCA.PathLen); err != nil {
+			log.Fatal("Error while checking the parent Intermediate CA: ", err)
+		}
+	} else if _, err := os.Stat(rootCaDir + "/rootCA.key"); os.IsNotExist(err) {
+		log.Fatal("Root CA Key not found, the Root CA seems to be offline: ", rootCaDir)
+	}
+
+	// Find the leaves before the old crt is archived
+	var leaves []CreateAppCrtOptions
+	if opts.Reissue {
+		searchDirs := append([]string{opts.IntermediateCA.ConfigDirectory}, opts.LeafDirectories...)
+		for _, searchDir := range searchDirs {
+			found, err := findLeafCrts(searchDir, oldIntermediateCert, opts.Leaf)
+			if err != nil {
+				log.Fatal("Error while searching leaves in ", searchDir, ": ", err)
+			}
+			leaves = append(leaves, found...)
+		}
+	}
+
+	archiveDir := intermediateCaDir + "/archive/" + time.Now().Format("20060102150405")
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		log.Fatal("Error while creating Intermediate CA archive dir: ", err)
+	}
+	// The index and crl belong to the old intermediate ca, its issued certs keep them
+	var archived []string
+	for _, name := range intermediateCaStateFiles {
+		err := os.Rename(intermediateCaDir+"/"+name, archiveDir+"/"+name)
+		if err != nil && !os.IsNotExist(err) {
+			restoreIntermediateCa(intermediateCaDir, archiveDir, archived)
+			log.Fatal("Error while archiving Intermediate CA: ", err)
+		}
+		if err == nil {
+			archived = append(archived, name)
+		}
+	}
+	log.Info("Old Intermediate CA archived at ", archiveDir)
+
+	// The new intermediate ca has the same subject as the old one
+	if err := allowDuplicateSubjects(rootCaDir); err != nil {
+		restoreIntermediateCa(intermediateCaDir, archiveDir, archived)
+		log.Fatal("Error while updating Root CA index attributes: ", err)
+	}
+	intermediateCA, err := createIntermediateCa(opts.IntermediateCA)
+	if err != nil {
+		// Put the old intermediate ca back, so the ca keeps an active one
+		restoreIntermediateCa(intermediateCaDir, archiveDir, archived)
+		log.Fatal(err, ". The old Intermediate CA is restored.")
+	}
+	log.Info("Intermediate CA rotated successfully.")
+	log.Info("Intermediate CA name: ", opts.IntermediateCA.IntermediateCAName)
+	for _, child := range children {
+		log.Warn("Intermediate CA ", child, " is signed by the old Intermediate CA, rotate it with crtforge intermediate rotate -i ", child)
+	}
+
+	for _, leaf := range leaves {
+		log.Info("Reissuing ", leaf.AppName, " in ", leaf.OutputDir)
+		leaf.IntermediateCACnf = intermediateCA.IntermediateCACnf
+		leaf.IntermediateCACrt = intermediateCA.IntermediateCACrt
+		leaf.IntermediateCAKey = intermediateCA.IntermediateCAKey
+		leaf.RootCACrt = opts.RootCACrt
+		CreateAppCrt(leaf)
+	}
+	if opts.Reissue {
+		log.Info(len(leaves), " leaf certs reissued.")
+	}
+
+	return intermediateCA
+}
+
+// intermediateCaStateFiles are the files of an intermediate ca that are
+// replaced by a rotation
+var intermediateCaStateFiles = []string{"intermediateCA.key", "intermediateCA.csr", "intermediateCA.crt", "index.txt", "crlnumber", "newcerts"}
+
+// restoreIntermediateCa removes the files of a failed rotation and moves the
+// archived files back.
+func restoreIntermediateCa(intermediateCaDir, archiveDir string, archived []string) {
+	for _, name := range intermediateCaStateFiles {
+		if err := os.RemoveAll(intermediateCaDir + "/" + name); err != nil {
+			log.Error("Error while removing ", name, " of the failed rotation: ", err)
+		}
+	}
+	for _, name := range archived {
+		if err := os.Rename(archiveDir+"/"+name, intermediateCaDir+"/"+name); err != nil {
+			log.Error("Error while restoring ", name, " from ", archiveDir, ": ", err)
+			return
+		}
+	}
+	os.Remove(archiveDir)
+}
+
+// childIntermediateCas returns the names of the intermediate cas in caDir
+// signed by issuer.
+func childIntermediateCas(caDir string, issuer *x509.Certificate) []string {
+	entries, err := os.ReadDir(caDir)
+	if err != nil {
+		return nil
+	}
+	var children []string
+	for _, entry := range entries {
+		cert, err := readCert(caDir + "/" + entry.Name() + "/intermediateCA.crt")
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		if !bytes.Equal(cert.Raw, issuer.Raw) && issuedBy(cert, issuer) {
+			children = append(children, entry.Name())
+		}
+	}
+	return children
+}
+
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// findLeafCrts looks for <app> dirs under dir with a pem or der cert signed
+// by issuer, named by the file name template of leafOpts. It returns the
+// options that reissue each leaf with its key type, validity, usages and
+// output formats.
+func findLeafCrts(dir string, issuer *x509.Certificate, leafOpts CreateAppCrtOptions) ([]CreateAppCrtOptions, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var leaves []CreateAppCrtOptions
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		appName := entry.Name()
+		appDir := dir + "/" + appName
+		cert, err := readLeafCrt(appDir, appName, leafOpts.NameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil || cert.IsCA || cert.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		leaf := leafOpts
+		leaf.OutputDir = dir
+		leaf.AppName = appName
+		leaf.Subject = leafSubjectOf(cert)
+		leaf.AltNames = leafAltNames(cert)
+		leaf.ExtKeyUsages = cert.ExtKeyUsage
+		leaf.CriticalExtKeyUsages = hasCriticalExtKeyUsage(cert)
+		leaf.KeyType, leaf.KeySize = leafKeyType(cert)
+		leaf.Validity = cert.NotAfter.Sub(cert.NotBefore)
+		if leaf.SignatureAlgorithm == "" {
+			leaf.SignatureAlgorithm = signatureAlgorithmName(cert.SignatureAlgorithm)
+		}
+		if leaf.Formats, err = leafFormats(appDir, appName, leafOpts.NameTemplate); err != nil {
+			return nil, err
+		}
+		// Fail before the rotation, e.g. without the password of an encrypted key
+		if err := checkAppCrtFormats(leaf); err != nil {
+			return nil, fmt.Errorf("can't reissue %s: %v", appDir, err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, nil
+}
+
+// readLeafCrt reads the pem or der cert of an app dir, nil when it has none.
+func readLeafCrt(appDir, appName, nameTemplate string) (*x509.Certificate, error) {
+	for _, format := range []string{"pem", "der"} {
+		for _, file := range appCrtFiles(format, appName) {
+			if file.Kind != "crt" && file.Kind != "der" {
+				continue
+			}
+			name, err := appCrtFileName(nameTemplate, file)
+			if err != nil {
+				return nil, err
+			}
+			data, err := os.ReadFile(appDir + "/" + name)
+			if err != nil {
+				continue
+			}
+			var cert *x509.Certificate
+			if format == "der" {
+				cert, err = x509.ParseCertificate(data)
+			} else {
+				cert, err = readCert(appDir + "/" + name)
+			}
+			if err != nil {
+				log.Warn("Skipping unreadable cert ", appDir+"/"+name, ": ", err)
+				continue
+			}
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// leafFormats returns the output formats whose files all exist in an app dir.
+func leafFormats(appDir, appName, nameTemplate string) ([]string, error) {
+	var formats []string
+	for _, format := range AppCrtFormats {
+		found := true
+		for _, file := range appCrtFiles(format, appName) {
+			name, err := appCrtFileName(nameTemplate, file)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(appDir + "/" + name); err != nil {
+				found = false
+			}
+		}
+		if found {
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+// leafKeyType returns the key type and size of cert in the form
+// CreateAppCrtOptions takes them.
+func leafKeyType(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "rsa", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ecdsa", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "ed25519", 0
+	}
+	return "", 0
+}
+
+// hasCriticalExtKeyUsage reports whether the extended key usage extension of
+// cert is critical.
+func hasCriticalExtKeyUsage(cert *x509.Certificate) bool {
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 37}) {
+			return extension.Critical
+		}
+	}
+	return false
+}
+
+// leafAltNames returns the SANs of cert in the form CreateAppCrt accepts.
+func leafAltNames(cert *x509.Certificate) []string {
+	altNames := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		altNames = append(altNames, "ip:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		altNames = append(altNames, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		altNames = append(altNames, "uri:"+uri.String())
+	}
+	return altNames
+}
+
+// keepCaSubject copies the subject attributes of cert into opts so a
+// recreated ca keeps the subject of the one it replaces.
+func keepCaSubject(opts CreateIntermediateCAOptions, cert *x509.Certificate) CreateIntermediateCAOptions {
+	subject := cert.Subject
+	if len(subject.Country) > 0 {
+		opts.CountryName = subject.Country[0]
+	}
+	if len(subject.Province) > 0 {
+		opts.StateOrProvinceName = subject.Province[0]
+	}
+	if len(subject.Locality) > 0 {
+		opts.LocalityName = subject.Locality[0]
+	}
+	for _, name := range subject.Names {
+		if name.Type.Equal(oidEmailAddress) {
+			if emailAddress, ok := name.Value.(string); ok {
+				opts.EmailAddress = emailAddress
+			}
+		}
+	}
+	return opts
+}
+
+// allowDuplicateSubjects lets openssl ca sign a certificate whose subject is
+// already in the root ca index, which is the case for rotated cas.
+func allowDuplicateSubjects(rootCaDir string) error {
+	return os.WriteFile(rootCaDir+"/index.txt.attr", []byte("unique_subject = no\n"), 0600)
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+func testIntermediateCaOptions(caDir, name string) CreateIntermediateCAOptions {
+	return CreateIntermediateCAOptions{
+		ConfigDirectory:     caDir,
+		RootCACnf:           caDir + "/rootCA/rootCA.cnf",
+		IntermediateCAName:  name,
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+	}
+}
+
+func TestRotateIntermediateCaRestoresOnFailure(t *testing.T) {
+	configDir := t.TempDir()
+	caDir := configDir + "/lab"
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	oldCrt, err := os.ReadFile(intermediateCA.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root ca can't sign the new intermediate ca with a broken key
+	rootKey, err := os.ReadFile(caDir + "/rootCA/rootCA.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caDir+"/rootCA/rootCA.key", []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectFatal(t, func() {
+		RotateIntermediateCa(RotateIntermediateCAOptions{IntermediateCA: testIntermediateCaOptions(caDir, "frontend"), RootCACrt: rootCACrt})
+	})
+	if got, err := os.ReadFile(intermediateCA.IntermediateCACrt); err != nil || !bytes.Equal(got, oldCrt) {
+		t.Errorf("old intermediate ca wasn't restored: %v", err)
+	}
+	if _, err := os.Stat(intermediateCA.IntermediateCAKey); err != nil {
+		t.Errorf("old intermediate ca key wasn't restored: %v", err)
+	}
+
+	if err := os.WriteFile(caDir+"/rootCA/rootCA.key", rootKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	RotateIntermediateCa(RotateIntermediateCAOptions{IntermediateCA: testIntermediateCaOptions(caDir, "frontend"), RootCACrt: rootCACrt})
+	if got, _ := os.ReadFile(intermediateCA.IntermediateCACrt); bytes.Equal(got, oldCrt) {
+		t.Error("intermediate ca wasn't rotated")
+	}
+}
+
+func TestRotateIntermediateCaWithChildren(t *testing.T) {
+	configDir := t.TempDir()
+	caDir := configDir + "/lab"
+	rootCACrt, _ := createTestCaChain(t, configDir, "lab", "frontend")
+	orgOpts := testIntermediateCaOptions(caDir, "org")
+	orgOpts.PathLen = 1
+	org := CreateIntermediateCa(orgOpts)
+	teamOpts := testIntermediateCaOptions(caDir, "team")
+	teamOpts.Parent = "org"
+	team := CreateIntermediateCa(teamOpts)
+	oldOrgCrt, err := os.ReadFile(org.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The children would stay signed by the archived key
+	expectFatal(t, func() {
+		RotateIntermediateCa(RotateIntermediateCAOptions{IntermediateCA: testIntermediateCaOptions(caDir, "org"), RootCACrt: rootCACrt})
+	})
+	if got, _ := os.ReadFile(org.IntermediateCACrt); !bytes.Equal(got, oldOrgCrt) {
+		t.Fatal("intermediate ca with children was rotated without --force")
+	}
+
+	RotateIntermediateCa(RotateIntermediateCAOptions{IntermediateCA: testIntermediateCaOptions(caDir, "org"), RootCACrt: rootCACrt, Force: true})
+	RotateIntermediateCa(RotateIntermediateCAOptions{IntermediateCA: testIntermediateCaOptions(caDir, "team"), RootCACrt: rootCACrt})
+
+	// Leaves of the rotated child validate through the rotated parent
+	leaf, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: team.IntermediateCACrt,
+		IntermediateCAKey: team.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		AltNames:          []string{"app.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainPEM, err := ChainPEM(team.IntermediateCACrt, rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 {
+		t.Errorf("chain has %d certs, want team, org and the root ca", len(chain))
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, cert := range chain {
+		if isSelfSigned(cert) {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if _, err := leaf.Cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("leaf of the rotated child doesn't validate: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IssuancePolicy restricts the leaf certs a ca issues. It is read from the
+// policy.json file in the root ca and intermediate ca directories, a request
+// has to satisfy the policies of both. Unset fields don't restrict anything.
+type IssuancePolicy struct {
+	// AllowedDomains are the domains, and their subdomains, dns names may be in
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+	// AllowedPatterns are regular expressions dns names may match instead
+	AllowedPatterns []string `json:"allowedPatterns,omitempty"`
+	// AllowWildcards permits wildcard dns names
+	AllowWildcards *bool `json:"allowWildcards,omitempty"`
+	// AllowIPAddresses permits ip address SANs
+	AllowIPAddresses *bool `json:"allowIpAddresses,omitempty"`
+	// MaxValidityDays is the longest validity of an issued cert
+	MaxValidityDays int `json:"maxValidityDays,omitempty"`
+	// AllowedKeyTypes are the permitted key types: RSA, ECDSA or Ed25519
+	AllowedKeyTypes []string `json:"allowedKeyTypes,omitempty"`
+	// MinRSAKeySize is the smallest permitted rsa key size in bits
+	MinRSAKeySize int `json:"minRsaKeySize,omitempty"`
+	// MinECDSAKeySize is the smallest permitted ecdsa curve size in bits
+	MinECDSAKeySize int `json:"minEcdsaKeySize,omitempty"`
+	// AllowedExtKeyUsages are the permitted extended key usages, e.g. serverAuth
+	AllowedExtKeyUsages []string `json:"allowedExtKeyUsages,omitempty"`
+
+	// patterns are the compiled AllowedPatterns, anchored to the whole name
+	patterns []*regexp.Regexp
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// PolicyFile returns the policy file of the ca the crt file belongs to.
+func PolicyFile(caCrtFile string) string {
+	return filepath.Dir(caCrtFile) + "/policy.json"
+}
+
+// LoadIssuancePolicy reads a policy file. A missing file is an empty policy.
+func LoadIssuancePolicy(policyFile string) (*IssuancePolicy, error) {
+	policyJSON, err := os.ReadFile(policyFile)
+	if os.IsNotExist(err) {
+		return &IssuancePolicy{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy file: %v", err)
+	}
+
+	var policy IssuancePolicy
+	decoder := json.NewDecoder(bytes.NewReader(policyJSON))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("error parsing policy file %s: %v", policyFile, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", policyFile, err)
+	}
+	return &policy, nil
+}
+
+// InitIssuancePolicy writes a policy file matching what crtforge issues by
+// default, as a starting point for editing.
+func InitIssuancePolicy(policyFile string) {
+	if _, err := os.Stat(policyFile); err == nil {
+		log.Fatal("Policy file already exists, refusing to overwrite: ", policyFile)
+	}
+	allow := true
+	policy := IssuancePolicy{
+		AllowWildcards:      &allow,
+		AllowIPAddresses:    &allow,
+		MaxValidityDays:     366,
+		AllowedKeyTypes:     []string{"RSA", "ECDSA", "Ed25519"},
+		MinRSAKeySize:       2048,
+		MinECDSAKeySize:     256,
+		AllowedExtKeyUsages: []string{"serverAuth", "clientAuth"},
+	}
+	policyJSON, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		log.Fatal("Error while encoding policy: ", err)
+	}
+	if err := os.WriteFile(policyFile, append(policyJSON, '\n'), 0600); err != nil {
+		log.Fatal("Error while writing policy file: ", err)
+	}
+	log.Info("Policy file created at ", policyFile)
+}
+
+func (p *IssuancePolicy) validate() error {
+	p.patterns = nil
+	for _, pattern := range p.AllowedPatterns {
+		compiled, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		p.patterns = append(p.patterns, compiled)
+	}
+	for _, keyType := range p.AllowedKeyTypes {
+		if keyType != "RSA" && keyType != "ECDSA" && keyType != "Ed25519" {
+			return fmt.Errorf("unknown key type %s, use RSA, ECDSA or Ed25519", keyType)
+		}
+	}
+	for _, extKeyUsage := range p.AllowedExtKeyUsages {
+		if _, ok := extKeyUsageNames[extKeyUsage]; !ok {
+			return fmt.Errorf("unknown extended key usage %s", extKeyUsage)
+		}
+	}
+	return nil
+}
+
+// checkIssuancePolicies checks template and its public key against the
+// policies of the cas in caCrtFiles.
+func checkIssuancePolicies(template *x509.Certificate, publicKey crypto.PublicKey, caCrtFiles ...string) error {
+	for _, caCrtFile := range caCrtFiles {
+		policyFile := PolicyFile(caCrtFile)
+		policy, err := LoadIssuancePolicy(policyFile)
+		if err != nil {
+			return err
+		}
+		if err := policy.Check(template, publicKey); err != nil {
+			return fmt.Errorf("%v (policy %s)", err, policyFile)
+		}
+		log.Debug("Issuance policy satisfied: ", policyFile)
+	}
+	return nil
+}
+
+// Check returns the reason template and its public key break the policy, or nil.
+func (p *IssuancePolicy) Check(template *x509.Certificate, publicKey crypto.PublicKey) error {
+	// Policies built without LoadIssuancePolicy haven't compiled their patterns yet
+	if len(p.patterns) != len(p.AllowedPatterns) {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	restrictsDomains := len(p.AllowedDomains) > 0 || len(p.AllowedPatterns) > 0
+	for _, dnsName := range policyDNSNames(template) {
+		if strings.Contains(dnsName, "*") && p.AllowWildcards != nil && !*p.AllowWildcards {
+			return fmt.Errorf("wildcard name %s is not allowed", dnsName)
+		}
+		if restrictsDomains && !p.allowsDomain(dnsName) {
+			return fmt.Errorf("%s is not in the allowed domains or patterns", dnsName)
+		}
+	}
+	// Email and uri SANs are checked by their domain, e.g. example.com of
+	// user@example.com and spiffe://example.com/app
+	if restrictsDomains {
+		for _, email := range template.EmailAddresses {
+			if !p.allowsDomain(email[strings.LastIndex(email, "@")+1:]) {
+				return fmt.Errorf("email address %s is not in the allowed domains or patterns", email)
+			}
+		}
+		for _, uri := range template.URIs {
+			if !p.allowsDomain(uri.Hostname()) {
+				return fmt.Errorf("uri %s is not in the allowed domains or patterns", uri)
+			}
+		}
+	}
+
+	if len(template.IPAddresses) > 0 && p.AllowIPAddresses != nil && !*p.AllowIPAddresses {
+		return fmt.Errorf("ip address %s is not allowed", template.IPAddresses[0])
+	}
+
+	if p.MaxValidityDays > 0 {
+		validity := template.NotAfter.Sub(template.NotBefore)
+		if validity > time.Duration(p.MaxValidityDays)*24*time.Hour {
+			return fmt.Errorf("validity of %.1f days is longer than the allowed %d days", validity.Hours()/24, p.MaxValidityDays)
+		}
+	}
+
+	if err := p.checkKey(publicKey); err != nil {
+		return err
+	}
+
+	if len(p.AllowedExtKeyUsages) > 0 {
+		for _, extKeyUsage := range template.ExtKeyUsage {
+			if !p.allowsExtKeyUsage(extKeyUsage) {
+				return fmt.Errorf("extended key usage %s is not allowed", extKeyUsageName(extKeyUsage))
+			}
+		}
+	}
+	return nil
+}
+
+// policyDNSNames returns the dns names of template and its common name when
+// it looks like a host name, clients without san support match it instead.
+func policyDNSNames(template *x509.Certificate) []string {
+	commonName := template.Subject.CommonName
+	if !strings.ContainsAny(commonName, ".*") || net.ParseIP(commonName) != nil || !hostNamePattern.MatchString(commonName) {
+		return template.DNSNames
+	}
+	for _, dnsName := range template.DNSNames {
+		if strings.EqualFold(dnsName, commonName) {
+			return template.DNSNames
+		}
+	}
+	return append(append([]string{}, template.DNSNames...), commonName)
+}
+
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9*_.-]+$`)
+
+func (p *IssuancePolicy) allowsDomain(dnsName string) bool {
+	if matchesAnyDomain(dnsName, p.AllowedDomains) {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(dnsName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *IssuancePolicy) checkKey(publicKey crypto.PublicKey) error {
+	var keyType string
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		keyType = "RSA"
+		if p.MinRSAKeySize > 0 && key.N.BitLen() < p.MinRSAKeySize {
+			return fmt.Errorf("rsa key size %d is smaller than the allowed %d bits", key.N.BitLen(), p.MinRSAKeySize)
+		}
+	case *ecdsa.PublicKey:
+		keyType = "ECDSA"
+		if p.MinECDSAKeySize > 0 && key.Curve.Params().BitSize < p.MinECDSAKeySize {
+			return fmt.Errorf("ecdsa key size %d is smaller than the allowed %d bits", key.Curve.Params().BitSize, p.MinECDSAKeySize)
+		}
+	case ed25519.PublicKey:
+		keyType = "Ed25519"
+	default:
+		return fmt.Errorf("unsupported key type %T", publicKey)
+	}
+
+	if len(p.AllowedKeyTypes) == 0 {
+		return nil
+	}
+	for _, allowedKeyType := range p.AllowedKeyTypes {
+		if allowedKeyType == keyType {
+			return nil
+		}
+	}
+	return fmt.Errorf("key type %s is not allowed", keyType)
+}
+
+func (p *IssuancePolicy) allowsExtKeyUsage(extKeyUsage x509.ExtKeyUsage) bool {
+	for _, allowed := range p.AllowedExtKeyUsages {
+		if extKeyUsageNames[allowed] == extKeyUsage {
+			return true
+		}
+	}
+	return false
+}
+
+func extKeyUsageName(extKeyUsage x509.ExtKeyUsage) string {
+	for name, value := range extKeyUsageNames {
+		if value == extKeyUsage {
+			return name
+		}
+	}
+	return fmt.Sprint(extKeyUsage)
+}
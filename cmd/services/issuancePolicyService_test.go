@@ -0,0 +1,147 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIssuancePolicyCheck(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := false
+	now := time.Now()
+	uri := func(rawURL string) []*url.URL {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*url.URL{parsed}
+	}
+
+	tests := []struct {
+		name     string
+		policy   IssuancePolicy
+		template x509.Certificate
+		key      crypto.PublicKey
+		allowed  bool
+	}{
+		{"empty policy", IssuancePolicy{}, x509.Certificate{DNSNames: []string{"any.test"}}, &ecdsaKey.PublicKey, true},
+		{"allowed domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{DNSNames: []string{"api.example.com"}}, &ecdsaKey.PublicKey, true},
+		{"other domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{DNSNames: []string{"example.com.attacker.test"}}, &ecdsaKey.PublicKey, false},
+		{"pattern match", IssuancePolicy{AllowedPatterns: []string{`api\.corp\.example`}}, x509.Certificate{DNSNames: []string{"api.corp.example"}}, &ecdsaKey.PublicKey, true},
+		{"pattern suffix", IssuancePolicy{AllowedPatterns: []string{`api\.corp\.example`}}, x509.Certificate{DNSNames: []string{"api.corp.example.attacker.com"}}, &ecdsaKey.PublicKey, false},
+		{"pattern prefix", IssuancePolicy{AllowedPatterns: []string{`api\.corp\.example`}}, x509.Certificate{DNSNames: []string{"evil.api.corp.example"}}, &ecdsaKey.PublicKey, false},
+		{"pattern alternation", IssuancePolicy{AllowedPatterns: []string{`a\.lab|b\.lab`}}, x509.Certificate{DNSNames: []string{"b.lab"}}, &ecdsaKey.PublicKey, true},
+		{"pattern alternation suffix", IssuancePolicy{AllowedPatterns: []string{`a\.lab|b\.lab`}}, x509.Certificate{DNSNames: []string{"a.lab.attacker.com"}}, &ecdsaKey.PublicKey, false},
+		{"wildcard denied", IssuancePolicy{AllowWildcards: &deny}, x509.Certificate{DNSNames: []string{"*.example.com"}}, &ecdsaKey.PublicKey, false},
+		{"common name only", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{Subject: pkix.Name{CommonName: "evil.test"}}, &ecdsaKey.PublicKey, false},
+		{"common name wildcard", IssuancePolicy{AllowWildcards: &deny}, x509.Certificate{Subject: pkix.Name{CommonName: "*.example.com"}}, &ecdsaKey.PublicKey, false},
+		{"common name of a person", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{Subject: pkix.Name{CommonName: "Jane Doe"}}, &ecdsaKey.PublicKey, true},
+		{"email in domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{EmailAddresses: []string{"jane@example.com"}}, &ecdsaKey.PublicKey, true},
+		{"email outside domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{EmailAddresses: []string{"jane@attacker.test"}}, &ecdsaKey.PublicKey, false},
+		{"uri in domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{URIs: uri("spiffe://example.com/app")}, &ecdsaKey.PublicKey, true},
+		{"uri outside domain", IssuancePolicy{AllowedDomains: []string{"example.com"}}, x509.Certificate{URIs: uri("spiffe://attacker.test/app")}, &ecdsaKey.PublicKey, false},
+		{"ip denied", IssuancePolicy{AllowIPAddresses: &deny}, x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, &ecdsaKey.PublicKey, false},
+		{"validity at the limit", IssuancePolicy{MaxValidityDays: 366}, x509.Certificate{NotBefore: now, NotAfter: now.Add(366 * 24 * time.Hour)}, &ecdsaKey.PublicKey, true},
+		{"validity a fraction over", IssuancePolicy{MaxValidityDays: 366}, x509.Certificate{NotBefore: now, NotAfter: now.Add(366*24*time.Hour + 22*time.Hour)}, &ecdsaKey.PublicKey, false},
+		{"rsa key too small", IssuancePolicy{MinRSAKeySize: 2048}, x509.Certificate{}, &rsaKey.PublicKey, false},
+		{"key type denied", IssuancePolicy{AllowedKeyTypes: []string{"RSA"}}, x509.Certificate{}, &ecdsaKey.PublicKey, false},
+		{"ext key usage denied", IssuancePolicy{AllowedExtKeyUsages: []string{"serverAuth"}}, x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}}, &ecdsaKey.PublicKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Check(&test.template, test.key)
+			if (err == nil) != test.allowed {
+				t.Errorf("Check() = %v, want allowed %v", err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestLoadIssuancePolicy(t *testing.T) {
+	policyDir := t.TempDir()
+	tests := []struct {
+		name  string
+		json  string
+		valid bool
+	}{
+		{"patterns", `{"allowedPatterns": ["^[a-z]+\\.lab$"]}`, true},
+		{"broken pattern", `{"allowedPatterns": ["("]}`, false},
+		{"unknown field", `{"allowedDomain": ["example.com"]}`, false},
+		{"unknown key type", `{"allowedKeyTypes": ["DSA"]}`, false},
+	}
+	for _, test := range tests {
+		policyFile := policyDir + "/" + test.name + ".json"
+		if err := os.WriteFile(policyFile, []byte(test.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIssuancePolicy(policyFile); (err == nil) != test.valid {
+			t.Errorf("%s: LoadIssuancePolicy() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestParentIntermediateCaPolicy(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, _ := createTestCaChain(t, configDir, "lab", "frontend")
+	CreateIntermediateCa(CreateIntermediateCAOptions{
+		ConfigDirectory:     configDir + "/lab",
+		RootCACnf:           configDir + "/lab/rootCA/rootCA.cnf",
+		IntermediateCAName:  "org",
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+		PathLen:             1,
+	})
+	team := CreateIntermediateCa(CreateIntermediateCAOptions{
+		ConfigDirectory:     configDir + "/lab",
+		RootCACnf:           configDir + "/lab/rootCA/rootCA.cnf",
+		IntermediateCAName:  "team",
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+		Parent:              "org",
+	})
+	if err := os.WriteFile(configDir+"/lab/org/policy.json", []byte(`{"allowedDomains": ["example.com"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		domain  string
+		allowed bool
+	}{
+		{"app.example.com", true},
+		{"evil.test", false},
+	} {
+		_, err := IssueAppCrt(CreateAppCrtOptions{
+			IntermediateCACrt: team.IntermediateCACrt,
+			IntermediateCAKey: team.IntermediateCAKey,
+			RootCACrt:         rootCACrt,
+			CommonName:        test.domain,
+			AltNames:          []string{test.domain},
+		})
+		if (err == nil) != test.allowed {
+			t.Errorf("issuing %s under the team ca = %v, want allowed %v", test.domain, err, test.allowed)
+		}
+	}
+}
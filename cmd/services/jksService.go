@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf16"
+)
+
+// The JKS format is the proprietary keystore format of Java. The keystore is
+// protected by a sha1 digest of the password and the keys by a sha1 keystream
+// of the password, as written by keytool.
+const (
+	jksMagic            = 0xfeedfeed
+	jceksMagic          = 0xcececece
+	jksVersion          = 2
+	jksPrivateKeyTag    = 1
+	jksTrustedCertTag   = 2
+	jksSaltSize         = sha1.Size
+	jksIntegritySuffix  = "Mighty Aphrodite"
+	jksCertType         = "X.509"
+	jksMaxEntryDataSize = 1 << 20
+)
+
+// oidJKSKeyProtector is the algorithm of keys protected by keytool
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksEntry is a key with its chain, or a trusted cert when Key is nil
+type jksEntry struct {
+	Alias string
+	Key   crypto.Signer
+	Certs []*x509.Certificate
+}
+
+// encodeJKS returns a JKS keystore with the entries. The keys are protected
+// with the keystore password.
+func encodeJKS(entries []jksEntry, password string) ([]byte, error) {
+	var out bytes.Buffer
+	writeUint32 := func(v uint32) { binary.Write(&out, binary.BigEndian, v) }
+	writeUTF := func(s string) error {
+		if len(s) > 0xffff {
+			return fmt.Errorf("JKS string too long: %d bytes", len(s))
+		}
+		binary.Write(&out, binary.BigEndian, uint16(len(s)))
+		out.WriteString(s)
+		return nil
+	}
+	writeCert := func(cert *x509.Certificate) error {
+		if err := writeUTF(jksCertType); err != nil {
+			return err
+		}
+		writeUint32(uint32(len(cert.Raw)))
+		out.Write(cert.Raw)
+		return nil
+	}
+
+	writeUint32(jksMagic)
+	writeUint32(jksVersion)
+	writeUint32(uint32(len(entries)))
+	timestamp := time.Now().UnixMilli()
+	for _, entry := range entries {
+		if entry.Key == nil {
+			if len(entry.Certs) != 1 {
+				return nil, fmt.Errorf("trusted cert entry %s needs exactly one cert", entry.Alias)
+			}
+			writeUint32(jksTrustedCertTag)
+		} else {
+			writeUint32(jksPrivateKeyTag)
+		}
+		if err := writeUTF(entry.Alias); err != nil {
+			return nil, err
+		}
+		binary.Write(&out, binary.BigEndian, timestamp)
+		if entry.Key == nil {
+			if err := writeCert(entry.Certs[0]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		protectedKey, err := protectJKSKey(entry.Key, password)
+		if err != nil {
+			return nil, fmt.Errorf("error protecting key %s: %v", entry.Alias, err)
+		}
+		writeUint32(uint32(len(protectedKey)))
+		out.Write(protectedKey)
+		writeUint32(uint32(len(entry.Certs)))
+		for _, cert := range entry.Certs {
+			if err := writeCert(cert); err != nil {
+				return nil, err
+			}
+		}
+	}
+	out.Write(jksDigest(out.Bytes(), password))
+	return out.Bytes(), nil
+}
+
+// decodeJKS returns the entries of a JKS keystore after checking its
+// integrity with the password.
+func decodeJKS(data []byte, password string) ([]jksEntry, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, fmt.Errorf("JKS keystore too short")
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	in := bytes.NewReader(body)
+	readUint32 := func() (uint32, error) {
+		var v uint32
+		err := binary.Read(in, binary.BigEndian, &v)
+		return v, err
+	}
+	readBytes := func(size uint32) ([]byte, error) {
+		if size > jksMaxEntryDataSize || int(size) > in.Len() {
+			return nil, fmt.Errorf("invalid JKS entry size %d", size)
+		}
+		b := make([]byte, size)
+		_, err := io.ReadFull(in, b)
+		return b, err
+	}
+	readUTF := func() (string, error) {
+		var size uint16
+		if err := binary.Read(in, binary.BigEndian, &size); err != nil {
+			return "", err
+		}
+		b, err := readBytes(uint32(size))
+		return string(b), err
+	}
+	readCert := func() (*x509.Certificate, error) {
+		certType, err := readUTF()
+		if err != nil {
+			return nil, err
+		}
+		if certType != jksCertType {
+			return nil, fmt.Errorf("unsupported JKS cert type %s", certType)
+		}
+		size, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		der, err := readBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	}
+
+	magic, err := readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if magic == jceksMagic {
+		return nil, fmt.Errorf("JCEKS keystores are not supported, convert them to PKCS#12 with keytool")
+	}
+	if magic != jksMagic {
+		return nil, fmt.Errorf("not a JKS keystore")
+	}
+	if version, err := readUint32(); err != nil || version != jksVersion {
+		return nil, fmt.Errorf("unsupported JKS version %d", version)
+	}
+	if subtle.ConstantTimeCompare(digest, jksDigest(body, password)) != 1 {
+		return nil, fmt.Errorf("wrong JKS keystore password or corrupted keystore")
+	}
+	count, err := readUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []jksEntry
+	for i := uint32(0); i < count; i++ {
+		tag, err := readUint32()
+		if err != nil {
+			return nil, fmt.Errorf("error reading JKS entry: %v", err)
+		}
+		alias, err := readUTF()
+		if err != nil {
+			return nil, fmt.Errorf("error reading JKS entry: %v", err)
+		}
+		var timestamp int64
+		if err := binary.Read(in, binary.BigEndian, &timestamp); err != nil {
+			return nil, fmt.Errorf("error reading JKS entry %s: %v", alias, err)
+		}
+		entry := jksEntry{Alias: alias}
+		switch tag {
+		case jksTrustedCertTag:
+			cert, err := readCert()
+			if err != nil {
+				return nil, fmt.Errorf("error reading JKS cert %s: %v", alias, err)
+			}
+			entry.Certs = []*x509.Certificate{cert}
+		case jksPrivateKeyTag:
+			size, err := readUint32()
+			if err != nil {
+				return nil, fmt.Errorf("error reading JKS key %s: %v", alias, err)
+			}
+			protectedKey, err := readBytes(size)
+			if err != nil {
+				return nil, fmt.Errorf("error reading JKS key %s: %v", alias, err)
+			}
+			if entry.Key, err = recoverJKSKey(protectedKey, password); err != nil {
+				return nil, fmt.Errorf("error reading JKS key %s: %v", alias, err)
+			}
+			chainSize, err := readUint32()
+			if err != nil {
+				return nil, fmt.Errorf("error reading JKS chain %s: %v", alias, err)
+			}
+			for j := uint32(0); j < chainSize; j++ {
+				cert, err := readCert()
+				if err != nil {
+					return nil, fmt.Errorf("error reading JKS chain %s: %v", alias, err)
+				}
+				entry.Certs = append(entry.Certs, cert)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported JKS entry type %d of %s", tag, alias)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// protectJKSKey encrypts a PKCS#8 key the way keytool does, by xoring it
+// with a sha1 keystream of the password and a random salt.
+func protectJKSKey(key crypto.Signer, password string) ([]byte, error) {
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, jksSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	passwordBytes := jksPasswordBytes(password)
+	encrypted := append(salt, jksKeystream(passwordBytes, salt, pkcs8Key)...)
+	check := sha1.Sum(append(passwordBytes, pkcs8Key...))
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData:       append(encrypted, check[:]...),
+	})
+}
+
+// recoverJKSKey decrypts a key protected by protectJKSKey.
+func recoverJKSKey(protectedKey []byte, password string) (crypto.Signer, error) {
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protectedKey, &keyInfo); err != nil {
+		return nil, err
+	}
+	if !keyInfo.EncryptionAlgorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		return nil, fmt.Errorf("unsupported key protection %s", keyInfo.EncryptionAlgorithm.Algorithm)
+	}
+	data := keyInfo.EncryptedData
+	if len(data) <= jksSaltSize+sha1.Size {
+		return nil, fmt.Errorf("protected key too short")
+	}
+	salt, encrypted, check := data[:jksSaltSize], data[jksSaltSize:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	passwordBytes := jksPasswordBytes(password)
+	pkcs8Key := jksKeystream(passwordBytes, salt, encrypted)
+	expected := sha1.Sum(append(passwordBytes, pkcs8Key...))
+	if subtle.ConstantTimeCompare(check, expected[:]) != 1 {
+		return nil, fmt.Errorf("wrong key password")
+	}
+	return parsePrivateKey(pkcs8Key)
+}
+
+// jksKeystream xors data with the blocks sha1(password || previous block),
+// starting with the salt.
+func jksKeystream(passwordBytes, salt, data []byte) []byte {
+	out := make([]byte, len(data))
+	digest := salt
+	for i := 0; i < len(data); i += sha1.Size {
+		sum := sha1.Sum(append(passwordBytes[:len(passwordBytes):len(passwordBytes)], digest...))
+		digest = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(data); j++ {
+			out[i+j] = data[i+j] ^ digest[j]
+		}
+	}
+	return out
+}
+
+// jksDigest is the keystore integrity digest over the keystore data.
+func jksDigest(data []byte, password string) []byte {
+	digest := sha1.New()
+	digest.Write(jksPasswordBytes(password))
+	digest.Write([]byte(jksIntegritySuffix))
+	digest.Write(data)
+	return digest.Sum(nil)
+}
+
+// jksPasswordBytes returns the password as the big endian utf-16 chars java
+// uses.
+func jksPasswordBytes(password string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
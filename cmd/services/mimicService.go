@@ -0,0 +1,132 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type MimicCrtOptions struct {
+	// From is the host:port of a tls endpoint or a crt file to copy the cert of
+	From string
+	// ServerName is the sni name sent to the tls endpoint, the host of From when empty
+	ServerName string
+	// AppCrt are the options of the lookalike cert. The subject, names, key
+	// type and extended key usages are taken from the source cert
+	AppCrt CreateAppCrtOptions
+}
+
+// The subject attributes pkix.Name has fields for
+var pkixNameAttributes = map[string]bool{
+	"2.5.4.3": true, "2.5.4.5": true, "2.5.4.6": true, "2.5.4.7": true, "2.5.4.8": true,
+	"2.5.4.9": true, "2.5.4.10": true, "2.5.4.11": true, "2.5.4.17": true,
+}
+
+// leafSubjectOf returns the subject of cert for a new cert. Attributes
+// without a pkix.Name field, e.g. emailAddress, are kept as extra names.
+func leafSubjectOf(cert *x509.Certificate) pkix.Name {
+	subject := cert.Subject
+	subject.ExtraNames = nil
+	for _, attribute := range cert.Subject.Names {
+		if !pkixNameAttributes[attribute.Type.String()] {
+			subject.ExtraNames = append(subject.ExtraNames, attribute)
+		}
+	}
+	return subject
+}
+
+// MimicCrt issues an app cert shaped like the cert of a tls endpoint or a crt
+// file, signed by the intermediate ca.
+func MimicCrt(opts MimicCrtOptions) {
+	source, err := ReadSourceCrt(opts.From, opts.ServerName)
+	if err != nil {
+		log.Fatal("Error while reading the source cert: ", err)
+	}
+	appCrtOpts, err := MimicAppCrtOptions(source, opts.AppCrt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Without an app name the cert is named after the source
+	if appCrtOpts.AppName == "" {
+		appCrtOpts.AppName = source.Subject.CommonName
+		if len(source.DNSNames) > 0 {
+			appCrtOpts.AppName = source.DNSNames[0]
+		}
+		appCrtOpts.AppName = strings.ReplaceAll(appCrtOpts.AppName, "*", "wildcard")
+	}
+
+	log.Info("Mimicking ", source.Subject.String(), " issued by ", source.Issuer.String())
+	log.Info("Key: ", appCrtOpts.KeyType, " ", appCrtOpts.KeySize)
+	CreateAppCrt(appCrtOpts)
+}
+
+// ReadSourceCrt reads a crt file, or the leaf cert of a tls endpoint when
+// from is not a file.
+func ReadSourceCrt(from, serverName string) (*x509.Certificate, error) {
+	if _, err := os.Stat(from); err == nil {
+		data, err := os.ReadFile(from)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		return x509.ParseCertificate(data)
+	}
+
+	address := from
+	if _, _, err := net.SplitHostPort(from); err != nil {
+		address = net.JoinHostPort(from, "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	// Only the shape of the cert is copied, so it doesn't have to be trusted
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		return nil, fmt.Errorf("%s sent no certificate", address)
+	}
+	return peerCerts[0], nil
+}
+
+// MimicAppCrtOptions returns opts with the subject, dns, ip, email and uri
+// names, key type and extended key usages of source.
+func MimicAppCrtOptions(source *x509.Certificate, opts CreateAppCrtOptions) (CreateAppCrtOptions, error) {
+	switch publicKey := source.PublicKey.(type) {
+	case *rsa.PublicKey:
+		opts.KeyType, opts.KeySize = "rsa", publicKey.N.BitLen()
+	case *ecdsa.PublicKey:
+		opts.KeyType, opts.KeySize = "ecdsa", publicKey.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		opts.KeyType, opts.KeySize = "ed25519", 0
+	default:
+		return opts, fmt.Errorf("unsupported public key type %T", source.PublicKey)
+	}
+
+	opts.Subject = leafSubjectOf(source)
+	opts.CommonName = source.Subject.CommonName
+
+	opts.AltNames = leafAltNames(source)
+	opts.ExtKeyUsages = source.ExtKeyUsage
+	return opts, nil
+}
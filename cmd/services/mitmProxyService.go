@@ -0,0 +1,278 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type MitmProxyOptions struct {
+	// Listen is the address the proxy listens on, e.g. :8080
+	Listen string
+	// IntermediateCACrt is the crt file of the intermediate ca that forges the certs
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that forges the certs
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file, it has to be created by crtforge
+	RootCACrt string
+	// UpstreamCACrt is a ca crt file trusted for upstream servers next to the system roots
+	UpstreamCACrt string
+	// InsecureUpstream skips the verification of upstream certs
+	InsecureUpstream bool
+	// DumpFile receives the full requests and responses, - for stdout
+	DumpFile string
+}
+
+type mitmProxy struct {
+	onDemand *OnDemandTLS
+	proxy    *httputil.ReverseProxy
+	// intercepted tls connections are served by an http server reading from conns
+	conns chan net.Conn
+
+	dumpMu sync.Mutex
+	dump   io.Writer
+}
+
+// ServeMitm serves an http proxy that intercepts the tls connections tunneled
+// with CONNECT. Each upstream host gets a cert forged by the intermediate ca,
+// and the decrypted requests and responses are logged or dumped.
+func ServeMitm(opts MitmProxyOptions) {
+	p, err := newMitmProxy(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch opts.DumpFile {
+	case "":
+	case "-":
+		p.dump = os.Stdout
+	default:
+		dumpFile, err := os.OpenFile(opts.DumpFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal("Error while opening dump file: ", err)
+		}
+		defer dumpFile.Close()
+		p.dump = dumpFile
+	}
+	if opts.InsecureUpstream {
+		log.Warn("Upstream certs are not verified.")
+	}
+
+	httpServer := &http.Server{
+		Addr:              opts.Listen,
+		Handler:           p,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving MITM proxy on ", opts.Listen)
+	log.Info("Clients have to trust ", opts.RootCACrt)
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+// newMitmProxy loads the intermediate ca and starts serving the intercepted
+// connections. The root ca has to be the one of a crtforge ca dir.
+func newMitmProxy(opts MitmProxyOptions) (*mitmProxy, error) {
+	caDir := filepath.Dir(filepath.Dir(opts.RootCACrt))
+	if filepath.Clean(opts.RootCACrt) != filepath.Join(caDir, "rootCA", "rootCA.crt") {
+		return nil, fmt.Errorf("refusing to intercept traffic with a root ca outside a crtforge ca dir: %s", opts.RootCACrt)
+	}
+	if err := CheckCrtforgeRootCa(caDir); err != nil {
+		return nil, err
+	}
+	onDemand, err := NewOnDemandTLS(OnDemandTLSOptions{
+		IntermediateCACrt: opts.IntermediateCACrt,
+		IntermediateCAKey: opts.IntermediateCAKey,
+		RootCACrt:         opts.RootCACrt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while loading CA: %v", err)
+	}
+
+	upstreamCAs, err := x509.SystemCertPool()
+	if err != nil {
+		upstreamCAs = x509.NewCertPool()
+	}
+	if opts.UpstreamCACrt != "" {
+		upstreamCAPEM, err := os.ReadFile(opts.UpstreamCACrt)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading upstream CA: %v", err)
+		}
+		if !upstreamCAs.AppendCertsFromPEM(upstreamCAPEM) {
+			return nil, fmt.Errorf("no certificate found in upstream CA file: %s", opts.UpstreamCACrt)
+		}
+	}
+
+	p := &mitmProxy{
+		onDemand: onDemand,
+		conns:    make(chan net.Conn),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		// Requests already carry the absolute upstream url
+		Rewrite:        p.rewrite,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Warn(r.Method, " ", r.URL, ": ", err)
+			http.Error(w, "upstream error: "+err.Error(), http.StatusBadGateway)
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:            upstreamCAs,
+				InsecureSkipVerify: opts.InsecureUpstream,
+			},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	interceptServer := &http.Server{
+		Handler:           http.HandlerFunc(p.serveIntercepted),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go interceptServer.Serve(&connListener{conns: p.conns})
+	return p, nil
+}
+
+// CheckCrtforgeRootCa returns an error unless the root ca of caDir was created
+// by crtforge. Imported roots are usually trusted by machines for more than
+// the lab, so they never forge certs of other hosts.
+func CheckCrtforgeRootCa(caDir string) error {
+	rootCaDir := caDir + "/rootCA"
+	cert, err := readCert(rootCaDir + "/rootCA.crt")
+	if err != nil {
+		return fmt.Errorf("error reading root CA: %v", err)
+	}
+	if !isSelfSigned(cert) {
+		return fmt.Errorf("refusing to intercept traffic with a root ca that isn't self-signed: %s", cert.Subject.String())
+	}
+	if _, err := os.Stat(rootCaDir + "/rootCA.key"); err != nil {
+		return fmt.Errorf("refusing to intercept traffic with a root ca without its key in %s", rootCaDir)
+	}
+	// ca import writes the loose policy to the cnf, crtforge roots sign with the strict one
+	rootCaCnf, err := os.ReadFile(rootCaDir + "/rootCA.cnf")
+	if err != nil {
+		return fmt.Errorf("refusing to intercept traffic with a root ca outside a crtforge ca dir: %v", err)
+	}
+	if !rootCaPolicyStrict.Match(rootCaCnf) {
+		return fmt.Errorf("refusing to intercept traffic with a root ca not created by crtforge: %s", cert.Subject.String())
+	}
+	return nil
+}
+
+var rootCaPolicyStrict = regexp.MustCompile(`(?m)^policy\s*=\s*policy_strict\s*$`)
+
+// ServeHTTP intercepts CONNECT tunnels and forwards plain http proxy requests.
+func (p *mitmProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.intercept(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// intercept answers the CONNECT and terminates the tunneled tls connection
+// with a cert forged for the requested host.
+func (p *mitmProxy) intercept(w http.ResponseWriter, r *http.Request) {
+	connectHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		connectHost = r.Host
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be intercepted", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Warn("Error while intercepting ", r.Host, ": ", err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	log.Debug("Intercepting ", r.Host)
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		// Clients without SNI get the cert of the CONNECT host
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = connectHost
+			}
+			return p.onDemand.Certificate(strings.ToLower(name))
+		},
+	})
+	p.conns <- tlsConn
+}
+
+// serveIntercepted forwards a decrypted request to its upstream host.
+func (p *mitmProxy) serveIntercepted(w http.ResponseWriter, r *http.Request) {
+	r.URL.Scheme = "https"
+	r.URL.Host = r.Host
+	p.proxy.ServeHTTP(w, r)
+}
+
+func (p *mitmProxy) rewrite(r *httputil.ProxyRequest) {
+	if p.dump == nil {
+		return
+	}
+	dump, err := httputil.DumpRequest(r.Out, true)
+	if err != nil {
+		log.Warn("Error while dumping request: ", err)
+		return
+	}
+	p.writeDump(">>> "+r.Out.Method+" "+r.Out.URL.String(), dump)
+}
+
+func (p *mitmProxy) modifyResponse(resp *http.Response) error {
+	log.Info(resp.Request.Method, " ", resp.Request.URL, " ", resp.StatusCode)
+	if p.dump == nil {
+		return nil
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return fmt.Errorf("error dumping response: %v", err)
+	}
+	p.writeDump("<<< "+resp.Status+" "+resp.Request.URL.String(), dump)
+	return nil
+}
+
+func (p *mitmProxy) writeDump(title string, dump []byte) {
+	p.dumpMu.Lock()
+	defer p.dumpMu.Unlock()
+	fmt.Fprintf(p.dump, "%s %s\n%s\n\n", time.Now().Format(time.RFC3339), title, dump)
+}
+
+// connListener hands the intercepted connections to an http server.
+type connListener struct {
+	conns chan net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
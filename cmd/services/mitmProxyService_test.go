@@ -0,0 +1,99 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestMitmProxyInterceptsUpstream(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "mitm")
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	upstreamCACrt := configDir + "/upstream.crt"
+	upstreamPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(upstreamCACrt, upstreamPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newMitmProxy(MitmProxyOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		UpstreamCACrt:     upstreamCACrt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	rootCert, err := readCert(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	resp, err := client.Get(upstream.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello from /health" {
+		t.Errorf("unexpected body %q", body)
+	}
+	intermediateCert, err := readCert(intermediateCA.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuedBy(resp.TLS.PeerCertificates[0], intermediateCert) {
+		t.Errorf("upstream cert %s wasn't forged by the intermediate ca", resp.TLS.PeerCertificates[0].Subject)
+	}
+}
+
+func TestMitmProxyRefusesImportedRootCa(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, _ := createTestCaChain(t, configDir, "lab", "mitm")
+	// A crtforge root imported into another ca dir carries the crtforge subject
+	ImportCa(ImportCAOptions{
+		ConfigDirectory:     configDir,
+		CACrt:               rootCACrt,
+		CAKey:               configDir + "/lab/rootCA/rootCA.key",
+		Name:                "corp",
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+		BasicConstraints:    "CA:FALSE",
+	})
+
+	if err := CheckCrtforgeRootCa(configDir + "/lab"); err != nil {
+		t.Errorf("root ca created by crtforge was refused: %v", err)
+	}
+	if err := CheckCrtforgeRootCa(configDir + "/corp"); err == nil {
+		t.Error("imported root ca was accepted")
+	}
+	if err := CheckCrtforgeRootCa(configDir + "/missing"); err == nil {
+		t.Error("missing ca dir was accepted")
+	}
+	if _, err := newMitmProxy(MitmProxyOptions{RootCACrt: configDir + "/corp/rootCA/rootCA.crt"}); err == nil {
+		t.Error("proxy started with an imported root ca")
+	}
+}
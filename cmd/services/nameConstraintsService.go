@@ -0,0 +1,191 @@
+package services
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var oidNameConstraints = asn1.ObjectIdentifier{2, 5, 29, 30}
+
+type NameConstraints struct {
+	// PermittedDNSDomains are the dns domains the intermediate ca may sign
+	PermittedDNSDomains []string
+	// ExcludedDNSDomains are the dns domains the intermediate ca may not sign
+	ExcludedDNSDomains []string
+	// PermittedIPRanges are the ip ranges in CIDR notation the intermediate ca may sign
+	PermittedIPRanges []string
+}
+
+func (c NameConstraints) isEmpty() bool {
+	return len(c.PermittedDNSDomains) == 0 && len(c.ExcludedDNSDomains) == 0 && len(c.PermittedIPRanges) == 0
+}
+
+// opensslValue formats the constraints for the nameConstraints setting of
+// an openssl extension section, e.g. permitted;DNS:example.com
+func (c NameConstraints) opensslValue() (string, error) {
+	var values []string
+	for _, domain := range c.PermittedDNSDomains {
+		values = append(values, "permitted;DNS:"+domain)
+	}
+	for _, ipRange := range c.PermittedIPRanges {
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return "", fmt.Errorf("invalid ip range %s: %v", ipRange, err)
+		}
+		values = append(values, "permitted;IP:"+ipNetString(ipNet))
+	}
+	for _, domain := range c.ExcludedDNSDomains {
+		values = append(values, "excluded;DNS:"+domain)
+	}
+	return strings.Join(values, ","), nil
+}
+
+// certNameConstraints returns the name constraints of an issued ca cert.
+func certNameConstraints(cert *x509.Certificate) NameConstraints {
+	constraints := NameConstraints{
+		PermittedDNSDomains: cert.PermittedDNSDomains,
+		ExcludedDNSDomains:  cert.ExcludedDNSDomains,
+	}
+	for _, ipRange := range cert.PermittedIPRanges {
+		constraints.PermittedIPRanges = append(constraints.PermittedIPRanges, ipRange.String())
+	}
+	return constraints
+}
+
+type generalSubtree struct {
+	Name asn1.RawValue
+}
+
+type nameConstraintsExt struct {
+	Permitted []generalSubtree `asn1:"optional,tag:0"`
+	Excluded  []generalSubtree `asn1:"optional,tag:1"`
+}
+
+// csrNameConstraints returns the name constraints requested by a csr in the
+// openssl format, or an empty string if none were requested.
+func csrNameConstraints(csr *x509.CertificateRequest) (string, error) {
+	var ext *pkix.Extension
+	for i := range csr.Extensions {
+		if csr.Extensions[i].Id.Equal(oidNameConstraints) {
+			ext = &csr.Extensions[i]
+		}
+	}
+	if ext == nil {
+		return "", nil
+	}
+
+	var constraints nameConstraintsExt
+	if _, err := asn1.Unmarshal(ext.Value, &constraints); err != nil {
+		return "", fmt.Errorf("error parsing name constraints: %v", err)
+	}
+	var values []string
+	for _, subtrees := range []struct {
+		kind     string
+		subtrees []generalSubtree
+	}{{"permitted", constraints.Permitted}, {"excluded", constraints.Excluded}} {
+		for _, subtree := range subtrees.subtrees {
+			switch subtree.Name.Tag {
+			case 2: // dNSName
+				values = append(values, subtrees.kind+";DNS:"+string(subtree.Name.Bytes))
+			case 7: // iPAddress, address followed by mask
+				size := len(subtree.Name.Bytes) / 2
+				ipNet := &net.IPNet{IP: subtree.Name.Bytes[:size], Mask: subtree.Name.Bytes[size:]}
+				values = append(values, subtrees.kind+";IP:"+ipNetString(ipNet))
+			default:
+				return "", fmt.Errorf("unsupported name constraint type %d", subtree.Name.Tag)
+			}
+		}
+	}
+	return strings.Join(values, ","), nil
+}
+
+func ipNetString(ipNet *net.IPNet) string {
+	return ipNet.IP.String() + "/" + net.IP(ipNet.Mask).String()
+}
+
+// checkNameConstraints returns an error for the first SAN of template that
+// caCert isn't allowed to sign.
+func checkNameConstraints(caCert *x509.Certificate, template *x509.Certificate) error {
+	for _, dnsName := range template.DNSNames {
+		if len(caCert.PermittedDNSDomains) > 0 && !matchesAnyDomain(dnsName, caCert.PermittedDNSDomains) {
+			return fmt.Errorf("%s is not in the permitted domains %v of %s", dnsName, caCert.PermittedDNSDomains, caCert.Subject.String())
+		}
+		if matchesAnyDomain(dnsName, caCert.ExcludedDNSDomains) {
+			return fmt.Errorf("%s is in the excluded domains %v of %s", dnsName, caCert.ExcludedDNSDomains, caCert.Subject.String())
+		}
+	}
+	for _, ip := range template.IPAddresses {
+		if len(caCert.PermittedIPRanges) > 0 && !matchesAnyIPRange(ip, caCert.PermittedIPRanges) {
+			return fmt.Errorf("%s is not in the permitted ip ranges %v of %s", ip, caCert.PermittedIPRanges, caCert.Subject.String())
+		}
+		if matchesAnyIPRange(ip, caCert.ExcludedIPRanges) {
+			return fmt.Errorf("%s is in the excluded ip ranges %v of %s", ip, caCert.ExcludedIPRanges, caCert.Subject.String())
+		}
+	}
+	for _, email := range template.EmailAddresses {
+		if len(caCert.PermittedEmailAddresses) > 0 && !matchesAnyEmail(email, caCert.PermittedEmailAddresses) {
+			return fmt.Errorf("%s is not in the permitted email addresses %v of %s", email, caCert.PermittedEmailAddresses, caCert.Subject.String())
+		}
+		if matchesAnyEmail(email, caCert.ExcludedEmailAddresses) {
+			return fmt.Errorf("%s is in the excluded email addresses %v of %s", email, caCert.ExcludedEmailAddresses, caCert.Subject.String())
+		}
+	}
+	for _, uri := range template.URIs {
+		// Clients reject uris without a host name under uri constraints
+		host := uri.Hostname()
+		if len(caCert.PermittedURIDomains) > 0 && (host == "" || !matchesAnyDomain(host, caCert.PermittedURIDomains)) {
+			return fmt.Errorf("%s is not in the permitted uri domains %v of %s", uri, caCert.PermittedURIDomains, caCert.Subject.String())
+		}
+		if len(caCert.ExcludedURIDomains) > 0 && (host == "" || matchesAnyDomain(host, caCert.ExcludedURIDomains)) {
+			return fmt.Errorf("%s is in the excluded uri domains %v of %s", uri, caCert.ExcludedURIDomains, caCert.Subject.String())
+		}
+	}
+	return nil
+}
+
+// matchesAnyDomain follows RFC 5280, a constraint matches the domain itself
+// and its subdomains, a constraint with a leading dot only its subdomains.
+// The wildcard label of a dns name is matched like any other label.
+func matchesAnyDomain(dnsName string, constraints []string) bool {
+	dnsName = strings.ToLower(dnsName)
+	for _, constraint := range constraints {
+		constraint = strings.ToLower(constraint)
+		if strings.HasPrefix(constraint, ".") {
+			if strings.HasSuffix(dnsName, constraint) {
+				return true
+			}
+		} else if dnsName == constraint || strings.HasSuffix(dnsName, "."+constraint) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyEmail matches a constraint with an @ against the whole address
+// and any other constraint like a dns constraint against the domain part.
+func matchesAnyEmail(email string, constraints []string) bool {
+	at := strings.LastIndex(email, "@")
+	for _, constraint := range constraints {
+		if constraintAt := strings.LastIndex(constraint, "@"); constraintAt >= 0 {
+			if email[:at+1] == constraint[:constraintAt+1] && strings.EqualFold(email[at+1:], constraint[constraintAt+1:]) {
+				return true
+			}
+		} else if matchesAnyDomain(email[at+1:], []string{constraint}) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyIPRange(ip net.IP, constraints []*net.IPNet) bool {
+	for _, constraint := range constraints {
+		if constraint.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"crypto/x509"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestCheckNameConstraints(t *testing.T) {
+	_, lab, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := func(rawURL string) []*url.URL {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*url.URL{parsed}
+	}
+
+	tests := []struct {
+		name     string
+		caCert   x509.Certificate
+		template x509.Certificate
+		allowed  bool
+	}{
+		{"no constraints", x509.Certificate{}, x509.Certificate{DNSNames: []string{"any.test"}}, true},
+		{"permitted domain", x509.Certificate{PermittedDNSDomains: []string{"example.com"}}, x509.Certificate{DNSNames: []string{"api.example.com"}}, true},
+		{"permitted domain itself", x509.Certificate{PermittedDNSDomains: []string{"example.com"}}, x509.Certificate{DNSNames: []string{"example.com"}}, true},
+		{"subdomains only", x509.Certificate{PermittedDNSDomains: []string{".example.com"}}, x509.Certificate{DNSNames: []string{"example.com"}}, false},
+		{"suffix without dot", x509.Certificate{PermittedDNSDomains: []string{"example.com"}}, x509.Certificate{DNSNames: []string{"evilexample.com"}}, false},
+		{"excluded domain", x509.Certificate{ExcludedDNSDomains: []string{"internal.example.com"}}, x509.Certificate{DNSNames: []string{"DB.Internal.example.com"}}, false},
+		{"permitted ip", x509.Certificate{PermittedIPRanges: []*net.IPNet{lab}}, x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}}, true},
+		{"other ip", x509.Certificate{PermittedIPRanges: []*net.IPNet{lab}}, x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.168.1.1")}}, false},
+		{"permitted email domain", x509.Certificate{PermittedEmailAddresses: []string{"example.com"}}, x509.Certificate{EmailAddresses: []string{"jane@example.com"}}, true},
+		{"other email domain", x509.Certificate{PermittedEmailAddresses: []string{"example.com"}}, x509.Certificate{EmailAddresses: []string{"jane@attacker.test"}}, false},
+		{"permitted mailbox", x509.Certificate{PermittedEmailAddresses: []string{"jane@example.com"}}, x509.Certificate{EmailAddresses: []string{"jane@EXAMPLE.com"}}, true},
+		{"other mailbox", x509.Certificate{PermittedEmailAddresses: []string{"jane@example.com"}}, x509.Certificate{EmailAddresses: []string{"john@example.com"}}, false},
+		{"excluded email", x509.Certificate{ExcludedEmailAddresses: []string{"attacker.test"}}, x509.Certificate{EmailAddresses: []string{"jane@attacker.test"}}, false},
+		{"permitted uri domain", x509.Certificate{PermittedURIDomains: []string{"example.com"}}, x509.Certificate{URIs: uri("spiffe://example.com/app")}, true},
+		{"other uri domain", x509.Certificate{PermittedURIDomains: []string{"example.com"}}, x509.Certificate{URIs: uri("spiffe://attacker.test/app")}, false},
+		{"uri without host", x509.Certificate{PermittedURIDomains: []string{"example.com"}}, x509.Certificate{URIs: uri("urn:example.com:app")}, false},
+		{"excluded uri domain", x509.Certificate{ExcludedURIDomains: []string{"attacker.test"}}, x509.Certificate{URIs: uri("https://attacker.test/")}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkNameConstraints(&test.caCert, &test.template)
+			if (err == nil) != test.allowed {
+				t.Errorf("checkNameConstraints() = %v, want allowed %v", err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestIntermediateCaNameConstraints(t *testing.T) {
+	configDir := t.TempDir()
+	caDir := configDir + "/lab"
+	rootCACrt, _ := createTestCaChain(t, configDir, "lab", "frontend")
+	orgOpts := testIntermediateCaOptions(caDir, "org")
+	orgOpts.PathLen = 1
+	orgOpts.NameConstraints = NameConstraints{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"internal.example.com"},
+		PermittedIPRanges:   []string{"10.0.0.0/8"},
+	}
+	org := CreateIntermediateCa(orgOpts)
+	orgCert, err := readCert(org.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgCert.PermittedDNSDomains) != 1 || len(orgCert.ExcludedDNSDomains) != 1 || len(orgCert.PermittedIPRanges) != 1 || !orgCert.PermittedDNSDomainsCritical {
+		t.Errorf("org ca has the constraints %v %v %v, want them critical", orgCert.PermittedDNSDomains, orgCert.ExcludedDNSDomains, orgCert.PermittedIPRanges)
+	}
+	// The constraints of org apply to a child without constraints of its own
+	teamOpts := testIntermediateCaOptions(caDir, "team")
+	teamOpts.Parent = "org"
+	team := CreateIntermediateCa(teamOpts)
+
+	tests := []struct {
+		name     string
+		altNames []string
+		allowed  bool
+	}{
+		{"permitted domain", []string{"app.example.com"}, true},
+		{"permitted ip", []string{"app.example.com", "10.1.2.3"}, true},
+		{"other domain", []string{"app.other.com"}, false},
+		{"excluded domain", []string{"db.internal.example.com"}, false},
+		{"other ip", []string{"app.example.com", "192.168.1.1"}, false},
+	}
+	for _, test := range tests {
+		for _, ca := range []IntermediateCA{org, team} {
+			_, err := IssueAppCrt(CreateAppCrtOptions{
+				IntermediateCACrt: ca.IntermediateCACrt,
+				IntermediateCAKey: ca.IntermediateCAKey,
+				RootCACrt:         rootCACrt,
+				AltNames:          test.altNames,
+			})
+			if (err == nil) != test.allowed {
+				t.Errorf("%s under %s = %v, want allowed %v", test.name, ca.IntermediateCACrt, err, test.allowed)
+			}
+		}
+	}
+}
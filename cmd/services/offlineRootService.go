@@ -0,0 +1,147 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type SignIntermediateCSROptions struct {
+	// RootCACnf is the root ca cnf file
+	RootCACnf string
+	// IntermediateCACsr is the csr file created by CreateIntermediateCsr
+	IntermediateCACsr string
+	// IntermediateCACrt is the output file for the signed intermediate ca crt
+	IntermediateCACrt string
+	// SignatureAlgorithm is the signature algorithm of the intermediate ca crt
+	SignatureAlgorithm string
+	// PathLen is the number of intermediate cas that may follow the
+	// intermediate ca, 0 lets it sign only leaf certs and -1 sets no limit
+	PathLen int
+}
+
+// OpenRootCa returns the crt, cnf and key files of an existing root ca like
+// CreateRootCa, but fails instead of creating a new root ca when its crt or
+// key is missing, e.g. when the removable disk is not mounted.
+func OpenRootCa(opts CreateRootCAOptions) (string, string, string) {
+	rootCaDir := opts.ConfigDirectory + "/rootCA"
+	for _, name := range []string{"rootCA.crt", "rootCA.key"} {
+		if _, err := os.Stat(rootCaDir + "/" + name); err != nil {
+			log.Fatal("Root CA not found, check the root dir: ", err)
+		}
+	}
+	return CreateRootCa(opts)
+}
+
+// SignIntermediateCsr signs an intermediate ca csr with the root ca. It is
+// meant to be run where the root ca key is kept, e.g. an air-gapped machine.
+func SignIntermediateCsr(opts SignIntermediateCSROptions) {
+	csrPEM, err := os.ReadFile(opts.IntermediateCACsr)
+	if err != nil {
+		log.Fatal("Error while reading Intermediate CA Csr: ", err)
+	}
+	csrBlock, _ := pem.Decode(csrPEM)
+	if csrBlock == nil {
+		log.Fatal("Error while decoding Intermediate CA Csr: ", opts.IntermediateCACsr)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		log.Fatal("Error while parsing Intermediate CA Csr: ", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		log.Fatal("Intermediate CA Csr signature is invalid: ", err)
+	}
+
+	if _, err := os.Stat(opts.IntermediateCACrt); err == nil {
+		log.Fatal("Intermediate CA Crt already exists, refusing to overwrite: ", opts.IntermediateCACrt)
+	}
+
+	err = signIntermediateCsr(opts.RootCACnf, opts.IntermediateCACsr, opts.IntermediateCACrt, opts.PathLen, opts.SignatureAlgorithm)
+	if err != nil {
+		log.Fatal("Error while signing Intermediate CA Csr: ", err)
+	}
+
+	log.Info("Intermediate CA Csr signed successfully.")
+	log.Info("Subject: ", csr.Subject.String())
+	log.Info("Intermediate CA Crt: ", opts.IntermediateCACrt)
+}
+
+type InstallIntermediateCAOptions struct {
+	// ConfigDirectory is the ca directory the intermediate ca is under
+	ConfigDirectory string
+	// IntermediateCAName is the name of the intermediate ca
+	IntermediateCAName string
+	// IntermediateCACrt is the signed intermediate ca crt file
+	IntermediateCACrt string
+	// RootCACrt is the root ca crt file that signed the intermediate ca.
+	// Optional when the root ca crt already exists in ConfigDirectory.
+	RootCACrt string
+}
+
+// InstallIntermediateCa finishes the setup of an intermediate ca created by
+// CreateIntermediateCsr once its csr has been signed by the root ca.
+func InstallIntermediateCa(opts InstallIntermediateCAOptions) IntermediateCA {
+	intermediateCaDir := opts.ConfigDirectory + "/" + opts.IntermediateCAName
+	intermediateCA := IntermediateCA{
+		IntermediateCACrt: intermediateCaDir + "/intermediateCA.crt",
+		IntermediateCACnf: intermediateCaDir + "/intermediateCA.cnf",
+		IntermediateCAKey: intermediateCaDir + "/intermediateCA.key",
+		IntermediateCACsr: intermediateCaDir + "/intermediateCA.csr",
+	}
+	if _, err := os.Stat(intermediateCA.IntermediateCACrt); err == nil {
+		log.Fatal("Intermediate CA Crt already exists, refusing to overwrite: ", intermediateCA.IntermediateCACrt)
+	}
+
+	intermediateCert, intermediateKey, err := readCertAndKey(opts.IntermediateCACrt, intermediateCA.IntermediateCAKey)
+	if err != nil {
+		log.Fatal("Error while reading Intermediate CA, please create its csr first: ", err)
+	}
+	if !intermediateCert.BasicConstraintsValid || !intermediateCert.IsCA {
+		log.Fatal("The signed certificate is not a CA certificate: ", opts.IntermediateCACrt)
+	}
+	if err := checkKeyMatchesCert(intermediateCert, intermediateKey); err != nil {
+		log.Fatal("The signed certificate doesn't belong to the Intermediate CA Csr: ", err)
+	}
+
+	// Install the root ca crt, the root ca key stays offline
+	rootCaDir := opts.ConfigDirectory + "/rootCA"
+	rootCaCrtFile := rootCaDir + "/rootCA.crt"
+	rootCert, err := readCert(rootCaCrtFile)
+	if opts.RootCACrt != "" {
+		givenRootCert, err := readCert(opts.RootCACrt)
+		if err != nil {
+			log.Fatal("Error while reading Root CA Crt: ", err)
+		}
+		if rootCert != nil && !bytes.Equal(rootCert.Raw, givenRootCert.Raw) {
+			log.Fatal("A different Root CA Crt already exists at ", rootCaCrtFile)
+		}
+		rootCert = givenRootCert
+	} else if err != nil {
+		log.Fatal("Root CA Crt not found, please provide it: ", err)
+	}
+	if err := intermediateCert.CheckSignatureFrom(rootCert); err != nil {
+		log.Fatal("The signed certificate is not signed by the Root CA: ", err)
+	}
+	if _, err := os.Stat(rootCaCrtFile); os.IsNotExist(err) {
+		if err := os.MkdirAll(rootCaDir, 0700); err != nil {
+			log.Fatal("Error while creating Root CA dir: ", err)
+		}
+		if err := writeCertPEM(rootCaCrtFile, rootCert); err != nil {
+			log.Fatal("Error while writing Root CA Crt: ", err)
+		}
+		log.Debug("Root CA Crt installed at ", rootCaCrtFile)
+	}
+
+	if err := writeCertPEM(intermediateCA.IntermediateCACrt, intermediateCert); err != nil {
+		log.Fatal("Error while writing Intermediate CA Crt: ", err)
+	}
+
+	log.Info("Intermediate CA installed successfully.")
+	log.Info("Intermediate CA name: ", opts.IntermediateCAName)
+	log.Info("Intermediate CA dir: ", filepath.Dir(intermediateCA.IntermediateCACrt))
+	return intermediateCA
+}
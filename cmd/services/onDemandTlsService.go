@@ -0,0 +1,172 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OnDemandTLSOptions struct {
+	// IntermediateCACrt is the crt file of the intermediate ca that signs the certs
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that signs the certs
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file clients trust
+	RootCACrt string
+	// HostPolicy refuses the names it returns an error for, every name is allowed when nil
+	HostPolicy func(name string) error
+	// Validity is the validity of the certs, 7 days when zero
+	Validity time.Duration
+}
+
+// OnDemandTLS mints a cert for every requested server name in its
+// GetCertificate callback. The certs are kept in memory and are not recorded
+// in the intermediate ca index.
+type OnDemandTLS struct {
+	opts      OnDemandTLSOptions
+	caCert    *x509.Certificate
+	caKey     interface{}
+	rootCerts *x509.CertPool
+	chain     [][]byte
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewOnDemandTLS loads the intermediate ca once for every cert it mints.
+func NewOnDemandTLS(opts OnDemandTLSOptions) (*OnDemandTLS, error) {
+	caCert, caKey, err := loadCACertAndKey(opts.IntermediateCACrt, opts.IntermediateCAKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading CA certificate and key: %v", err)
+	}
+	rootPEM, err := os.ReadFile(opts.RootCACrt)
+	if err != nil {
+		return nil, fmt.Errorf("error reading root CA certificate: %v", err)
+	}
+	rootCerts := x509.NewCertPool()
+	if !rootCerts.AppendCertsFromPEM(rootPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", opts.RootCACrt)
+	}
+
+	// Servers send the intermediate ca, the intermediate cas above it and,
+	// during a root ca rollover, the cross-signed roots after the leaf. The
+	// self-signed roots are left out, clients already trust one of them.
+	chainPEM, err := ChainPEM(opts.IntermediateCACrt, opts.RootCACrt)
+	if err != nil {
+		return nil, err
+	}
+	chainCerts, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for _, cert := range chainCerts {
+		if !isSelfSigned(cert) {
+			chain = append(chain, cert.Raw)
+		}
+	}
+
+	if opts.Validity == 0 {
+		opts.Validity = 7 * 24 * time.Hour
+	}
+	return &OnDemandTLS{
+		opts:      opts,
+		caCert:    caCert,
+		caKey:     caKey,
+		rootCerts: rootCerts,
+		chain:     chain,
+		certs:     map[string]*tls.Certificate{},
+	}, nil
+}
+
+// ServerTLSConfig returns a tls.Config that mints a cert for every server name.
+func (o *OnDemandTLS) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: o.GetCertificate,
+	}
+}
+
+// ClientTLSConfig returns a tls.Config that trusts the root ca.
+func (o *OnDemandTLS) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    o.rootCerts,
+	}
+}
+
+// RootCAs returns a pool with the root ca.
+func (o *OnDemandTLS) RootCAs() *x509.CertPool {
+	return o.rootCerts
+}
+
+// GetCertificate returns the cert of the requested server name, minting it
+// on the first request. Clients without SNI get a cert for the ip address
+// they connected to.
+func (o *OnDemandTLS) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" && hello.Conn != nil {
+		if address, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = address.IP.String()
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no server name to mint a certificate for")
+	}
+	return o.Certificate(name)
+}
+
+// Certificate returns the cert of name, minting it if it isn't cached or
+// expires within a day.
+func (o *OnDemandTLS) Certificate(name string) (*tls.Certificate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if cert, ok := o.certs[name]; ok && time.Until(cert.Leaf.NotAfter) > 24*time.Hour {
+		return cert, nil
+	}
+	if o.opts.HostPolicy != nil {
+		if err := o.opts.HostPolicy(name); err != nil {
+			return nil, err
+		}
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating private key: %v", err)
+	}
+	template := x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(o.opts.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	leaf, err := createLeafCrt(&template, &privateKey.PublicKey, o.caCert, o.caKey, o.opts.IntermediateCACrt, o.opts.RootCACrt)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: append([][]byte{leaf.Raw}, o.chain...),
+		PrivateKey:  privateKey,
+		Leaf:        leaf,
+	}
+	o.certs[name] = cert
+	return cert, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnDemandTLSChainDuringRollover(t *testing.T) {
+	configDir := t.TempDir()
+	caDir := configDir + "/lab"
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	oldRootCert, err := readCert(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RolloverRootCa(RolloverRootCAOptions{RootCA: CreateRootCAOptions{
+		ConfigDirectory:     caDir,
+		RootCAName:          "lab",
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+	}})
+	newRootCert, err := readCert(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rootFile := range []string{rootCACrt, caDir + "/rootCA/trust-bundle.crt"} {
+		t.Run(filepath.Base(rootFile), func(t *testing.T) {
+			onDemand, err := NewOnDemandTLS(OnDemandTLSOptions{
+				IntermediateCACrt: intermediateCA.IntermediateCACrt,
+				IntermediateCAKey: intermediateCA.IntermediateCAKey,
+				RootCACrt:         rootFile,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsCert, err := onDemand.Certificate("app.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The intermediate ca and both cross-signed roots follow the leaf
+			if len(tlsCert.Certificate) != 4 {
+				t.Errorf("chain has %d certs, want the leaf, the intermediate ca and 2 cross-signed roots", len(tlsCert.Certificate))
+			}
+			intermediates := x509.NewCertPool()
+			for _, der := range tlsCert.Certificate[1:] {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isSelfSigned(cert) {
+					t.Errorf("chain contains the self-signed %s", cert.Subject.CommonName)
+				}
+				intermediates.AddCert(cert)
+			}
+
+			// Clients that trust either root ca validate the cert
+			for name, root := range map[string]*x509.Certificate{"old root ca": oldRootCert, "new root ca": newRootCert} {
+				roots := x509.NewCertPool()
+				roots.AddCert(root)
+				if _, err := tlsCert.Leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "app.example.com"}); err != nil {
+					t.Errorf("cert doesn't validate with the %s: %v", name, err)
+				}
+			}
+		})
+	}
+}
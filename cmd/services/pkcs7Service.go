@@ -0,0 +1,569 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+var (
+	oidPKCS7Data          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidPKCS7EnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Content is the [0] EXPLICIT tagged content
+	Content asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// pkcs7Attribute is an authenticated attribute, Values is the SET of values
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type pkcs7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []pkcs7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  pkcs7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// pkcs7Signed is a parsed and verified SignedData
+type pkcs7Signed struct {
+	// ContentType is the type of the signed content
+	ContentType asn1.ObjectIdentifier
+	// Content is the signed content, the detached content when the SignedData
+	// has none
+	Content []byte
+	// Certs are the certs carried by the SignedData
+	Certs []*x509.Certificate
+	// Signer is the cert of the signer
+	Signer *x509.Certificate
+	// Attributes are the first values of the authenticated attributes by oid
+	Attributes map[string]asn1.RawValue
+}
+
+// encodeCertsOnlyPKCS7 returns a degenerate PKCS#7 SignedData without
+// signers, the certs-only format of EST, SCEP and .p7b files.
+func encodeCertsOnlyPKCS7(certs []*x509.Certificate) ([]byte, error) {
+	return marshalPKCS7SignedData(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     pkcs7CertificatesValue(certs),
+		SignerInfos:      []pkcs7SignerInfo{},
+	})
+}
+
+// parsePKCS7Certs returns the certs of a SignedData, e.g. of a certs-only
+// .p7b file. Signatures are not verified.
+func parsePKCS7Certs(der []byte) ([]*x509.Certificate, error) {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, fmt.Errorf("error parsing PKCS#7: %v", err)
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content is not SignedData")
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, fmt.Errorf("error parsing SignedData: %v", err)
+	}
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SignedData certificates: %v", err)
+	}
+	return certs, nil
+}
+
+// signPKCS7 signs content with a single signer. The content type, message
+// digest and signing time attributes are added to attributes. A nil content
+// creates a SignedData without content.
+func signPKCS7(content []byte, signerCert *x509.Certificate, signerKey crypto.Signer, certs []*x509.Certificate, attributes ...pkcs7Attribute) ([]byte, error) {
+	return signPKCS7Content(content, pkcs7SignOptions{certs: append([]*x509.Certificate{signerCert}, certs...)}, signerCert, signerKey, attributes...)
+}
+
+// signDetachedPKCS7 signs content like signPKCS7, but leaves the content out
+// of the SignedData, the format of .p7s detached signatures.
+func signDetachedPKCS7(content []byte, signerCert *x509.Certificate, signerKey crypto.Signer, certs []*x509.Certificate, attributes ...pkcs7Attribute) ([]byte, error) {
+	return signPKCS7Content(content, pkcs7SignOptions{detached: true, certs: append([]*x509.Certificate{signerCert}, certs...)}, signerCert, signerKey, attributes...)
+}
+
+type pkcs7SignOptions struct {
+	// contentType is the type of the content, data when empty
+	contentType asn1.ObjectIdentifier
+	// detached leaves the content out of the SignedData
+	detached bool
+	// certs are the certs carried by the SignedData, none when empty
+	certs []*x509.Certificate
+}
+
+func signPKCS7Content(content []byte, opts pkcs7SignOptions, signerCert *x509.Certificate, signerKey crypto.Signer, attributes ...pkcs7Attribute) ([]byte, error) {
+	eContentType := opts.contentType
+	if eContentType == nil {
+		eContentType = oidPKCS7Data
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	messageDigest, err := newPKCS7Attribute(oidAttributeMessageDigest, digest.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := newPKCS7Attribute(oidAttributeContentType, eContentType)
+	if err != nil {
+		return nil, err
+	}
+	signingTime, err := newPKCS7Attribute(oidAttributeSigningTime, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	attributes = append(attributes, contentType, messageDigest, signingTime)
+
+	// The signature covers the DER SET OF the attributes, which is sorted
+	var encodedAttributes [][]byte
+	for _, attribute := range attributes {
+		encodedAttribute, err := asn1.Marshal(attribute)
+		if err != nil {
+			return nil, err
+		}
+		encodedAttributes = append(encodedAttributes, encodedAttribute)
+	}
+	sort.Slice(encodedAttributes, func(i, j int) bool {
+		return bytes.Compare(encodedAttributes[i], encodedAttributes[j]) < 0
+	})
+	attributesSet, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encodedAttributes, nil)})
+	if err != nil {
+		return nil, err
+	}
+	attributesDigest := crypto.SHA256.New()
+	attributesDigest.Write(attributesSet)
+	signature, err := signerKey.Sign(rand.Reader, attributesDigest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch signerKey.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported signer key type %T", signerKey.Public())
+	}
+
+	contentInfo := pkcs7ContentInfo{ContentType: eContentType}
+	if content != nil && !opts.detached {
+		contentOctets, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		contentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: contentOctets}
+	}
+
+	// Content other than data needs a CMS version 3 SignedData
+	version := 1
+	if !eContentType.Equal(oidPKCS7Data) {
+		version = 3
+	}
+	var certificates asn1.RawValue
+	if len(opts.certs) > 0 {
+		certificates = pkcs7CertificatesValue(opts.certs)
+	}
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	return marshalPKCS7SignedData(pkcs7SignedData{
+		Version:          version,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      contentInfo,
+		Certificates:     certificates,
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: signerCert.RawIssuer}, SerialNumber: signerCert.SerialNumber},
+			DigestAlgorithm:           sha256Algorithm,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bytes.Join(encodedAttributes, nil)},
+			DigestEncryptionAlgorithm: signatureAlgorithm,
+			EncryptedDigest:           signature,
+		}},
+	})
+}
+
+// parsePKCS7Signed parses a SignedData with a single signer and verifies the
+// signature over its authenticated attributes and content.
+func parsePKCS7Signed(der []byte) (*pkcs7Signed, error) {
+	return parseDetachedPKCS7Signed(der, nil)
+}
+
+// parseDetachedPKCS7Signed parses a SignedData like parsePKCS7Signed and
+// verifies it over content when the SignedData has no content of its own.
+func parseDetachedPKCS7Signed(der []byte, content []byte) (*pkcs7Signed, error) {
+	return parsePKCS7SignedWithCerts(der, content, nil)
+}
+
+// parsePKCS7SignedWithCerts parses a SignedData like parseDetachedPKCS7Signed
+// and also looks for the signer cert in certs, for SignedData without certs.
+func parsePKCS7SignedWithCerts(der []byte, content []byte, certs []*x509.Certificate) (*pkcs7Signed, error) {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, fmt.Errorf("error parsing PKCS#7: %v", err)
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content is not SignedData")
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, fmt.Errorf("error parsing SignedData: %v", err)
+	}
+
+	signed := &pkcs7Signed{ContentType: signedData.ContentInfo.ContentType, Content: content, Attributes: map[string]asn1.RawValue{}}
+	if len(signedData.ContentInfo.Content.Bytes) > 0 {
+		content, err := unmarshalOctetString(signedData.ContentInfo.Content.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SignedData content: %v", err)
+		}
+		signed.Content = content
+	}
+	if len(signedData.Certificates.Bytes) > 0 {
+		certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SignedData certificates: %v", err)
+		}
+		signed.Certs = certs
+	}
+	if len(signedData.SignerInfos) != 1 {
+		return signed, fmt.Errorf("expected one signer, found %d", len(signedData.SignerInfos))
+	}
+	signerInfo := signedData.SignerInfos[0]
+	for _, cert := range append(signed.Certs, certs...) {
+		if signed.Signer == nil && bytes.Equal(cert.RawIssuer, signerInfo.IssuerAndSerialNumber.Issuer.FullBytes) && cert.SerialNumber.Cmp(signerInfo.IssuerAndSerialNumber.SerialNumber) == 0 {
+			signed.Signer = cert
+		}
+	}
+	if signed.Signer == nil {
+		return signed, fmt.Errorf("signer certificate not found")
+	}
+
+	hash, err := pkcs7Hash(signerInfo.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return signed, err
+	}
+	contentDigest := hash.New()
+	contentDigest.Write(signed.Content)
+	signedBytes := signed.Content
+
+	if len(signerInfo.AuthenticatedAttributes.Bytes) > 0 {
+		rest := signerInfo.AuthenticatedAttributes.Bytes
+		for len(rest) > 0 {
+			var attribute pkcs7Attribute
+			rest, err = asn1.Unmarshal(rest, &attribute)
+			if err != nil {
+				return signed, fmt.Errorf("error parsing authenticated attributes: %v", err)
+			}
+			var value asn1.RawValue
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &value); err != nil {
+				return signed, fmt.Errorf("error parsing authenticated attribute %s: %v", attribute.Type, err)
+			}
+			signed.Attributes[attribute.Type.String()] = value
+		}
+		var messageDigest []byte
+		if _, err := asn1.Unmarshal(signed.Attributes[oidAttributeMessageDigest.String()].FullBytes, &messageDigest); err != nil {
+			return signed, fmt.Errorf("missing message digest attribute")
+		}
+		if !bytes.Equal(messageDigest, contentDigest.Sum(nil)) {
+			return signed, fmt.Errorf("message digest doesn't match the content")
+		}
+		// The signature covers the attributes with the SET OF tag instead of [0]
+		signedBytes = append([]byte{0x31}, signerInfo.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	signatureDigest := hash.New()
+	signatureDigest.Write(signedBytes)
+	switch publicKey := signed.Signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(publicKey, hash, signatureDigest.Sum(nil), signerInfo.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, signatureDigest.Sum(nil), signerInfo.EncryptedDigest) {
+			err = errors.New("ecdsa verification failure")
+		}
+	default:
+		err = fmt.Errorf("unsupported signer key type %T", publicKey)
+	}
+	if err != nil {
+		return signed, fmt.Errorf("invalid signature: %v", err)
+	}
+	return signed, nil
+}
+
+// encryptPKCS7 encrypts content for recipient, whose key has to be an rsa key.
+func encryptPKCS7(content []byte, recipient *x509.Certificate, contentEncryptionAlgorithm asn1.ObjectIdentifier) ([]byte, error) {
+	recipientKey, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("recipient key is not an rsa key")
+	}
+	block, keySize, err := pkcs7Cipher(contentEncryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	contentCipher, err := block(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, contentCipher.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding, always at least one byte
+	padding := contentCipher.BlockSize() - len(content)%contentCipher.BlockSize()
+	encryptedContent := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(contentCipher, iv).CryptBlocks(encryptedContent, encryptedContent)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, recipientKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ivParameter, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	envelopedData, err := asn1.Marshal(pkcs7EnvelopedData{
+		Version: 0,
+		RecipientInfos: []pkcs7RecipientInfo{{
+			Version:                0,
+			IssuerAndSerialNumber:  pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer}, SerialNumber: recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: pkcs7EncryptedContentInfo{
+			ContentType:                oidPKCS7Data,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: contentEncryptionAlgorithm, Parameters: asn1.RawValue{FullBytes: ivParameter}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encryptedContent},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7EnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: envelopedData},
+	})
+}
+
+var errPKCS7Decryption = errors.New("error decrypting PKCS#7 content")
+
+// decryptPKCS7 decrypts an EnvelopedData with the rsa key of a recipient. It
+// also returns the content encryption algorithm to answer with.
+func decryptPKCS7(der []byte, recipientKey *rsa.PrivateKey) ([]byte, asn1.ObjectIdentifier, error) {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, nil, fmt.Errorf("error parsing PKCS#7: %v", err)
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7EnvelopedData) {
+		return nil, nil, fmt.Errorf("PKCS#7 content is not EnvelopedData")
+	}
+	var envelopedData pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &envelopedData); err != nil {
+		return nil, nil, fmt.Errorf("error parsing EnvelopedData: %v", err)
+	}
+
+	// Every decryption failure returns the same error, so a client can't tell
+	// a wrong key from a wrong padding
+	var key []byte
+	for _, recipientInfo := range envelopedData.RecipientInfos {
+		decryptedKey, err := rsa.DecryptPKCS1v15(rand.Reader, recipientKey, recipientInfo.EncryptedKey)
+		if err == nil {
+			key = decryptedKey
+			break
+		}
+	}
+	if key == nil {
+		return nil, nil, errPKCS7Decryption
+	}
+
+	encryptedContentInfo := envelopedData.EncryptedContentInfo
+	algorithm := encryptedContentInfo.ContentEncryptionAlgorithm.Algorithm
+	block, _, err := pkcs7Cipher(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentCipher, err := block(key)
+	if err != nil {
+		return nil, nil, errPKCS7Decryption
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(encryptedContentInfo.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != contentCipher.BlockSize() {
+		return nil, nil, fmt.Errorf("invalid content encryption iv")
+	}
+
+	// Some clients send the encrypted content as constructed octet string
+	encryptedContent := encryptedContentInfo.EncryptedContent.Bytes
+	if encryptedContentInfo.EncryptedContent.IsCompound {
+		if encryptedContent, err = unmarshalOctetString(encryptedContent); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(encryptedContent) == 0 || len(encryptedContent)%contentCipher.BlockSize() != 0 {
+		return nil, nil, errPKCS7Decryption
+	}
+	content := make([]byte, len(encryptedContent))
+	cipher.NewCBCDecrypter(contentCipher, iv).CryptBlocks(content, encryptedContent)
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > contentCipher.BlockSize() || !bytes.Equal(content[len(content)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, nil, errPKCS7Decryption
+	}
+	return content[:len(content)-padding], algorithm, nil
+}
+
+func newPKCS7Attribute(attributeType asn1.ObjectIdentifier, value interface{}) (pkcs7Attribute, error) {
+	encodedValue, err := asn1.Marshal(value)
+	if err != nil {
+		return pkcs7Attribute{}, err
+	}
+	return pkcs7Attribute{
+		Type:   attributeType,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: encodedValue},
+	}, nil
+}
+
+func marshalPKCS7SignedData(signedData pkcs7SignedData) ([]byte, error) {
+	signedDataDER, err := asn1.Marshal(signedData)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedDataDER},
+	})
+}
+
+func pkcs7CertificatesValue(certs []*x509.Certificate) asn1.RawValue {
+	var certsDER []byte
+	for _, cert := range certs {
+		certsDER = append(certsDER, cert.Raw...)
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certsDER}
+}
+
+// unmarshalOctetString reads an octet string, joining the segments of a
+// constructed one.
+func unmarshalOctetString(der []byte) ([]byte, error) {
+	var octets []byte
+	for len(der) > 0 {
+		var value asn1.RawValue
+		rest, err := asn1.Unmarshal(der, &value)
+		if err != nil {
+			return nil, err
+		}
+		if value.IsCompound {
+			segments, err := unmarshalOctetString(value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			octets = append(octets, segments...)
+		} else {
+			octets = append(octets, value.Bytes...)
+		}
+		der = rest
+	}
+	return octets, nil
+}
+
+func pkcs7Hash(algorithm asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case algorithm.Equal(oidSHA1), algorithm.Equal(oidSHA1WithRSA):
+		return crypto.SHA1, nil
+	case algorithm.Equal(oidSHA256), algorithm.Equal(oidSHA256WithRSA):
+		return crypto.SHA256, nil
+	case algorithm.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case algorithm.Equal(oidSHA512), algorithm.Equal(oidSHA512WithRSA):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", algorithm)
+}
+
+func pkcs7Cipher(algorithm asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case algorithm.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	case algorithm.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case algorithm.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported content encryption algorithm %s", algorithm)
+}
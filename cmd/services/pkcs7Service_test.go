@@ -0,0 +1,69 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestDecryptPKCS7(t *testing.T) {
+	recipientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "scep client"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &recipientKey.PublicKey, recipientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A block of content is followed by a whole block of padding
+	content := []byte("0123456789abcdef")
+	envelope, err := encryptPKCS7(content, recipient, oidAES128CBC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encrypted content ends the envelope, flipping a byte of the first
+	// block flips the same byte of the padding block
+	brokenPadding := bytes.Clone(envelope)
+	brokenPadding[len(brokenPadding)-32] ^= 1
+	brokenLastByte := bytes.Clone(envelope)
+	brokenLastByte[len(brokenLastByte)-17] ^= 0x30
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		key      *rsa.PrivateKey
+		err      error
+	}{
+		{"decrypted", envelope, recipientKey, nil},
+		{"other recipient", envelope, otherKey, errPKCS7Decryption},
+		{"padding byte", brokenPadding, recipientKey, errPKCS7Decryption},
+		{"padding length", brokenLastByte, recipientKey, errPKCS7Decryption},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, algorithm, err := decryptPKCS7(test.envelope, test.key)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("decryptPKCS7() = %v, want %v", err, test.err)
+			}
+			if err == nil && (!bytes.Equal(decrypted, content) || !algorithm.Equal(oidAES128CBC)) {
+				t.Errorf("decrypted %q with %v, want %q with aes-128-cbc", decrypted, algorithm, content)
+			}
+		})
+	}
+}
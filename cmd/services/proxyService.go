@@ -0,0 +1,127 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ProxyOptions struct {
+	// Listen is the address the proxy listens on, e.g. :443
+	Listen string
+	// Routes maps host names to backend urls. A leading *. matches every
+	// subdomain of the name
+	Routes map[string]*url.URL
+	// IntermediateCACrt is the crt file of the intermediate ca that signs the certs
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that signs the certs
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file
+	RootCACrt string
+}
+
+type proxyServer struct {
+	routes  map[string]*url.URL
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// ServeProxy terminates tls for the routed host names with certs minted on
+// demand and forwards the requests to the backends until the server fails.
+func ServeProxy(opts ProxyOptions) {
+	server := &proxyServer{
+		routes:  map[string]*url.URL{},
+		proxies: map[string]*httputil.ReverseProxy{},
+	}
+	for host, backend := range opts.Routes {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		server.routes[host] = backend
+		server.proxies[host] = newReverseProxy(backend)
+		log.Info("Routing https://", host, " to ", backend)
+	}
+
+	onDemand, err := NewOnDemandTLS(OnDemandTLSOptions{
+		IntermediateCACrt: opts.IntermediateCACrt,
+		IntermediateCAKey: opts.IntermediateCAKey,
+		RootCACrt:         opts.RootCACrt,
+		HostPolicy:        server.hostPolicy,
+	})
+	if err != nil {
+		log.Fatal("Error while loading CA: ", err)
+	}
+
+	// The tls config has no NextProtos, so http.Server adds h2 and serves
+	// HTTP/2 next to HTTP/1.1
+	httpServer := &http.Server{
+		Addr:              opts.Listen,
+		Handler:           server,
+		TLSConfig:         onDemand.ServerTLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving proxy on ", opts.Listen)
+	log.Fatal(httpServer.ListenAndServeTLS("", ""))
+}
+
+// newReverseProxy forwards to backend. Upgrade requests like WebSockets are
+// tunneled by httputil.ReverseProxy.
+func newReverseProxy(backend *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(backend)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Warn("Error while proxying ", r.Host, r.URL.Path, " to ", backend, ": ", err)
+			http.Error(w, "backend unavailable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// route returns the route of host, exact routes win over wildcard routes.
+func (s *proxyServer) route(host string) (string, bool) {
+	if _, ok := s.routes[host]; ok {
+		return host, true
+	}
+	for dot := strings.Index(host, "."); dot != -1; dot = strings.Index(host, ".") {
+		host = host[dot+1:]
+		if _, ok := s.routes["*."+host]; ok {
+			return "*." + host, true
+		}
+	}
+	return "", false
+}
+
+// hostPolicy only mints certs for the routed host names.
+func (s *proxyServer) hostPolicy(name string) error {
+	if _, ok := s.route(name); !ok {
+		return fmt.Errorf("no route for %s", name)
+	}
+	return nil
+}
+
+// ServeHTTP routes by the tls server name, so the backend matches the cert
+// the client verified. Clients without SNI are routed by the Host header.
+func (s *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := ""
+	if r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	if host == "" {
+		host = r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostname
+		}
+	}
+	route, ok := s.route(strings.ToLower(strings.TrimSuffix(host, ".")))
+	if !ok {
+		http.Error(w, "no route for "+host, http.StatusNotFound)
+		return
+	}
+	log.Debug(r.Method, " https://", r.Host, r.URL.RequestURI(), " -> ", s.routes[route])
+	s.proxies[route].ServeHTTP(w, r)
+}
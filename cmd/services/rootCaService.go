@@ -10,6 +10,8 @@ import (
 	"html/template"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -32,6 +34,12 @@ type CreateRootCAOptions struct {
 	EmailAddress string
 	// BasicConstraints
 	BasicConstraints string
+	// Policy is the openssl ca policy section used when signing intermediates.
+	// Defaults to policy_strict.
+	Policy string
+	// SignatureAlgorithm is the signature algorithm of the root ca crt, see
+	// SignatureAlgorithms. Its hash is also the default_md of the cnf
+	SignatureAlgorithm string
 }
 
 func CreateRootCa(opts CreateRootCAOptions) (string, string, string) {
@@ -48,28 +56,16 @@ func CreateRootCa(opts CreateRootCAOptions) (string, string, string) {
 		log.Debug("Root CA dir already exists, skipping.")
 	}
 
-	// Create rootCA key
+	// Create rootCA key. A root ca whose crt exists without a key is kept
+	// offline, so no new key is generated for it.
 	rootCaKeyFile := rootCaDir + "/rootCA.key"
-	if _, err := os.Stat(rootCaKeyFile); os.IsNotExist(err) {
+	rootCaCrtFile := rootCaDir + "/rootCA.crt"
+	_, crtErr := os.Stat(rootCaCrtFile)
+	if _, err := os.Stat(rootCaKeyFile); os.IsNotExist(err) && os.IsNotExist(crtErr) {
 		log.Debug("Root CA Key is being created.")
-		caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
-		if err != nil {
-			log.Error(err)
-		}
-		// Encode the private key to PEM format
-		privKeyBytes := x509.MarshalPKCS1PrivateKey(caPrivKey)
-		privKeyPEM := &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: privKeyBytes,
-		}
-		file, err := os.Create(rootCaKeyFile)
+		err := generateRootCaKey(rootCaKeyFile)
 		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		err = pem.Encode(file, privKeyPEM)
-		if err != nil {
-			panic(err)
+			log.Fatal("Error while creating Root CA Key: ", err)
 		}
 		log.Debug("Root CA Key generated at ", rootCaKeyFile)
 	} else {
@@ -91,31 +87,27 @@ func CreateRootCa(opts CreateRootCAOptions) (string, string, string) {
 		log.Debug("Root CA Cnf generated at ", rootCaCnfFile)
 	} else {
 		log.Debug("Root CA Cnf already exists, skipping.")
+		// The root ca dir may live on a removable disk mounted at another path
+		err := relocateRootCnf(rootCaCnfFile, rootCaDir)
+		if err != nil {
+			log.Fatal("Error while updating Root CA Cnf dir: ", err)
+		}
 	}
 
 	// Create default CA root CA crt file
-	rootCaCrtFile := rootCaDir + "/rootCA.crt"
 	if _, err := os.Stat(rootCaCrtFile); os.IsNotExist(err) {
 		log.Debug("Root CA Crt being created.")
 		crtSubject := "/C=" + opts.CountryName + "/ST=" + opts.StateOrProvinceName + "/L=" + opts.LocalityName + "/O=Crtforge/OU=" + opts.RootCAName + "/CN=Crtforge Root CA/emailAddress=" + opts.EmailAddress
-		createRootCaCrtCmd := exec.Command(
-			"openssl", "req",
-			"-config", rootCaCnfFile,
-			"-key", rootCaKeyFile,
-			"-new", "-x509",
-			"-days", "7305",
-			"-sha256", "-extensions",
-			"v3_ca",
-			"-subj", crtSubject,
-			"-out", rootCaCrtFile)
-		createRootCaCrtCmd.Dir = rootCaDir
-		err = createRootCaCrtCmd.Run()
+		err := createRootCaCrt(rootCaCnfFile, rootCaKeyFile, crtSubject, rootCaCrtFile, opts.SignatureAlgorithm)
 		if err != nil {
 			log.Fatal("Error while creating Root CA Crt: ", err)
 		}
 		log.Debug("Root CA Crt generated at ", rootCaKeyFile)
 	} else {
 		log.Debug("Root CA Crt already exists, skipping.")
+		if opts.SignatureAlgorithm != "" {
+			log.Warn("Root CA already exists, its signature algorithm is not changed.")
+		}
 	}
 
 	// Create necessary files & folders
@@ -163,6 +155,71 @@ func CreateRootCa(opts CreateRootCAOptions) (string, string, string) {
 	return rootCaCrtFile, rootCaCnfFile, rootCaKeyFile
 }
 
+func generateRootCaKey(rootCaKeyFile string) error {
+	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+	// Encode the private key to PEM format
+	privKeyBytes := x509.MarshalPKCS1PrivateKey(caPrivKey)
+	privKeyPEM := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: privKeyBytes,
+	}
+	file, err := os.OpenFile(rootCaKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pem.Encode(file, privKeyPEM)
+}
+
+func createRootCaCrt(rootCaCnfFile, rootCaKeyFile, crtSubject, rootCaCrtFile, signatureAlgorithm string) error {
+	rootCaKey, err := readPrivateKey(rootCaKeyFile)
+	if err != nil {
+		return err
+	}
+	if err := checkSignatureAlgorithm(signatureAlgorithm, rootCaKey.Public()); err != nil {
+		return err
+	}
+	args := []string{
+		"req",
+		"-config", rootCaCnfFile,
+		"-key", rootCaKeyFile,
+		"-new", "-x509",
+		"-days", "7305",
+		"-" + opensslSignatureDigest(signatureAlgorithm), "-extensions",
+		"v3_ca",
+		"-subj", crtSubject,
+		"-out", rootCaCrtFile}
+	createRootCaCrtCmd := exec.Command("openssl", append(args, opensslSignatureOpts(signatureAlgorithm)...)...)
+	createRootCaCrtCmd.Dir = filepath.Dir(rootCaCrtFile)
+	return createRootCaCrtCmd.Run()
+}
+
+// relocateRootCnf points the dir setting of the cnf file to rootCaDir when the
+// root ca dir was moved since the cnf was generated.
+func relocateRootCnf(rootCaCnfFile string, rootCaDir string) error {
+	rootCaCnf, err := os.ReadFile(rootCaCnfFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(rootCaCnf), "\n")
+	for i, line := range lines {
+		key, value, found := strings.Cut(line, "=")
+		if !found || strings.TrimSpace(key) != "dir" {
+			continue
+		}
+		if strings.TrimSpace(value) == rootCaDir {
+			return nil
+		}
+		log.Debug("Root CA dir moved, updating the cnf dir to ", rootCaDir)
+		lines[i] = key + "= " + rootCaDir
+		return os.WriteFile(rootCaCnfFile, []byte(strings.Join(lines, "\n")), os.ModePerm)
+	}
+	return nil
+}
+
 func prepareRootCnf(rootCaDir string, opts CreateRootCAOptions) ([]byte, error) {
 	tmpl, err := template.New("rootCaCnf").Parse(string(rootCaCnfTmpl))
 	if err != nil {
@@ -175,6 +232,11 @@ func prepareRootCnf(rootCaDir string, opts CreateRootCAOptions) ([]byte, error)
 	vars["localityName"] = opts.LocalityName
 	vars["emailAddress"] = opts.EmailAddress
 	vars["basicConstr"] = opts.BasicConstraints
+	vars["defaultMd"] = opensslSignatureDigest(opts.SignatureAlgorithm)
+	vars["policy"] = "policy_strict"
+	if opts.Policy != "" {
+		vars["policy"] = opts.Policy
+	}
 
 	var output bytes.Buffer
 	if err := tmpl.Execute(&output, vars); err != nil {
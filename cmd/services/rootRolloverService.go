@@ -0,0 +1,309 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RolloverRootCAOptions struct {
+	// RootCA holds the options the root ca was created with
+	RootCA CreateRootCAOptions
+}
+
+// RolloverRootCa replaces the root ca with a new one and cross-signs the new
+// and the old root ca with each other. The cross-signed certs are written to
+// rootCA/transition.crt, which createFullchainCert appends to every fullchain
+// so clients that trust either root ca keep validating.
+func RolloverRootCa(opts RolloverRootCAOptions) {
+	rootCaDir := opts.RootCA.ConfigDirectory + "/rootCA"
+	rootCaCrtFile := rootCaDir + "/rootCA.crt"
+	rootCaKeyFile := rootCaDir + "/rootCA.key"
+	transitionFile := rootCaDir + "/transition.crt"
+	trustBundleFile := rootCaDir + "/trust-bundle.crt"
+	// A second rollover would replace the transition certs the first one handed out
+	if _, err := os.Stat(transitionFile); err == nil {
+		log.Fatal("A Root CA rollover is in progress, end it with crtforge root rollover finish first.")
+	}
+
+	oldRootCert, oldRootKey, err := readCertAndKey(rootCaCrtFile, rootCaKeyFile)
+	if err != nil {
+		log.Fatal("Error while reading the Root CA to roll over: ", err)
+	}
+	// The old root ca cross-signs the new one
+	if err := checkSignatureAlgorithm(opts.RootCA.SignatureAlgorithm, oldRootKey.Public()); err != nil {
+		log.Fatal("Error while checking the signature algorithm: ", err)
+	}
+
+	// Archive the old root ca, the index and serial are shared with the new one
+	archiveRootDir := rootCaDir + "/archive"
+	archives, _ := os.ReadDir(archiveRootDir)
+	generation := len(archives) + 2
+	archiveDir := archiveRootDir + "/" + time.Now().Format("20060102150405")
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		log.Fatal("Error while creating Root CA archive dir: ", err)
+	}
+	var archived []string
+	for _, name := range rootCaStateFiles {
+		if err := os.Rename(rootCaDir+"/"+name, archiveDir+"/"+name); err != nil {
+			restoreRootCa(rootCaDir, archiveDir, archived)
+			log.Fatal("Error while archiving Root CA: ", err)
+		}
+		archived = append(archived, name)
+	}
+	log.Info("Old Root CA archived at ", archiveDir)
+
+	newRootCert, err := createRolloverRootCa(opts, rootCaDir, archiveDir, generation, oldRootCert, oldRootKey)
+	if err != nil {
+		// Put the old root ca back, otherwise the next run creates an unrelated root ca
+		restoreRootCa(rootCaDir, archiveDir, archived)
+		log.Fatal(err, ". The old Root CA is restored.")
+	}
+
+	log.Info("Root CA rolled over successfully.")
+	log.Info("New Root CA: ", newRootCert.Subject.CommonName)
+	log.Info("Cross-signed transition certs: ", transitionFile)
+	log.Info("Old and new Root CA trust bundle: ", trustBundleFile)
+	log.Info("Rotate the intermediate cas that are still signed by the old Root CA, see crtforge root status.")
+}
+
+// rootCaStateFiles are the files of a root ca that are replaced by a rollover
+var rootCaStateFiles = []string{"rootCA.key", "rootCA.crt"}
+
+// createRolloverRootCa creates the new root ca in rootCaDir, cross-signs it
+// with the old root ca in archiveDir and writes the transition certs.
+func createRolloverRootCa(opts RolloverRootCAOptions, rootCaDir, archiveDir string, generation int, oldRootCert *x509.Certificate, oldRootKey crypto.Signer) (*x509.Certificate, error) {
+	rootCaCrtFile := rootCaDir + "/rootCA.crt"
+	rootCaKeyFile := rootCaDir + "/rootCA.key"
+
+	// Create the new root ca with a distinct name so clients can tell them apart
+	if err := generateRootCaKey(rootCaKeyFile); err != nil {
+		return nil, fmt.Errorf("Error while creating Root CA Key: %v", err)
+	}
+	crtSubject := "/C=" + opts.RootCA.CountryName + "/ST=" + opts.RootCA.StateOrProvinceName + "/L=" + opts.RootCA.LocalityName + "/O=Crtforge/OU=" + opts.RootCA.RootCAName + "/CN=Crtforge Root CA G" + fmt.Sprint(generation) + "/emailAddress=" + opts.RootCA.EmailAddress
+	if err := createRootCaCrt(rootCaDir+"/rootCA.cnf", rootCaKeyFile, crtSubject, rootCaCrtFile, opts.RootCA.SignatureAlgorithm); err != nil {
+		return nil, fmt.Errorf("Error while creating Root CA Crt: %v", err)
+	}
+	newRootCert, newRootKey, err := readCertAndKey(rootCaCrtFile, rootCaKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading the new Root CA: %v", err)
+	}
+
+	// Cross-sign the roots with each other
+	newByOld, err := crossSignCert(newRootCert, oldRootCert, oldRootKey, opts.RootCA.SignatureAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("Error while cross-signing the new Root CA: %v", err)
+	}
+	oldByNew, err := crossSignCert(oldRootCert, newRootCert, newRootKey, opts.RootCA.SignatureAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("Error while cross-signing the old Root CA: %v", err)
+	}
+	if err := writeCertPEM(archiveDir+"/newRootCrossSigned.crt", newByOld); err != nil {
+		return nil, fmt.Errorf("Error while writing cross-signed Root CA Crt: %v", err)
+	}
+	if err := writeCertPEM(archiveDir+"/oldRootCrossSigned.crt", oldByNew); err != nil {
+		return nil, fmt.Errorf("Error while writing cross-signed Root CA Crt: %v", err)
+	}
+
+	// Transition bundles
+	if err := writeCertsPEM(rootCaDir+"/transition.crt", newByOld, oldByNew); err != nil {
+		return nil, fmt.Errorf("Error while writing transition bundle: %v", err)
+	}
+	if err := writeCertsPEM(rootCaDir+"/trust-bundle.crt", newRootCert, oldRootCert); err != nil {
+		return nil, fmt.Errorf("Error while writing trust bundle: %v", err)
+	}
+	return newRootCert, nil
+}
+
+// restoreRootCa removes the files of a failed rollover and moves the archived
+// root ca back.
+func restoreRootCa(rootCaDir, archiveDir string, archived []string) {
+	for _, name := range append(rootCaStateFiles, "transition.crt", "trust-bundle.crt") {
+		if err := os.Remove(rootCaDir + "/" + name); err != nil && !os.IsNotExist(err) {
+			log.Error("Error while removing ", name, " of the failed rollover: ", err)
+		}
+	}
+	for _, name := range archived {
+		if err := os.Rename(archiveDir+"/"+name, rootCaDir+"/"+name); err != nil {
+			log.Error("Error while restoring ", name, " from ", archiveDir, ": ", err)
+			return
+		}
+	}
+	os.RemoveAll(archiveDir)
+}
+
+type FinishRootRolloverOptions struct {
+	// ConfigDirectory is the ca directory of the root ca
+	ConfigDirectory string
+	// Force ends the transition although intermediate cas are still signed by
+	// an old root ca
+	Force bool
+}
+
+// FinishRootRollover ends a root ca rollover by removing the transition certs
+// and the trust bundle, so fullchains only lead to the new root ca again. The
+// cross-signed certs stay in the archive of the old root ca.
+func FinishRootRollover(opts FinishRootRolloverOptions) {
+	rootCaDir := opts.ConfigDirectory + "/rootCA"
+	transitionFile := rootCaDir + "/transition.crt"
+	trustBundleFile := rootCaDir + "/trust-bundle.crt"
+	if _, err := os.Stat(transitionFile); os.IsNotExist(err) {
+		log.Fatal("No Root CA rollover in progress, ", transitionFile, " not found.")
+	}
+
+	// Intermediate cas under the old root ca only validate through the transition certs
+	oldRootCount := 0
+	for _, status := range RootCaStatus(opts.ConfigDirectory) {
+		if !status.Current {
+			oldRootCount++
+			log.Warn(status.Name, " is not signed by the current Root CA.")
+		}
+	}
+	if oldRootCount > 0 && !opts.Force {
+		log.Fatal("Rotate the intermediate cas with crtforge intermediate rotate first, or use --force.")
+	}
+
+	for _, file := range []string{transitionFile, trustBundleFile} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Fatal("Error while ending the Root CA rollover: ", err)
+		}
+	}
+	log.Info("Root CA rollover finished, new fullchains no longer contain the transition certs.")
+}
+
+// crossSignCert issues a copy of cert, keeping its subject and key, signed by issuer.
+func crossSignCert(cert *x509.Certificate, issuer *x509.Certificate, issuerKey crypto.Signer, signatureAlgorithm string) (*x509.Certificate, error) {
+	algorithm, err := x509SignatureAlgorithm(signatureAlgorithm, issuerKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := cert.NotAfter
+	if issuer.NotAfter.Before(notAfter) {
+		notAfter = issuer.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		RawSubject:            cert.RawSubject,
+		SubjectKeyId:          cert.SubjectKeyId,
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		KeyUsage:              cert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            cert.MaxPathLen,
+		MaxPathLenZero:        cert.MaxPathLenZero,
+		SignatureAlgorithm:    algorithm,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, issuer, cert.PublicKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(derBytes)
+}
+
+func writeCertsPEM(certFile string, certs ...*x509.Certificate) error {
+	var certsPEM []byte
+	for _, cert := range certs {
+		certsPEM = append(certsPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return os.WriteFile(certFile, certsPEM, 0644)
+}
+
+func parseCertsPEM(certsPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certsPEM = pem.Decode(certsPEM)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+type IntermediateCAStatus struct {
+	// Name is the name of the intermediate ca
+	Name string
+	// Issuer is the common name of the root ca that signed the intermediate ca
+	// or the topmost intermediate ca above it
+	Issuer string
+	// Parent is the name of the intermediate ca that signed the intermediate
+	// ca, empty when the root ca signed it. Current is false when the parent
+	// was rotated since.
+	Parent string
+	// Current is true when the intermediate ca is signed by the current root ca
+	Current bool
+	// ArchivedRoot is the archive dir of the old root ca that signed the intermediate ca
+	ArchivedRoot string
+}
+
+// RootCaStatus reports which root ca signed each intermediate ca under caDir.
+func RootCaStatus(caDir string) []IntermediateCAStatus {
+	rootCaDir := caDir + "/rootCA"
+	rootCert, err := readCert(rootCaDir + "/rootCA.crt")
+	if err != nil {
+		log.Fatal("Error while reading Root CA: ", err)
+	}
+
+	archivedRoots := map[string]*x509.Certificate{}
+	archives, _ := os.ReadDir(rootCaDir + "/archive")
+	for _, archive := range archives {
+		archiveDir := rootCaDir + "/archive/" + archive.Name()
+		archivedRoot, err := readCert(archiveDir + "/rootCA.crt")
+		if err == nil {
+			archivedRoots[archiveDir] = archivedRoot
+		}
+	}
+
+	entries, err := os.ReadDir(caDir)
+	if err != nil {
+		log.Fatal("Error while reading CA dir: ", err)
+	}
+	var statuses []IntermediateCAStatus
+	for _, entry := range entries {
+		intermediateCert, err := readCert(caDir + "/" + entry.Name() + "/intermediateCA.crt")
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		// Intermediate cas signed by other intermediate cas are under the
+		// root ca of the topmost one
+		parents := parentIntermediateCas(caDir, intermediateCert)
+		parent := issuingIntermediateCaName(caDir, intermediateCert)
+		if len(parents) > 0 {
+			intermediateCert = parents[len(parents)-1].Cert
+		}
+		status := IntermediateCAStatus{
+			Name:    entry.Name(),
+			Issuer:  intermediateCert.Issuer.CommonName,
+			Parent:  parent,
+			Current: intermediateCert.CheckSignatureFrom(rootCert) == nil,
+		}
+		for archiveDir, archivedRoot := range archivedRoots {
+			if !status.Current && intermediateCert.CheckSignatureFrom(archivedRoot) == nil {
+				status.ArchivedRoot = archiveDir
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
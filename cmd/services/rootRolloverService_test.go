@@ -0,0 +1,114 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+func TestRolloverRootCa(t *testing.T) {
+	configDir := t.TempDir()
+	caDir := configDir + "/lab"
+	rootCaDir := caDir + "/rootCA"
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "frontend")
+	rolloverOpts := RolloverRootCAOptions{RootCA: CreateRootCAOptions{
+		ConfigDirectory:     caDir,
+		RootCAName:          "lab",
+		CountryName:         "TR",
+		StateOrProvinceName: "Istanbul",
+		LocalityName:        "Istanbul",
+		EmailAddress:        "test@example.com",
+	}}
+	oldRootCrt, err := os.ReadFile(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRootKey, err := os.ReadFile(rootCaDir + "/rootCA.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed rollover puts the old root ca back
+	rootCaCnf, err := os.ReadFile(rootCaDir + "/rootCA.cnf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rootCaDir+"/rootCA.cnf", []byte("[ broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectFatal(t, func() { RolloverRootCa(rolloverOpts) })
+	for file, want := range map[string][]byte{"rootCA.crt": oldRootCrt, "rootCA.key": oldRootKey} {
+		got, err := os.ReadFile(rootCaDir + "/" + file)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s wasn't restored after the failed rollover: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(rootCaDir + "/transition.crt"); !os.IsNotExist(err) {
+		t.Error("transition.crt left behind by the failed rollover")
+	}
+	if archives, _ := os.ReadDir(rootCaDir + "/archive"); len(archives) != 0 {
+		t.Errorf("failed rollover left %d archives", len(archives))
+	}
+
+	if err := os.WriteFile(rootCaDir+"/rootCA.cnf", rootCaCnf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	RolloverRootCa(rolloverOpts)
+	newRootCert, err := readCert(rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newRootCert.Subject.CommonName != "Crtforge Root CA G2" {
+		t.Errorf("new root ca is %s, want Crtforge Root CA G2", newRootCert.Subject.CommonName)
+	}
+	transition, err := os.ReadFile(rootCaDir + "/transition.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaves of the intermediate ca under the old root ca validate with the new root ca
+	leaf, err := IssueAppCrt(CreateAppCrtOptions{
+		IntermediateCACrt: intermediateCA.IntermediateCACrt,
+		IntermediateCAKey: intermediateCA.IntermediateCAKey,
+		RootCACrt:         rootCACrt,
+		AltNames:          []string{"app.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainPEM, err := ChainPEM(intermediateCA.IntermediateCACrt, rootCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(newRootCert)
+	for _, cert := range chain {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("leaf doesn't validate with the new root ca: %v", err)
+	}
+
+	// A second rollover would replace the transition certs
+	expectFatal(t, func() { RolloverRootCa(rolloverOpts) })
+	if got, _ := os.ReadFile(rootCaDir + "/transition.crt"); !bytes.Equal(got, transition) {
+		t.Error("second rollover replaced the transition certs")
+	}
+
+	statuses := RootCaStatus(caDir)
+	if len(statuses) != 1 || statuses[0].Current {
+		t.Errorf("status = %+v, want frontend under the old root ca", statuses)
+	}
+	expectFatal(t, func() { FinishRootRollover(FinishRootRolloverOptions{ConfigDirectory: caDir}) })
+	FinishRootRollover(FinishRootRolloverOptions{ConfigDirectory: caDir, Force: true})
+	for _, file := range []string{"transition.crt", "trust-bundle.crt"} {
+		if _, err := os.Stat(rootCaDir + "/" + file); !os.IsNotExist(err) {
+			t.Errorf("%s is left after finishing the rollover", file)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	oidScepMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidScepPkiStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidScepFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidScepSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidScepRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidScepTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// SCEP message types and statuses, RFC 8894
+const (
+	scepCertRep    = "3"
+	scepRenewalReq = "17"
+	scepPKCSReq    = "19"
+
+	scepStatusSuccess = "0"
+	scepStatusFailure = "2"
+
+	scepFailBadAlg          = "0"
+	scepFailBadMessageCheck = "1"
+	scepFailBadRequest      = "2"
+)
+
+type ScepServerOptions struct {
+	// Listen is the address the scep server listens on, e.g. :8080
+	Listen string
+	// TLSCrt is the crt file of the scep server, plain http is served when empty
+	TLSCrt string
+	// TLSKey is the key file of the scep server
+	TLSKey string
+	// ChallengePasswords are the challenge passwords accepted in PKCSReq csrs
+	ChallengePasswords []string
+	// IntermediateCACrt is the crt file of the intermediate ca that signs the requests
+	IntermediateCACrt string
+	// IntermediateCAKey is the key file of the intermediate ca that signs the requests
+	IntermediateCAKey string
+	// RootCACrt is the root ca crt file
+	RootCACrt string
+}
+
+type scepServer struct {
+	opts   ScepServerOptions
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+}
+
+// scepRequest is a decoded PKIOperation message
+type scepRequest struct {
+	messageType   string
+	transactionID string
+	senderNonce   []byte
+	signer        *x509.Certificate
+	encryption    asn1.ObjectIdentifier
+	csr           *x509.CertificateRequest
+}
+
+// scepError is a request failure reported in a CertRep with a failInfo
+type scepError struct {
+	failInfo string
+	err      error
+}
+
+func (e *scepError) Error() string {
+	return e.err.Error()
+}
+
+// ServeScep serves the SCEP GetCACert, GetCACaps and PKIOperation operations
+// for an intermediate ca until the server fails. The intermediate ca key
+// decrypts the requests and signs the responses, so it has to be an rsa key.
+func ServeScep(opts ScepServerOptions) {
+	caCert, caKey, err := loadCACertAndKey(opts.IntermediateCACrt, opts.IntermediateCAKey)
+	if err != nil {
+		log.Fatal("Error loading CA certificate and key: ", err)
+	}
+	rsaKey, ok := caKey.(*rsa.PrivateKey)
+	if !ok {
+		log.Fatal("SCEP needs an Intermediate CA with an rsa key.")
+	}
+	server := &scepServer{opts: opts, caCert: caCert, caKey: rsaKey}
+
+	httpServer := &http.Server{
+		Addr:              opts.Listen,
+		Handler:           server.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving SCEP on ", opts.Listen, "/scep")
+	if opts.TLSCrt != "" {
+		log.Fatal(httpServer.ListenAndServeTLS(opts.TLSCrt, opts.TLSKey))
+	}
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+// routes returns the handler of the scep operations.
+func (s *scepServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scep", s.handle)
+	// The path of legacy clients that predate the /scep convention
+	mux.HandleFunc("/cgi-bin/pkiclient.exe", s.handle)
+	return mux
+}
+
+func (s *scepServer) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("operation") {
+	case "GetCACert":
+		s.getCACert(w)
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation\nRenewal\nSHA-1\nSHA-256\nSHA-512\nAES\nDES3\nSCEPStandard\n"))
+	case "PKIOperation":
+		s.pkiOperation(w, r)
+	default:
+		http.Error(w, "unsupported operation", http.StatusBadRequest)
+	}
+}
+
+func (s *scepServer) getCACert(w http.ResponseWriter) {
+	chainPEM, err := ChainPEM(s.opts.IntermediateCACrt, s.opts.RootCACrt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	certs, err := parseCertsPEM(chainPEM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The intermediate ca comes first, clients encrypt their requests for it
+	pkcs7DER, err := encodeCertsOnlyPKCS7(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	w.Write(pkcs7DER)
+}
+
+func (s *scepServer) pkiOperation(w http.ResponseWriter, r *http.Request) {
+	var message []byte
+	var err error
+	if r.Method == http.MethodPost {
+		message, err = io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	} else {
+		message, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+	}
+	if err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, err := s.decodeRequest(message)
+	if request == nil {
+		// Without a signer there is nobody to answer to
+		log.Warn("SCEP request rejected: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cert *x509.Certificate
+	if err == nil {
+		cert, err = s.issue(request)
+	}
+	var response []byte
+	if err != nil {
+		failInfo := scepFailBadRequest
+		var requestErr *scepError
+		if errors.As(err, &requestErr) {
+			failInfo = requestErr.failInfo
+		}
+		log.Warn("SCEP request ", request.transactionID, " failed: ", err)
+		response, err = s.certRep(request, nil, failInfo)
+	} else {
+		log.Info("SCEP issued ", cert.Subject.CommonName, " for transaction ", request.transactionID, ", serial ", serialHex(cert.SerialNumber))
+		response, err = s.certRep(request, cert, "")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pki-message")
+	w.Write(response)
+}
+
+// decodeRequest verifies and decrypts a PKIOperation message. The returned
+// request is nil when the message can't be answered at all.
+func (s *scepServer) decodeRequest(message []byte) (*scepRequest, error) {
+	signed, err := parsePKCS7Signed(message)
+	if signed == nil || signed.Signer == nil {
+		return nil, err
+	}
+	request := &scepRequest{signer: signed.Signer}
+	transactionID := signed.Attributes[oidScepTransactionID.String()]
+	messageType := signed.Attributes[oidScepMessageType.String()]
+	senderNonce := signed.Attributes[oidScepSenderNonce.String()]
+	if len(transactionID.Bytes) == 0 || len(messageType.Bytes) == 0 {
+		return nil, fmt.Errorf("missing transaction id or message type")
+	}
+	request.transactionID = string(transactionID.Bytes)
+	request.messageType = string(messageType.Bytes)
+	request.senderNonce = senderNonce.Bytes
+	if err != nil {
+		return request, &scepError{scepFailBadMessageCheck, err}
+	}
+
+	csrDER, encryption, err := decryptPKCS7(signed.Content, s.caKey)
+	if err != nil {
+		return request, &scepError{scepFailBadAlg, err}
+	}
+	request.encryption = encryption
+	request.csr, err = x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return request, &scepError{scepFailBadRequest, fmt.Errorf("error parsing csr: %v", err)}
+	}
+	return request, nil
+}
+
+// issue checks the challenge password of a PKCSReq or the current cert of a
+// RenewalReq and signs the csr.
+func (s *scepServer) issue(request *scepRequest) (*x509.Certificate, error) {
+	switch request.messageType {
+	case scepPKCSReq:
+		challengePassword, err := csrChallengePassword(request.csr)
+		if err != nil {
+			return nil, &scepError{scepFailBadRequest, err}
+		}
+		if !s.acceptsChallenge(challengePassword) {
+			return nil, &scepError{scepFailBadRequest, fmt.Errorf("wrong challenge password")}
+		}
+	case scepRenewalReq:
+		// The request is signed with the cert to renew
+		if err := s.checkRenewal(request); err != nil {
+			return nil, &scepError{scepFailBadRequest, err}
+		}
+	default:
+		return nil, &scepError{scepFailBadRequest, fmt.Errorf("unsupported message type %s", request.messageType)}
+	}
+
+	cert, err := signAppCsr(CreateAppCrtOptions{
+		IntermediateCACrt: s.opts.IntermediateCACrt,
+		IntermediateCAKey: s.opts.IntermediateCAKey,
+		RootCACrt:         s.opts.RootCACrt,
+		ExtKeyUsages:      []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, request.csr)
+	if err != nil {
+		return nil, &scepError{scepFailBadRequest, err}
+	}
+	return cert, nil
+}
+
+func (s *scepServer) acceptsChallenge(challengePassword string) bool {
+	for _, accepted := range s.opts.ChallengePasswords {
+		if subtle.ConstantTimeCompare([]byte(accepted), []byte(challengePassword)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scepServer) checkRenewal(request *scepRequest) error {
+	current := request.signer
+	if err := current.CheckSignatureFrom(s.caCert); err != nil {
+		return fmt.Errorf("renewal is not signed with a cert of this ca")
+	}
+	if time.Now().After(current.NotAfter) {
+		return fmt.Errorf("cert to renew has expired")
+	}
+	if current.Subject.String() != request.csr.Subject.String() {
+		return fmt.Errorf("renewal has to keep the subject of the current cert")
+	}
+	issuedCrts, err := ListIssuedCrts(filepath.Dir(s.opts.IntermediateCACrt))
+	if err != nil {
+		return err
+	}
+	for _, issuedCrt := range issuedCrts {
+		if issuedCrt.Serial == serialHex(current.SerialNumber) && issuedCrt.Revoked {
+			return fmt.Errorf("cert to renew is revoked")
+		}
+	}
+	return nil
+}
+
+// certRep signs a CertRep answering request. With a cert, the cert is
+// encrypted for the signer of the request, otherwise failInfo is reported.
+func (s *scepServer) certRep(request *scepRequest, cert *x509.Certificate, failInfo string) ([]byte, error) {
+	senderNonce := make([]byte, 16)
+	if _, err := rand.Read(senderNonce); err != nil {
+		return nil, err
+	}
+	attributes := []pkcs7Attribute{}
+	for _, value := range []struct {
+		attributeType asn1.ObjectIdentifier
+		value         interface{}
+	}{
+		{oidScepMessageType, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(scepCertRep)}},
+		{oidScepTransactionID, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(request.transactionID)}},
+		{oidScepSenderNonce, senderNonce},
+		{oidScepRecipientNonce, request.senderNonce},
+	} {
+		attribute, err := newPKCS7Attribute(value.attributeType, value.value)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, attribute)
+	}
+
+	var content []byte
+	status := scepStatusSuccess
+	if cert == nil {
+		status = scepStatusFailure
+		attribute, err := newPKCS7Attribute(oidScepFailInfo, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(failInfo)})
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, attribute)
+	} else {
+		certsOnly, err := encodeCertsOnlyPKCS7([]*x509.Certificate{cert})
+		if err != nil {
+			return nil, err
+		}
+		encryption := request.encryption
+		if encryption == nil {
+			encryption = oidAES128CBC
+		}
+		if content, err = encryptPKCS7(certsOnly, request.signer, encryption); err != nil {
+			return nil, err
+		}
+	}
+	statusAttribute, err := newPKCS7Attribute(oidScepPkiStatus, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(status)})
+	if err != nil {
+		return nil, err
+	}
+	attributes = append(attributes, statusAttribute)
+
+	return signPKCS7(content, s.caCert, s.caKey, nil, attributes...)
+}
+
+// csrChallengePassword returns the challenge password attribute of a csr,
+// which the x509 package doesn't expose.
+func csrChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []pkcs7Attribute `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", fmt.Errorf("error parsing csr attributes: %v", err)
+	}
+	for _, attribute := range tbs.RawAttributes {
+		if !attribute.Type.Equal(oidChallengePassword) {
+			continue
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(attribute.Values.Bytes, &value); err != nil {
+			return "", fmt.Errorf("error parsing challenge password: %v", err)
+		}
+		return string(value.Bytes), nil
+	}
+	return "", fmt.Errorf("csr has no challenge password")
+}
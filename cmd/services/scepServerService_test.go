@@ -0,0 +1,216 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScepServer(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "devices")
+	caCert, caKey, err := loadCACertAndKey(intermediateCA.IntermediateCACrt, intermediateCA.IntermediateCAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scep := &scepServer{
+		opts: ScepServerOptions{
+			ChallengePasswords: []string{"enroll-me"},
+			IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+			RootCACrt:          rootCACrt,
+		},
+		caCert: caCert,
+		caKey:  caKey.(*rsa.PrivateKey),
+	}
+	server := httptest.NewServer(scep.routes())
+	defer server.Close()
+
+	// Devices sign their first request with a self-signed cert
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSignedTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sensor.example.com"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	selfSignedDER, err := x509.CreateCertificate(rand.Reader, selfSignedTemplate, selfSignedTemplate, &deviceKey.PublicKey, deviceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := x509.ParseCertificate(selfSignedDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkiOperation := func(messageType, challengePassword string, signer *x509.Certificate, tamper bool) (*pkcs7Signed, *x509.Certificate) {
+		t.Helper()
+		csrDER := scepCsr(t, deviceKey, challengePassword)
+		envelope, err := encryptPKCS7(csrDER, caCert, oidAES128CBC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tamper {
+			envelope[len(envelope)-1] ^= 1
+		}
+		var attributes []pkcs7Attribute
+		for _, value := range []struct {
+			attributeType asn1.ObjectIdentifier
+			value         interface{}
+		}{
+			{oidScepMessageType, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(messageType)}},
+			{oidScepTransactionID, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte("transaction-1")}},
+			{oidScepSenderNonce, []byte("0123456789abcdef")},
+		} {
+			attribute, err := newPKCS7Attribute(value.attributeType, value.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attributes = append(attributes, attribute)
+		}
+		message, err := signPKCS7(envelope, signer, deviceKey, nil, attributes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := http.Post(server.URL+"/scep?operation=PKIOperation", "application/x-pki-message", bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", response.StatusCode, body)
+		}
+		certRep, err := parsePKCS7Signed(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !certRep.Signer.Equal(caCert) {
+			t.Errorf("CertRep is signed by %s, want the intermediate ca", certRep.Signer.Subject)
+		}
+		if string(certRep.Attributes[oidScepPkiStatus.String()].Bytes) != scepStatusSuccess {
+			return certRep, nil
+		}
+		certsOnly, _, err := decryptPKCS7(certRep.Content, deviceKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := parsePKCS7Certs(certsOnly)
+		if err != nil || len(certs) != 1 {
+			t.Fatalf("CertRep has %d certs: %v", len(certs), err)
+		}
+		return certRep, certs[0]
+	}
+
+	_, issued := pkiOperation(scepPKCSReq, "enroll-me", selfSigned, false)
+	if issued == nil {
+		t.Fatal("PKCSReq with the challenge password failed")
+	}
+	if issued.Subject.CommonName != "sensor.example.com" || !issuedBy(issued, caCert) {
+		t.Errorf("issued %s by %s, want sensor.example.com by the intermediate ca", issued.Subject.CommonName, issued.Issuer.CommonName)
+	}
+
+	tests := []struct {
+		name              string
+		messageType       string
+		challengePassword string
+		signer            *x509.Certificate
+		tamper            bool
+		failInfo          string
+	}{
+		{"wrong challenge password", scepPKCSReq, "guess", selfSigned, false, scepFailBadRequest},
+		{"no challenge password", scepPKCSReq, "", selfSigned, false, scepFailBadRequest},
+		{"broken envelope", scepPKCSReq, "enroll-me", selfSigned, true, scepFailBadAlg},
+		{"renewal", scepRenewalReq, "", issued, false, ""},
+		{"renewal with a self-signed cert", scepRenewalReq, "", selfSigned, false, scepFailBadRequest},
+		{"unsupported message type", "20", "", selfSigned, false, scepFailBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certRep, cert := pkiOperation(test.messageType, test.challengePassword, test.signer, test.tamper)
+			if test.failInfo == "" {
+				if cert == nil {
+					t.Errorf("request failed with failInfo %s", certRep.Attributes[oidScepFailInfo.String()].Bytes)
+				}
+				return
+			}
+			if cert != nil {
+				t.Fatal("request was issued")
+			}
+			if failInfo := string(certRep.Attributes[oidScepFailInfo.String()].Bytes); failInfo != test.failInfo {
+				t.Errorf("failInfo %s, want %s", failInfo, test.failInfo)
+			}
+		})
+	}
+
+	// A revoked cert can't be renewed
+	if _, err := RevokeCrt(configDir+"/lab/devices", serialHex(issued.SerialNumber)); err != nil {
+		t.Fatal(err)
+	}
+	if _, cert := pkiOperation(scepRenewalReq, "", issued, false); cert != nil {
+		t.Error("revoked cert was renewed")
+	}
+}
+
+// scepCsr returns a csr with a challenge password attribute, which x509
+// can't add, so the tbs of an x509 csr is extended and signed again.
+func scepCsr(t *testing.T, key *rsa.PrivateKey, challengePassword string) []byte {
+	t.Helper()
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "sensor.example.com"}, DNSNames: []string{"sensor.example.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challengePassword == "" {
+		return csrDER
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tbs struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []pkcs7Attribute `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		t.Fatal(err)
+	}
+	attribute, err := newPKCS7Attribute(oidChallengePassword, asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte(challengePassword)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs.RawAttributes = append(tbs.RawAttributes, attribute)
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbsDER)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err = asn1.Marshal(struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}{
+		TBS:                asn1.RawValue{FullBytes: tbsDER},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, Parameters: asn1.NullRawValue},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csrDER
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// SignatureAlgorithms are the signature algorithms of the root, intermediate
+// and leaf certs. The hash is used with the key of the issuer, rsa-pss needs
+// an rsa key. Ed25519 keys have a fixed algorithm, so none can be selected.
+var SignatureAlgorithms = []string{"sha256", "sha384", "sha512", "rsa-pss-sha256", "rsa-pss-sha384", "rsa-pss-sha512"}
+
+// defaultSignatureHash is the hash of the openssl path when none is selected
+const defaultSignatureHash = "sha256"
+
+// parseSignatureAlgorithm returns the hash of a signature algorithm and
+// whether it uses rsa-pss.
+func parseSignatureAlgorithm(name string) (string, bool, error) {
+	hash, pss := strings.CutPrefix(name, "rsa-pss-")
+	switch hash {
+	case "sha256", "sha384", "sha512":
+		return hash, pss, nil
+	}
+	return "", false, fmt.Errorf("unknown signature algorithm %s, use one of: %s", name, strings.Join(SignatureAlgorithms, ", "))
+}
+
+// hashSize is the size in bytes of the hashes of the signature algorithms
+var hashSize = map[string]int{"sha256": 32, "sha384": 48, "sha512": 64}
+
+// checkSignatureAlgorithm rejects signature algorithms the key of the issuer
+// can't sign with. An empty name is the default of the key.
+func checkSignatureAlgorithm(name string, publicKey crypto.PublicKey) error {
+	if name == "" {
+		return nil
+	}
+	hash, pss, err := parseSignatureAlgorithm(name)
+	if err != nil {
+		return err
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		// rsa-pss salts are as long as the hash
+		if pss && key.Size() < 2*hashSize[hash]+2 {
+			return fmt.Errorf("%d bit rsa key is too small for %s", key.N.BitLen(), name)
+		}
+	case *ecdsa.PublicKey:
+		if pss {
+			return fmt.Errorf("%s needs an rsa key, the key is ecdsa %s", name, key.Curve.Params().Name)
+		}
+		// A hash weaker than the curve weakens the signature, sha512 is the
+		// strongest hash and fits p-521
+		minHashBits := min(key.Curve.Params().BitSize, 512)
+		if hashSize[hash]*8 < minHashBits {
+			return fmt.Errorf("%s is weaker than the ecdsa %s key, use a hash of at least %d bits", name, key.Curve.Params().Name, minHashBits)
+		}
+	case ed25519.PublicKey:
+		return fmt.Errorf("ed25519 keys have a fixed signature algorithm, %s can't be used", name)
+	default:
+		return fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	return nil
+}
+
+// x509SignatureAlgorithm returns the signature algorithm of x509 templates
+// signed by the key. An empty name leaves the choice to x509.CreateCertificate.
+func x509SignatureAlgorithm(name string, publicKey crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	if err := checkSignatureAlgorithm(name, publicKey); err != nil || name == "" {
+		return x509.UnknownSignatureAlgorithm, err
+	}
+	hash, pss, _ := parseSignatureAlgorithm(name)
+	if _, ok := publicKey.(*ecdsa.PublicKey); ok {
+		return map[string]x509.SignatureAlgorithm{
+			"sha256": x509.ECDSAWithSHA256,
+			"sha384": x509.ECDSAWithSHA384,
+			"sha512": x509.ECDSAWithSHA512,
+		}[hash], nil
+	}
+	if pss {
+		return map[string]x509.SignatureAlgorithm{
+			"sha256": x509.SHA256WithRSAPSS,
+			"sha384": x509.SHA384WithRSAPSS,
+			"sha512": x509.SHA512WithRSAPSS,
+		}[hash], nil
+	}
+	return map[string]x509.SignatureAlgorithm{
+		"sha256": x509.SHA256WithRSA,
+		"sha384": x509.SHA384WithRSA,
+		"sha512": x509.SHA512WithRSA,
+	}[hash], nil
+}
+
+// signatureAlgorithmName returns the name of the signature algorithm of a
+// cert, empty for algorithms that can't be selected like ed25519.
+func signatureAlgorithmName(algorithm x509.SignatureAlgorithm) string {
+	switch algorithm {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		return "sha256"
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		return "sha384"
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		return "sha512"
+	case x509.SHA256WithRSAPSS:
+		return "rsa-pss-sha256"
+	case x509.SHA384WithRSAPSS:
+		return "rsa-pss-sha384"
+	case x509.SHA512WithRSAPSS:
+		return "rsa-pss-sha512"
+	}
+	return ""
+}
+
+// opensslSignatureDigest returns the openssl digest of a signature
+// algorithm, sha256 when none is selected.
+func opensslSignatureDigest(name string) string {
+	if hash, _, err := parseSignatureAlgorithm(name); err == nil {
+		return hash
+	}
+	return defaultSignatureHash
+}
+
+// opensslSignatureOpts returns the -sigopt arguments of a signature
+// algorithm. The rsa-pss salt is as long as the hash, like x509 uses.
+func opensslSignatureOpts(name string) []string {
+	if _, pss, err := parseSignatureAlgorithm(name); err != nil || !pss {
+		return nil
+	}
+	return []string{"-sigopt", "rsa_padding_mode:pss", "-sigopt", "rsa_pss_saltlen:digest"}
+}
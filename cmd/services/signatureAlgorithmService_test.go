@@ -0,0 +1,59 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestCheckSignatureAlgorithm(t *testing.T) {
+	keys := map[string]crypto.PublicKey{}
+	for name, curve := range map[string]elliptic.Curve{"p256": elliptic.P256(), "p384": elliptic.P384(), "p521": elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key.Public()
+	}
+	for name, bits := range map[string]int{"rsa1024": 1024, "rsa2048": 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key.Public()
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["ed25519"] = edKey
+
+	tests := []struct {
+		algorithm string
+		key       string
+		valid     bool
+	}{
+		{"", "ed25519", true},
+		{"sha256", "rsa2048", true},
+		{"rsa-pss-sha512", "rsa2048", true},
+		{"rsa-pss-sha512", "rsa1024", false},
+		{"md5", "rsa2048", false},
+		{"sha256", "p256", true},
+		{"rsa-pss-sha256", "p256", false},
+		{"sha256", "p384", false},
+		{"sha384", "p384", true},
+		{"sha512", "p384", true},
+		{"sha384", "p521", false},
+		{"sha512", "p521", true},
+		{"sha256", "ed25519", false},
+	}
+	for _, test := range tests {
+		if err := checkSignatureAlgorithm(test.algorithm, keys[test.key]); (err == nil) != test.valid {
+			t.Errorf("checkSignatureAlgorithm(%q, %s) = %v, want valid %v", test.algorithm, test.key, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package services
+
+import (
+	"crypto/x509"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type CreateSmimeCrtOptions struct {
+	// Email is the email address the cert protects
+	Email string
+	// Name is the common name of the cert, the email address when empty
+	Name string
+	// AppCrt are the options of the cert. The names and usages are set for
+	// email protection and a p12 file is always created
+	AppCrt CreateAppCrtOptions
+}
+
+// CreateSmimeCrt issues an S/MIME cert for signing and encrypting mail, and
+// writes it with its chain to a password protected p12 file for mail clients.
+func CreateSmimeCrt(opts CreateSmimeCrtOptions) {
+	appCrtOpts := opts.AppCrt
+	appCrtOpts.Subject.CommonName = opts.Name
+	if appCrtOpts.Subject.CommonName == "" {
+		appCrtOpts.Subject.CommonName = opts.Email
+	}
+	appCrtOpts.AltNames = []string{"email:" + opts.Email}
+	appCrtOpts.ExtKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	appCrtOpts.P12 = true
+	if appCrtOpts.AppName == "" {
+		appCrtOpts.AppName = opts.Email
+	}
+	CreateAppCrt(appCrtOpts)
+	log.Info("Import ", appCrtOpts.AppName, ".pfx into the mail client of ", opts.Email)
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// The extensions ssh-keygen adds to user certs by default
+var defaultSshUserExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+type CreateSshCAOptions struct {
+	// ConfigDirectory is the directory of the root ca the ssh cas belong to
+	ConfigDirectory string
+	// KeyType is the key type of the ssh cas: ed25519, ecdsa or rsa
+	KeyType string
+	// HostPattern is the known_hosts pattern of the hosts the host ca signs
+	HostPattern string
+}
+
+type SignSshKeyOptions struct {
+	// ConfigDirectory is the directory of the root ca the ssh cas belong to
+	ConfigDirectory string
+	// PublicKey is the public key file to sign
+	PublicKey string
+	// Output is the cert file, <key>-cert.pub when empty
+	Output string
+	// Host signs a host cert instead of a user cert
+	Host bool
+	// Identity is the key id of the cert, logged by sshd on authentication
+	Identity string
+	// Principals are the user names or host names the cert is valid for
+	Principals []string
+	// Validity is how long the cert is valid
+	Validity time.Duration
+	// CriticalOptions are the critical options of a user cert, e.g. force-command=/bin/true
+	CriticalOptions []string
+	// Extensions are the extensions of a user cert, the ssh-keygen defaults when nil
+	Extensions []string
+}
+
+// SshCaFiles returns the user and host ca key files of the root ca in configDirectory.
+func SshCaFiles(configDirectory string) (string, string) {
+	sshCaDir := configDirectory + "/sshCA"
+	return sshCaDir + "/user_ca", sshCaDir + "/host_ca"
+}
+
+// CreateSshCa creates the user and host ssh cas next to the root ca if they
+// don't exist, and logs the lines to trust them.
+func CreateSshCa(opts CreateSshCAOptions) {
+	userCaFile, hostCaFile := SshCaFiles(opts.ConfigDirectory)
+	if err := os.MkdirAll(opts.ConfigDirectory+"/sshCA", 0700); err != nil {
+		log.Fatal("Error while creating SSH CA dir: ", err)
+	}
+	for _, caFile := range []string{userCaFile, hostCaFile} {
+		if _, err := os.Stat(caFile); err == nil {
+			log.Debug("SSH CA already exists, skipping: ", caFile)
+			continue
+		}
+		if err := generateSshCaKey(caFile, opts.KeyType); err != nil {
+			log.Fatal("Error while creating SSH CA: ", err)
+		}
+		log.Info("SSH CA created at ", caFile)
+	}
+
+	userCaPub, err := os.ReadFile(userCaFile + ".pub")
+	if err != nil {
+		log.Fatal("Error while reading SSH user CA: ", err)
+	}
+	hostCaPub, err := os.ReadFile(hostCaFile + ".pub")
+	if err != nil {
+		log.Fatal("Error while reading SSH host CA: ", err)
+	}
+	log.Info("To trust the user certs, copy ", userCaFile+".pub", " to /etc/ssh/user_ca.pub on the servers and add to sshd_config:")
+	fmt.Println("TrustedUserCAKeys /etc/ssh/user_ca.pub")
+	log.Info("To trust the host certs, add to ~/.ssh/known_hosts on the clients:")
+	fmt.Println("@cert-authority " + opts.HostPattern + " " + strings.TrimSpace(string(hostCaPub)))
+	log.Debug("SSH user CA: ", strings.TrimSpace(string(userCaPub)))
+}
+
+func generateSshCaKey(caFile string, keyType string) error {
+	var privateKey crypto.Signer
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return fmt.Errorf("unknown key type %s, use ed25519, ecdsa or rsa", keyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	comment := "crtforge " + strings.TrimSuffix(caFile[strings.LastIndex(caFile, "/")+1:], "_ca") + " ca"
+	privateKeyBlock, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(privateKeyBlock), 0600); err != nil {
+		return err
+	}
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))) + " " + comment + "\n"
+	return os.WriteFile(caFile+".pub", []byte(authorizedKey), 0644)
+}
+
+// SignSshKey signs a public key with the user or host ssh ca and writes the cert.
+func SignSshKey(opts SignSshKeyOptions) string {
+	userCaFile, hostCaFile := SshCaFiles(opts.ConfigDirectory)
+	caFile := userCaFile
+	certType := uint32(ssh.UserCert)
+	if opts.Host {
+		caFile = hostCaFile
+		certType = ssh.HostCert
+	}
+	caKeyPEM, err := os.ReadFile(caFile)
+	if os.IsNotExist(err) {
+		log.Fatal("SSH CA not found, create it with crtforge ssh ca create: ", caFile)
+	}
+	if err != nil {
+		log.Fatal("Error while reading SSH CA: ", err)
+	}
+	caSigner, err := ssh.ParsePrivateKey(caKeyPEM)
+	if err != nil {
+		log.Fatal("Error while parsing SSH CA: ", err)
+	}
+
+	publicKeyData, err := os.ReadFile(opts.PublicKey)
+	if err != nil {
+		log.Fatal("Error while reading public key: ", err)
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(publicKeyData)
+	if err != nil {
+		log.Fatal("Error while parsing public key: ", err)
+	}
+	if len(opts.Principals) == 0 {
+		log.Fatal("At least one principal is required.")
+	}
+
+	var serialBytes [8]byte
+	if _, err := rand.Read(serialBytes[:]); err != nil {
+		log.Fatal("Error while generating serial: ", err)
+	}
+	identity := opts.Identity
+	if identity == "" {
+		identity = comment
+	}
+	if identity == "" {
+		identity = opts.Principals[0]
+	}
+
+	// Tolerate small clock skew between the ca and the servers
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          binary.BigEndian.Uint64(serialBytes[:]),
+		CertType:        certType,
+		KeyId:           identity,
+		ValidPrincipals: opts.Principals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(opts.Validity).Unix()),
+	}
+	if !opts.Host {
+		cert.Permissions = ssh.Permissions{
+			CriticalOptions: sshOptions(opts.CriticalOptions),
+			Extensions:      sshOptions(opts.Extensions),
+		}
+		if opts.Extensions == nil {
+			cert.Permissions.Extensions = sshOptions(defaultSshUserExtensions)
+		}
+	} else if len(opts.CriticalOptions) > 0 || len(opts.Extensions) > 0 {
+		log.Fatal("Host certs don't support critical options or extensions.")
+	}
+
+	// Sign with rsa-sha2-512 rather than the deprecated ssh-rsa
+	signer := caSigner
+	if algorithmSigner, ok := caSigner.(ssh.AlgorithmSigner); ok && caSigner.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signer, err = ssh.NewSignerWithAlgorithms(algorithmSigner, []string{ssh.KeyAlgoRSASHA512})
+		if err != nil {
+			log.Fatal("Error while preparing SSH CA signer: ", err)
+		}
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		log.Fatal("Error while signing SSH cert: ", err)
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = strings.TrimSuffix(opts.PublicKey, ".pub") + "-cert.pub"
+	}
+	if err := os.WriteFile(output, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		log.Fatal("Error while writing SSH cert: ", err)
+	}
+	log.Info("SSH cert created at ", output)
+	log.Info("Principals: ", opts.Principals, ", valid until ", now.Add(opts.Validity).Format(time.RFC3339))
+	return output
+}
+
+// sshOptions turns name=value or name entries into cert options.
+func sshOptions(entries []string) map[string]string {
+	options := map[string]string{}
+	for _, entry := range entries {
+		name, value, _ := strings.Cut(entry, "=")
+		options[name] = value
+	}
+	return options
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type CreateSvidOptions struct {
+	// SpiffeId is the spiffe id of the workload, e.g. spiffe://example.org/ns/foo/sa/bar
+	SpiffeId string
+	// AppCrt are the options of the svid. The subject, names and usages are
+	// set by the X.509-SVID rules
+	AppCrt CreateAppCrtOptions
+}
+
+type SvidBundleOptions struct {
+	// ConfigDirectory is the directory of the root ca that is the trust domain
+	ConfigDirectory string
+	// Output is the bundle file, stdout when empty
+	Output string
+}
+
+// svidBundle is a spiffe trust domain bundle in the jwks format
+type svidBundle struct {
+	Keys []svidJwk `json:"keys"`
+}
+
+type svidJwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+// CreateSvid issues an X.509-SVID: a leaf whose only name is the uri san of
+// the spiffe id, valid for server and client authentication.
+func CreateSvid(opts CreateSvidOptions) {
+	spiffeId, err := ParseSpiffeId(opts.SpiffeId)
+	if err != nil {
+		log.Fatal("Invalid spiffe id: ", err)
+	}
+	if spiffeId.Path == "" {
+		log.Fatal("Invalid spiffe id: an svid needs a workload path, e.g. spiffe://", spiffeId.Host, "/service")
+	}
+
+	appCrtOpts := opts.AppCrt
+	appCrtOpts.CommonName = ""
+	appCrtOpts.AltNames = []string{"uri:" + spiffeId.String()}
+	appCrtOpts.ExtKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if appCrtOpts.AppName == "" {
+		appCrtOpts.AppName = spiffeId.Host + strings.ReplaceAll(spiffeId.Path, "/", "-")
+	}
+	CreateAppCrt(appCrtOpts)
+	log.Info("SPIFFE ID: ", spiffeId.String())
+}
+
+// ParseSpiffeId parses a spiffe id and checks it against the spiffe id rules.
+func ParseSpiffeId(spiffeId string) (*url.URL, error) {
+	id, err := url.Parse(spiffeId)
+	if err != nil {
+		return nil, err
+	}
+	if id.Scheme != "spiffe" {
+		return nil, fmt.Errorf("scheme has to be spiffe")
+	}
+	if id.Host == "" {
+		return nil, fmt.Errorf("trust domain is missing")
+	}
+	if id.User != nil || id.Port() != "" {
+		return nil, fmt.Errorf("trust domain can't have a user or a port")
+	}
+	if id.RawQuery != "" || id.Fragment != "" || id.Opaque != "" {
+		return nil, fmt.Errorf("spiffe id can't have a query or a fragment")
+	}
+	for _, r := range id.Host {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return nil, fmt.Errorf("trust domain can only have lowercase letters, digits, dots, dashes and underscores")
+		}
+	}
+	if id.Path != "" {
+		for _, segment := range strings.Split(strings.TrimPrefix(id.Path, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return nil, fmt.Errorf("path can't have empty, . or .. segments")
+			}
+			for _, r := range segment {
+				if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+					return nil, fmt.Errorf("path can only have letters, digits, dots, dashes and underscores")
+				}
+			}
+		}
+	}
+	return id, nil
+}
+
+// ExportSvidBundle writes the trust domain bundle of a root ca in the spiffe
+// jwks format. The bundle has the root ca, the roots of a rollover and every
+// intermediate ca of the root ca.
+func ExportSvidBundle(opts SvidBundleOptions) {
+	rootCaCrt := opts.ConfigDirectory + "/rootCA/rootCA.crt"
+	// During a rollover the trust bundle has the old and the new root ca
+	if _, err := os.Stat(opts.ConfigDirectory + "/rootCA/trust-bundle.crt"); err == nil {
+		rootCaCrt = opts.ConfigDirectory + "/rootCA/trust-bundle.crt"
+	}
+	caCrts := []string{rootCaCrt}
+	entries, err := os.ReadDir(opts.ConfigDirectory)
+	if err != nil {
+		log.Fatal("Error while reading CA dir: ", err)
+	}
+	for _, entry := range entries {
+		intermediateCaCrt := opts.ConfigDirectory + "/" + entry.Name() + "/intermediateCA.crt"
+		if _, err := os.Stat(intermediateCaCrt); entry.IsDir() && err == nil {
+			caCrts = append(caCrts, intermediateCaCrt)
+		}
+	}
+
+	bundle := svidBundle{Keys: []svidJwk{}}
+	for _, caCrt := range caCrts {
+		certsPEM, err := os.ReadFile(caCrt)
+		if err != nil {
+			log.Fatal("Error while reading CA: ", err)
+		}
+		certs, err := parseCertsPEM(certsPEM)
+		if err != nil {
+			log.Fatal("Error while parsing CA ", caCrt, ": ", err)
+		}
+		for _, cert := range certs {
+			jwk, err := svidJwkOf(cert)
+			if err != nil {
+				log.Fatal("Error while encoding CA ", cert.Subject.String(), ": ", err)
+			}
+			bundle.Keys = append(bundle.Keys, jwk)
+		}
+	}
+
+	bundleJSON, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		log.Fatal("Error while encoding bundle: ", err)
+	}
+	bundleJSON = append(bundleJSON, '\n')
+	if opts.Output == "" {
+		os.Stdout.Write(bundleJSON)
+		return
+	}
+	if err := os.WriteFile(opts.Output, bundleJSON, 0644); err != nil {
+		log.Fatal("Error while writing bundle: ", err)
+	}
+	log.Info("SPIFFE bundle with ", len(bundle.Keys), " authorities written to ", opts.Output)
+}
+
+// svidJwkOf returns the x509-svid authority jwk of a ca cert.
+func svidJwkOf(cert *x509.Certificate) (svidJwk, error) {
+	jwk := svidJwk{
+		Use: "x509-svid",
+		X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch publicKey := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(publicKey.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = encode(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = encode(publicKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(publicKey)
+	default:
+		return jwk, fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+	return jwk, nil
+}
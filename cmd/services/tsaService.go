@@ -0,0 +1,508 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	oidTSTInfo                     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttributeSigningCertificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidAttributeSigningCertV2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidExtKeyUsage                 = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// PKIStatus values and PKIFailureInfo bits of RFC 3161
+const (
+	tsaStatusGranted         = 0
+	tsaStatusGrantedWithMods = 1
+	tsaStatusRejection       = 2
+
+	tsaFailBadAlg              = 0
+	tsaFailBadRequest          = 2
+	tsaFailBadDataFormat       = 5
+	tsaFailUnacceptedPolicy    = 15
+	tsaFailUnacceptedExtension = 16
+	tsaFailSystemFailure       = 25
+)
+
+const (
+	tsaMaxRequestSize = 64 * 1024
+	// tsaDefaultPolicy is the policy of the openssl example tsa config
+	tsaDefaultPolicy            = "1.2.3.4.1"
+	tsaTimestampQueryMediaType  = "application/timestamp-query"
+	tsaTimestampReplyMediaType  = "application/timestamp-reply"
+	tsaCrtRenewalBeforeNotAfter = 24 * time.Hour
+)
+
+type TsaServerOptions struct {
+	// Listen is the address the tsa listens on, e.g. :3161
+	Listen string
+	// TsaCrt is the crt file of the timestamping cert
+	TsaCrt string
+	// TsaKey is the key file of the timestamping cert
+	TsaKey string
+	// ChainCrt is a pem file with the intermediate ca certs sent with the
+	// tsa cert, e.g. the fullchain of the tsa cert. Root certs are left out
+	ChainCrt string
+	// Policy is the tsa policy oid of the tokens, 1.2.3.4.1 when empty
+	Policy string
+}
+
+type VerifyTimestampOptions struct {
+	// Token is a timestamp response or token file, DER or PEM encoded
+	Token string
+	// Data is the timestamped file, not checked when empty
+	Data string
+	// Digest is the hex digest of the timestamped data, not checked when empty
+	Digest string
+	// RootCACrt is the root ca crt file, or trust bundle, the tsa cert has to chain to
+	RootCACrt string
+	// TsaCrt is a pem file with the tsa cert and its intermediate ca, e.g. the
+	// fullchain of the tsa cert, for tokens requested without certs
+	TsaCrt string
+}
+
+// TimestampInfo is a verified timestamp
+type TimestampInfo struct {
+	// GenTime is the time the data was timestamped
+	GenTime time.Time
+	// SerialNumber is the serial of the token
+	SerialNumber *big.Int
+	// Policy is the tsa policy oid of the token
+	Policy string
+	// HashAlgorithm is the hash of the timestamped data
+	HashAlgorithm crypto.Hash
+	// HashedMessage is the digest of the timestamped data
+	HashedMessage []byte
+	// Tsa is the cert of the tsa that signed the token
+	Tsa *x509.Certificate
+}
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+type tsaStatusInfo struct {
+	Status int
+	// StatusString is the PKIFreeText SEQUENCE OF UTF8String
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type tsaResponse struct {
+	Status         tsaStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tsaTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       tsaAccuracy      `asn1:"optional"`
+	Ordering       bool             `asn1:"optional,default:false"`
+	Nonce          *big.Int         `asn1:"optional"`
+	Tsa            asn1.RawValue    `asn1:"optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+// essCertId is an ESSCertID or, with a hash algorithm other than sha256, an
+// ESSCertIDv2 of the signing certificate attributes
+type essCertId struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"`
+	CertHash      []byte
+	IssuerSerial  asn1.RawValue `asn1:"optional"`
+}
+
+type essSigningCertificate struct {
+	Certs    []essCertId
+	Policies asn1.RawValue `asn1:"optional"`
+}
+
+type tsaServer struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	chain  []*x509.Certificate
+	policy asn1.ObjectIdentifier
+}
+
+// EnsureTsaCrt returns the crt and key files of the timestamping cert in
+// opts.OutputDir, and issues a new one when it doesn't exist or is about to
+// expire. Tokens stay verifiable with the cert they were signed with.
+func EnsureTsaCrt(opts CreateAppCrtOptions) (string, string) {
+	appCrtDir := opts.OutputDir + "/" + opts.AppName
+	tsaCrt := appCrtDir + "/" + opts.AppName + ".crt"
+	tsaKey := appCrtDir + "/" + opts.AppName + ".key"
+	if cert, err := readCert(tsaCrt); err == nil && time.Until(cert.NotAfter) > tsaCrtRenewalBeforeNotAfter {
+		return tsaCrt, tsaKey
+	}
+	CreateTsaCrt(opts)
+	return tsaCrt, tsaKey
+}
+
+// CreateTsaCrt issues a cert that is only valid for timestamping, with the
+// critical extended key usage RFC 3161 requires.
+func CreateTsaCrt(opts CreateAppCrtOptions) {
+	opts.AltNames = nil
+	opts.ExtKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}
+	opts.CriticalExtKeyUsages = true
+	CreateAppCrt(opts)
+}
+
+// ServeTsa serves an RFC 3161 timestamping authority over http until the
+// server fails. Requests are posted as application/timestamp-query.
+func ServeTsa(opts TsaServerOptions) {
+	cert, key, err := readCertAndKey(opts.TsaCrt, opts.TsaKey)
+	if err != nil {
+		log.Fatal("Error while reading TSA cert: ", err)
+	}
+	if err := checkTsaCrt(cert); err != nil {
+		log.Fatal(err)
+	}
+	server := &tsaServer{cert: cert, key: key}
+	if opts.ChainCrt != "" {
+		chainPEM, err := os.ReadFile(opts.ChainCrt)
+		if err != nil {
+			log.Fatal("Error while reading chain: ", err)
+		}
+		certs, err := parseCertsPEM(chainPEM)
+		if err != nil {
+			log.Fatal("Error while parsing chain: ", err)
+		}
+		for _, chainCert := range certs {
+			if !chainCert.Equal(cert) && !isSelfSigned(chainCert) {
+				server.chain = append(server.chain, chainCert)
+			}
+		}
+	}
+	policy := opts.Policy
+	if policy == "" {
+		policy = tsaDefaultPolicy
+	}
+	server.policy, err = parseOid(policy)
+	if err != nil {
+		log.Fatal("Invalid TSA policy: ", err)
+	}
+
+	httpServer := &http.Server{
+		Addr:              opts.Listen,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info("Serving RFC 3161 TSA on ", opts.Listen)
+	log.Info("TSA cert: ", cert.Subject.String(), ", valid until ", cert.NotAfter.Format(time.RFC3339))
+	log.Info("TSA policy: ", server.policy.String())
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+func (s *tsaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "post an "+tsaTimestampQueryMediaType, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, tsaMaxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, err := asn1.Marshal(s.timestamp(body))
+	if err != nil {
+		log.Warn("Error while encoding timestamp response: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", tsaTimestampReplyMediaType)
+	w.Write(response)
+}
+
+// timestamp answers a timestamp request. Refused requests get a rejection
+// status instead of an http error, like RFC 3161 asks.
+func (s *tsaServer) timestamp(requestDER []byte) tsaResponse {
+	var request tsaRequest
+	rest, err := asn1.Unmarshal(requestDER, &request)
+	if err != nil || len(rest) > 0 {
+		return tsaRejection(tsaFailBadDataFormat, "invalid timestamp request")
+	}
+	if request.Version != 1 {
+		return tsaRejection(tsaFailBadRequest, fmt.Sprintf("unsupported request version %d", request.Version))
+	}
+	hash, err := pkcs7Hash(request.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return tsaRejection(tsaFailBadAlg, err.Error())
+	}
+	if len(request.MessageImprint.HashedMessage) != hash.Size() {
+		return tsaRejection(tsaFailBadDataFormat, "message imprint doesn't match its hash algorithm")
+	}
+	if request.ReqPolicy != nil && !request.ReqPolicy.Equal(s.policy) {
+		return tsaRejection(tsaFailUnacceptedPolicy, "unaccepted policy "+request.ReqPolicy.String())
+	}
+	if len(request.Extensions) > 0 {
+		return tsaRejection(tsaFailUnacceptedExtension, "extensions are not supported")
+	}
+
+	serialNumber, err := randomSerial()
+	if err != nil {
+		log.Warn("Error while timestamping: ", err)
+		return tsaRejection(tsaFailSystemFailure, "system failure")
+	}
+	tstInfo, err := asn1.Marshal(tsaTSTInfo{
+		Version:        1,
+		Policy:         s.policy,
+		MessageImprint: request.MessageImprint,
+		SerialNumber:   serialNumber,
+		GenTime:        time.Now().UTC(),
+		Accuracy:       tsaAccuracy{Seconds: 1},
+		Nonce:          request.Nonce,
+	})
+	if err != nil {
+		log.Warn("Error while timestamping: ", err)
+		return tsaRejection(tsaFailSystemFailure, "system failure")
+	}
+
+	// The token identifies the tsa cert even when it doesn't carry it
+	certHash := sha256.Sum256(s.cert.Raw)
+	signingCertificate, err := newPKCS7Attribute(oidAttributeSigningCertV2, essSigningCertificate{Certs: []essCertId{{CertHash: certHash[:]}}})
+	if err != nil {
+		log.Warn("Error while timestamping: ", err)
+		return tsaRejection(tsaFailSystemFailure, "system failure")
+	}
+	signOpts := pkcs7SignOptions{contentType: oidTSTInfo}
+	if request.CertReq {
+		signOpts.certs = append([]*x509.Certificate{s.cert}, s.chain...)
+	}
+	token, err := signPKCS7Content(tstInfo, signOpts, s.cert, s.key, signingCertificate)
+	if err != nil {
+		log.Warn("Error while timestamping: ", err)
+		return tsaRejection(tsaFailSystemFailure, "system failure")
+	}
+	log.Info("Timestamp ", serialHex(serialNumber), " for ", hash.String(), " ", hex.EncodeToString(request.MessageImprint.HashedMessage))
+	return tsaResponse{
+		Status:         tsaStatusInfo{Status: tsaStatusGranted},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	}
+}
+
+func tsaRejection(failure int, text string) tsaResponse {
+	log.Warn("Timestamp request rejected: ", text)
+	// The DER bit string ends with the failure bit
+	failInfo := asn1.BitString{Bytes: make([]byte, failure/8+1), BitLength: failure + 1}
+	failInfo.Bytes[failure/8] = 0x80 >> (failure % 8)
+	return tsaResponse{Status: tsaStatusInfo{
+		Status:       tsaStatusRejection,
+		StatusString: []asn1.RawValue{{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte(text)}},
+		FailInfo:     failInfo,
+	}}
+}
+
+// checkTsaCrt returns an error unless cert is only valid for timestamping,
+// with a critical extended key usage.
+func checkTsaCrt(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageTimeStamping || len(cert.UnknownExtKeyUsage) > 0 {
+		return fmt.Errorf("the TSA cert %s has to be only valid for timestamping", cert.Subject.String())
+	}
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oidExtKeyUsage) && !extension.Critical {
+			return fmt.Errorf("the extended key usage of the TSA cert %s has to be critical", cert.Subject.String())
+		}
+	}
+	return nil
+}
+
+// VerifyTimestamp checks a timestamp token, its tsa cert against the root ca
+// and, when given, the timestamped data.
+func VerifyTimestamp(opts VerifyTimestampOptions) (*TimestampInfo, error) {
+	tokenDER, err := os.ReadFile(opts.Token)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token: %v", err)
+	}
+	if block, _ := pem.Decode(tokenDER); block != nil {
+		tokenDER = block.Bytes
+	}
+	// A timestamp response wraps the token with a status
+	var response tsaResponse
+	if rest, err := asn1.Unmarshal(tokenDER, &response); err == nil && len(rest) == 0 {
+		if response.Status.Status != tsaStatusGranted && response.Status.Status != tsaStatusGrantedWithMods {
+			var text string
+			for _, statusString := range response.Status.StatusString {
+				text += " " + string(statusString.Bytes)
+			}
+			return nil, fmt.Errorf("timestamp request was rejected with status %d:%s", response.Status.Status, text)
+		}
+		tokenDER = response.TimeStampToken.FullBytes
+	}
+
+	var tsaCerts []*x509.Certificate
+	if opts.TsaCrt != "" {
+		tsaCertsPEM, err := os.ReadFile(opts.TsaCrt)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TSA cert: %v", err)
+		}
+		if tsaCerts, err = parseCertsPEM(tsaCertsPEM); err != nil {
+			return nil, fmt.Errorf("error parsing TSA cert: %v", err)
+		}
+	}
+	signed, err := parsePKCS7SignedWithCerts(tokenDER, nil, tsaCerts)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying token signature: %v", err)
+	}
+	var contentType asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(signed.Attributes[oidAttributeContentType.String()].FullBytes, &contentType); err != nil ||
+		!signed.ContentType.Equal(oidTSTInfo) || !contentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("token content is not a TSTInfo")
+	}
+	var tstInfo tsaTSTInfo
+	if _, err := asn1.Unmarshal(signed.Content, &tstInfo); err != nil {
+		return nil, fmt.Errorf("error parsing TSTInfo: %v", err)
+	}
+	if err := checkEssSigningCertificate(signed); err != nil {
+		return nil, err
+	}
+	if err := checkTsaCrt(signed.Signer); err != nil {
+		return nil, err
+	}
+
+	rootsPEM, err := os.ReadFile(opts.RootCACrt)
+	if err != nil {
+		return nil, fmt.Errorf("error reading root CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificate found in root CA file %s", opts.RootCACrt)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range append(signed.Certs, tsaCerts...) {
+		intermediates.AddCert(cert)
+	}
+	// The tsa cert has to be valid when the token was created, not now
+	if _, err := signed.Signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   tstInfo.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}); err != nil {
+		return nil, fmt.Errorf("TSA %s is not trusted: %v", signed.Signer.Subject.String(), err)
+	}
+
+	hash, err := pkcs7Hash(tstInfo.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	info := &TimestampInfo{
+		GenTime:       tstInfo.GenTime,
+		SerialNumber:  tstInfo.SerialNumber,
+		Policy:        tstInfo.Policy.String(),
+		HashAlgorithm: hash,
+		HashedMessage: tstInfo.MessageImprint.HashedMessage,
+		Tsa:           signed.Signer,
+	}
+	digest := opts.Digest
+	if opts.Data != "" {
+		data, err := os.ReadFile(opts.Data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading data: %v", err)
+		}
+		dataDigest := hash.New()
+		dataDigest.Write(data)
+		digest = hex.EncodeToString(dataDigest.Sum(nil))
+	}
+	if digest != "" {
+		expected, err := hex.DecodeString(digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest: %v", err)
+		}
+		if !bytes.Equal(expected, info.HashedMessage) {
+			return nil, fmt.Errorf("token is for another %s digest: %s", hash.String(), hex.EncodeToString(info.HashedMessage))
+		}
+	}
+	return info, nil
+}
+
+// checkEssSigningCertificate checks the signing certificate attribute, which
+// binds the token to the tsa cert.
+func checkEssSigningCertificate(signed *pkcs7Signed) error {
+	attributeValue, v2 := signed.Attributes[oidAttributeSigningCertV2.String()]
+	if !v2 {
+		var found bool
+		if attributeValue, found = signed.Attributes[oidAttributeSigningCertificate.String()]; !found {
+			return fmt.Errorf("token has no signing certificate attribute")
+		}
+	}
+	var signingCertificate essSigningCertificate
+	if _, err := asn1.Unmarshal(attributeValue.FullBytes, &signingCertificate); err != nil || len(signingCertificate.Certs) == 0 {
+		return fmt.Errorf("invalid signing certificate attribute")
+	}
+	certId := signingCertificate.Certs[0]
+	var certHash []byte
+	switch {
+	case !v2:
+		digest := sha1.Sum(signed.Signer.Raw)
+		certHash = digest[:]
+	case certId.HashAlgorithm.Algorithm == nil:
+		digest := sha256.Sum256(signed.Signer.Raw)
+		certHash = digest[:]
+	default:
+		hash, err := pkcs7Hash(certId.HashAlgorithm.Algorithm)
+		if err != nil {
+			return err
+		}
+		digest := hash.New()
+		digest.Write(signed.Signer.Raw)
+		certHash = digest.Sum(nil)
+	}
+	if !bytes.Equal(certHash, certId.CertHash) {
+		return fmt.Errorf("signing certificate attribute doesn't match the TSA cert")
+	}
+	return nil
+}
+
+// parseOid parses a dotted oid, e.g. 1.2.3.4.1.
+func parseOid(dotted string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, arc := range strings.Split(dotted, ".") {
+		value, err := strconv.Atoi(arc)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid oid %s", dotted)
+		}
+		oid = append(oid, value)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid oid %s", dotted)
+	}
+	return oid, nil
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestTsaServer(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "tsa")
+	tsaOpts := CreateAppCrtOptions{
+		IntermediateCACrt:    intermediateCA.IntermediateCACrt,
+		IntermediateCAKey:    intermediateCA.IntermediateCAKey,
+		RootCACrt:            rootCACrt,
+		CommonName:           "Crtforge TSA",
+		ExtKeyUsages:         []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		CriticalExtKeyUsages: true,
+	}
+	tsaCrt, err := IssueAppCrt(tsaOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTsaCrt(tsaCrt.Cert); err != nil {
+		t.Fatal(err)
+	}
+	intermediateCert, err := readCert(intermediateCA.IntermediateCACrt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsa := &tsaServer{cert: tsaCrt.Cert, key: tsaCrt.PrivateKey, chain: []*x509.Certificate{intermediateCert}, policy: asn1.ObjectIdentifier{1, 2, 3, 4, 1}}
+	server := httptest.NewServer(tsa)
+	defer server.Close()
+
+	data := []byte("release artifact")
+	digest := sha256.Sum256(data)
+	dataFile := configDir + "/artifact"
+	if err := os.WriteFile(dataFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tsaChainFile := configDir + "/tsa-chain.crt"
+	if err := writeCertsPEM(tsaChainFile, tsaCrt.Cert, intermediateCert); err != nil {
+		t.Fatal(err)
+	}
+	sha256Imprint := tsaMessageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, HashedMessage: digest[:]}
+
+	tests := []struct {
+		name    string
+		request tsaRequest
+		// failure is the PKIFailureInfo bit of a rejection, -1 when granted
+		failure int
+		// tsaChain verifies the token with the tsa cert file
+		tsaChain bool
+	}{
+		{"granted with certs", tsaRequest{Version: 1, MessageImprint: sha256Imprint, Nonce: big.NewInt(42), CertReq: true}, -1, false},
+		{"granted without certs", tsaRequest{Version: 1, MessageImprint: sha256Imprint}, -1, true},
+		{"requested policy", tsaRequest{Version: 1, MessageImprint: sha256Imprint, ReqPolicy: asn1.ObjectIdentifier{1, 2, 3, 4, 1}, CertReq: true}, -1, false},
+		{"other policy", tsaRequest{Version: 1, MessageImprint: sha256Imprint, ReqPolicy: asn1.ObjectIdentifier{1, 2, 3, 4, 2}}, tsaFailUnacceptedPolicy, false},
+		{"version 2", tsaRequest{Version: 2, MessageImprint: sha256Imprint}, tsaFailBadRequest, false},
+		{"unknown hash", tsaRequest{Version: 1, MessageImprint: tsaMessageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 3}}, HashedMessage: digest[:]}}, tsaFailBadAlg, false},
+		{"short imprint", tsaRequest{Version: 1, MessageImprint: tsaMessageImprint{HashAlgorithm: sha256Imprint.HashAlgorithm, HashedMessage: digest[:20]}}, tsaFailBadDataFormat, false},
+		{"extensions", tsaRequest{Version: 1, MessageImprint: sha256Imprint, Extensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3}, Value: []byte{5, 0}}}}, tsaFailUnacceptedExtension, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestDER, err := asn1.Marshal(test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := http.Post(server.URL, tsaTimestampQueryMediaType, bytes.NewReader(requestDER))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			responseDER, _ := io.ReadAll(response.Body)
+			var tsaResponse tsaResponse
+			if _, err := asn1.Unmarshal(responseDER, &tsaResponse); err != nil {
+				t.Fatal(err)
+			}
+			if test.failure >= 0 {
+				if tsaResponse.Status.Status != tsaStatusRejection || tsaResponse.Status.FailInfo.At(test.failure) != 1 {
+					t.Errorf("status %d with failInfo %v, want a rejection with bit %d", tsaResponse.Status.Status, tsaResponse.Status.FailInfo, test.failure)
+				}
+				return
+			}
+
+			tokenFile := t.TempDir() + "/token.tsr"
+			if err := os.WriteFile(tokenFile, responseDER, 0600); err != nil {
+				t.Fatal(err)
+			}
+			verifyOpts := VerifyTimestampOptions{Token: tokenFile, Data: dataFile, RootCACrt: rootCACrt}
+			if test.tsaChain {
+				// A token without certs can't be verified without the tsa cert
+				if _, err := VerifyTimestamp(verifyOpts); err == nil {
+					t.Error("token without certs verified without the tsa cert")
+				}
+				verifyOpts.TsaCrt = tsaChainFile
+			}
+			info, err := VerifyTimestamp(verifyOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.Tsa.Equal(tsaCrt.Cert) || info.Policy != "1.2.3.4.1" {
+				t.Errorf("token of %s with policy %s, want the tsa cert and 1.2.3.4.1", info.Tsa.Subject, info.Policy)
+			}
+			verifyOpts.Data = ""
+			verifyOpts.Digest = hex.EncodeToString(make([]byte, sha256.Size))
+			if _, err := VerifyTimestamp(verifyOpts); err == nil {
+				t.Error("token verified for another digest")
+			}
+		})
+	}
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want %d", response.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCheckTsaCrt(t *testing.T) {
+	configDir := t.TempDir()
+	rootCACrt, intermediateCA := createTestCaChain(t, configDir, "lab", "tsa")
+	tests := []struct {
+		name         string
+		extKeyUsages []x509.ExtKeyUsage
+		critical     bool
+		valid        bool
+	}{
+		{"critical timestamping", []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}, true, true},
+		{"not critical", []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}, false, false},
+		{"server auth", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, true, false},
+		{"timestamping and code signing", []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping, x509.ExtKeyUsageCodeSigning}, true, false},
+	}
+	for _, test := range tests {
+		appCrt, err := IssueAppCrt(CreateAppCrtOptions{
+			IntermediateCACrt:    intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:    intermediateCA.IntermediateCAKey,
+			RootCACrt:            rootCACrt,
+			CommonName:           "Crtforge TSA",
+			ExtKeyUsages:         test.extKeyUsages,
+			CriticalExtKeyUsages: test.critical,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkTsaCrt(appCrt.Cert); (err == nil) != test.valid {
+			t.Errorf("%s: checkTsaCrt() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var smimeName string
+var smimePassword string
+var smimeKeyType string
+
+var smimeCmd = &cobra.Command{
+	Use:   "smime user@example.com",
+	Short: "Issue an S/MIME cert to sign and encrypt mail",
+	Long: `Issue an S/MIME cert to sign and encrypt mail.
+The email address is the SAN of the cert, which is only valid for email
+protection. The key and the cert with its chain are also written to a password
+protected pfx file that mail clients can import. Without --password or
+CRTFORGE_PFX_PASSWORD, a random password is generated and printed.`,
+	Args: cobra.ExactArgs(1),
+	Run:  smimeRun,
+}
+
+func smimeRun(cmd *cobra.Command, args []string) {
+	if smimePassword == "" {
+		smimePassword = os.Getenv("CRTFORGE_PFX_PASSWORD")
+	}
+	if smimePassword == "" {
+		randomBytes := make([]byte, 12)
+		if _, err := rand.Read(randomBytes); err != nil {
+			log.Fatal("Error while generating pfx password: ", err)
+		}
+		smimePassword = base64.RawURLEncoding.EncodeToString(randomBytes)
+		log.Info("PFX password: ", smimePassword)
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	if outputDir == "" {
+		outputDir = defaultCADir
+	}
+	services.CreateSmimeCrt(services.CreateSmimeCrtOptions{
+		Email: args[0],
+		Name:  smimeName,
+		AppCrt: services.CreateAppCrtOptions{
+			OutputDir:          outputDir,
+			IntermediateCACnf:  intermediateCA.IntermediateCACnf,
+			IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+			RootCACrt:          defaultCARootCACrt,
+			KeyType:            smimeKeyType,
+			P12Password:        smimePassword,
+			SignatureAlgorithm: signatureAlgorithm,
+		},
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(smimeCmd)
+
+	smimeCmd.Flags().StringVar(&smimeName, "name", "", "Common name of the cert, e.g. the full name. Defaults to the email address.")
+	smimeCmd.Flags().StringVar(&smimePassword, "password", "", "Password of the pfx file. Defaults to CRTFORGE_PFX_PASSWORD.")
+	smimeCmd.Flags().StringVar(&smimeKeyType, "key-type", "rsa", "Key type of the cert: rsa or ecdsa. Encryption with ecdsa keys isn't supported by every mail client.")
+	smimeCmd.Flags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+	smimeCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	addSignatureAlgorithmFlag(smimeCmd)
+	smimeCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
+	addCaSubjectFlags(smimeCmd)
+
+	smimeCmd.Example = `crtforge smime alice@example.com --name "Alice Example" -r mail
+CRTFORGE_PFX_PASSWORD=secret crtforge smime bob@example.com -r mail`
+}
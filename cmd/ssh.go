@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var sshKeyType string
+var sshHostPattern string
+var sshPublicKey string
+var sshCertOutput string
+var sshIdentity string
+var sshPrincipals []string
+var sshValidity string
+var sshCriticalOptions []string
+var sshExtensions []string
+
+// sshCmd groups the commands that manage the ssh cas
+var sshCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Manage ssh certificate authorities next to the root cas",
+}
+
+var sshCaCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the ssh cas of a root ca",
+}
+
+var sshCaCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create the ssh user and host cas of a root ca",
+	Long: `Create the ssh user and host cas of a root ca.
+The keys are stored in the sshCA dir of the root ca. The lines to trust them
+in sshd_config and known_hosts are printed.`,
+	Run: sshCaCreateRun,
+}
+
+var sshSignUserCmd = &cobra.Command{
+	Use:   "sign-user",
+	Short: "Sign a user public key with the ssh user ca",
+	Run:   sshSignRun,
+}
+
+var sshSignHostCmd = &cobra.Command{
+	Use:   "sign-host",
+	Short: "Sign a host public key with the ssh host ca",
+	Run:   sshSignRun,
+}
+
+func sshCaCreateRun(cmd *cobra.Command, args []string) {
+	services.CreateSshCa(services.CreateSshCAOptions{
+		ConfigDirectory: services.CreateCaDir(getConfigDirectory(), caName),
+		KeyType:         sshKeyType,
+		HostPattern:     sshHostPattern,
+	})
+}
+
+func sshSignRun(cmd *cobra.Command, args []string) {
+	if sshPublicKey == "" {
+		log.Fatal("--key is required.")
+	}
+	validity, err := parseValidity(sshValidity)
+	if err != nil {
+		log.Fatal("Invalid validity: ", err)
+	}
+
+	opts := services.SignSshKeyOptions{
+		ConfigDirectory: services.CreateCaDir(getConfigDirectory(), caName),
+		PublicKey:       sshPublicKey,
+		Output:          sshCertOutput,
+		Host:            cmd.Name() == "sign-host",
+		Identity:        sshIdentity,
+		Principals:      sshPrincipals,
+		Validity:        validity,
+		CriticalOptions: sshCriticalOptions,
+	}
+	// Without --extension the ssh-keygen defaults are used
+	if cmd.Flags().Changed("extension") {
+		opts.Extensions = sshExtensions
+	}
+	services.SignSshKey(opts)
+}
+
+// parseValidity parses a duration that may also use d for days and w for weeks.
+func parseValidity(validity string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if count, found := strings.CutSuffix(validity, suffix); found {
+			units, err := strconv.Atoi(count)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(units) * unit, nil
+		}
+	}
+	return time.ParseDuration(validity)
+}
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+	sshCmd.AddCommand(sshCaCmd, sshSignUserCmd, sshSignHostCmd)
+	sshCaCmd.AddCommand(sshCaCreateCmd)
+
+	// Select the root ca the ssh cas belong to
+	sshCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	sshCaCreateCmd.Flags().StringVar(&sshKeyType, "key-type", "ed25519", "Key type of the ssh cas: ed25519, ecdsa or rsa.")
+	sshCaCreateCmd.Flags().StringVar(&sshHostPattern, "host-pattern", "*", "Hosts the host ca is trusted for in known_hosts, e.g. *.example.com")
+
+	for _, signCmd := range []*cobra.Command{sshSignUserCmd, sshSignHostCmd} {
+		signCmd.Flags().StringVarP(&sshPublicKey, "key", "k", "", "Public key file to sign.")
+		signCmd.Flags().StringVarP(&sshCertOutput, "output", "o", "", "Cert file. Defaults to <key>-cert.pub next to the public key.")
+		signCmd.Flags().StringVar(&sshIdentity, "identity", "", "Key id of the cert. Defaults to the key comment.")
+		signCmd.Flags().StringSliceVarP(&sshPrincipals, "principals", "n", nil, "User names or host names the cert is valid for.")
+	}
+	sshSignUserCmd.Flags().StringVarP(&sshValidity, "validity", "V", "24h", "Validity of the cert, e.g. 8h, 30d or 52w.")
+	sshSignHostCmd.Flags().StringVarP(&sshValidity, "validity", "V", "24h", "Validity of the cert, e.g. 8h, 30d or 52w.")
+	sshSignUserCmd.Flags().StringSliceVar(&sshCriticalOptions, "critical-option", nil, "Critical option, e.g. force-command=/usr/bin/backup or source-address=10.0.0.0/8")
+	sshSignUserCmd.Flags().StringSliceVar(&sshExtensions, "extension", nil, "Extension, e.g. permit-pty. Replaces the ssh-keygen default extensions.")
+
+	sshCmd.Example = `crtforge ssh ca create -r corp --host-pattern "*.corp.example.com"
+crtforge ssh sign-user -r corp --key ~/.ssh/id_ed25519.pub --principals alice --validity 8h
+crtforge ssh sign-host -r corp --key /etc/ssh/ssh_host_ed25519_key.pub --principals web1.corp.example.com --validity 52w`
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var svidName string
+var svidKeyType string
+var svidValidity string
+var svidBundleOutput string
+
+// svidCmd groups the SPIFFE commands
+var svidCmd = &cobra.Command{
+	Use:   "svid",
+	Short: "Issue SPIFFE X.509-SVIDs and export trust domain bundles",
+}
+
+var svidIssueCmd = &cobra.Command{
+	Use:   "issue spiffe://example.org/ns/foo/sa/bar",
+	Short: "Issue an X.509-SVID for a spiffe id",
+	Long: `Issue an X.509-SVID for a spiffe id.
+The spiffe id is the only name of the cert, as a uri san. The cert has no
+common name and is valid for server and client authentication.`,
+	Args: cobra.ExactArgs(1),
+	Run:  svidIssueRun,
+}
+
+var svidBundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Export the trust domain bundle of a root ca in the spiffe format",
+	Long: `Export the trust domain bundle of a root ca in the spiffe format.
+The jwks bundle has the root ca and every intermediate ca of the root ca as
+x509-svid authorities.`,
+	Run: svidBundleRun,
+}
+
+func svidIssueRun(cmd *cobra.Command, args []string) {
+	validity, err := parseValidity(svidValidity)
+	if err != nil {
+		log.Fatal("Invalid validity: ", err)
+	}
+
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+	if outputDir == "" {
+		outputDir = defaultCADir
+	}
+	services.CreateSvid(services.CreateSvidOptions{
+		SpiffeId: args[0],
+		AppCrt: services.CreateAppCrtOptions{
+			OutputDir:          outputDir,
+			IntermediateCACnf:  intermediateCA.IntermediateCACnf,
+			IntermediateCACrt:  intermediateCA.IntermediateCACrt,
+			IntermediateCAKey:  intermediateCA.IntermediateCAKey,
+			RootCACrt:          defaultCARootCACrt,
+			AppName:            svidName,
+			KeyType:            svidKeyType,
+			Validity:           validity,
+			SignatureAlgorithm: signatureAlgorithm,
+		},
+	})
+}
+
+func svidBundleRun(cmd *cobra.Command, args []string) {
+	services.ExportSvidBundle(services.SvidBundleOptions{
+		ConfigDirectory: services.CreateCaDir(getConfigDirectory(), caName),
+		Output:          svidBundleOutput,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(svidCmd)
+	svidCmd.AddCommand(svidIssueCmd, svidBundleCmd)
+
+	// Select the root ca of the trust domain
+	svidCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	svidIssueCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	svidIssueCmd.Flags().StringVarP(&outputDir, "output", "o", "", "Set output directory for the certs.")
+	svidIssueCmd.Flags().StringVar(&svidName, "name", "", "Name of the svid files. Defaults to the trust domain and path of the spiffe id.")
+	svidIssueCmd.Flags().StringVar(&svidKeyType, "key-type", "ecdsa", "Key type of the svid: ecdsa, rsa or ed25519.")
+	svidIssueCmd.Flags().StringVarP(&svidValidity, "validity", "V", "24h", "Validity of the svid, e.g. 1h or 7d.")
+	addCaSubjectFlags(svidIssueCmd)
+	addSignatureAlgorithmFlag(svidIssueCmd)
+
+	svidBundleCmd.Flags().StringVarP(&svidBundleOutput, "output", "o", "", "Bundle file. Printed when empty.")
+
+	svidCmd.Example = `crtforge svid issue spiffe://example.org/ns/foo/sa/bar -r example.org --validity 1h
+crtforge svid bundle -r example.org -o bundle.json`
+}
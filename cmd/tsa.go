@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"crtforge/cmd/services"
+	"encoding/hex"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Cli flags
+var tsaListenAddress string
+var tsaPolicy string
+var tsaKeyType string
+var tsaCrtFile string
+var tsaKeyFile string
+var tsaData string
+var tsaDigest string
+var tsaCaFile string
+
+// tsaCmd groups the timestamping commands
+var tsaCmd = &cobra.Command{
+	Use:   "tsa",
+	Short: "Timestamp data with an RFC 3161 timestamping authority",
+}
+
+var tsaServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve an RFC 3161 timestamping authority over http",
+	Long: `Serve an RFC 3161 timestamping authority over http.
+Timestamp queries are posted as application/timestamp-query to any path. The
+tokens are signed with a timestamping cert of the selected intermediate ca,
+which is only valid for timestamping with a critical extended key usage. The
+cert is issued on the first start and reissued a day before it expires.`,
+	Run: tsaServeRun,
+}
+
+var tsaVerifyCmd = &cobra.Command{
+	Use:   "verify <response.tsr>",
+	Short: "Verify a timestamp response or token against the root ca",
+	Long: `Verify a timestamp response or token against the root ca.
+The token signature is checked and the tsa cert has to be a timestamping cert
+issued under the root ca at the time of the timestamp. With --data or --digest
+the token also has to be for the given data.`,
+	Args: cobra.ExactArgs(1),
+	Run:  tsaVerifyRun,
+}
+
+func tsaServeRun(cmd *cobra.Command, args []string) {
+	// A given tsa crt file may have the chain of the tsa cert too
+	chainCrt := tsaCrtFile
+	if tsaCrtFile == "" || tsaKeyFile == "" {
+		defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+		defaultCARootCACrt, intermediateCA := createCaChain(defaultCADir)
+		tsaCrtFile, tsaKeyFile = services.EnsureTsaCrt(services.CreateAppCrtOptions{
+			OutputDir:         defaultCADir,
+			IntermediateCACnf: intermediateCA.IntermediateCACnf,
+			IntermediateCACrt: intermediateCA.IntermediateCACrt,
+			IntermediateCAKey: intermediateCA.IntermediateCAKey,
+			RootCACrt:         defaultCARootCACrt,
+			AppName:           "crtforge-tsa",
+			CommonName:        "Crtforge TSA",
+			KeyType:           tsaKeyType,
+		})
+		chainCrt = defaultCADir + "/crtforge-tsa/fullchain.crt"
+	}
+	services.ServeTsa(services.TsaServerOptions{
+		Listen:   tsaListenAddress,
+		TsaCrt:   tsaCrtFile,
+		TsaKey:   tsaKeyFile,
+		ChainCrt: chainCrt,
+		Policy:   tsaPolicy,
+	})
+}
+
+func tsaVerifyRun(cmd *cobra.Command, args []string) {
+	defaultCADir := services.CreateCaDir(getConfigDirectory(), caName)
+	// Tokens requested without certs are signed by the local tsa cert
+	if _, err := os.Stat(defaultCADir + "/crtforge-tsa/fullchain.crt"); err == nil && tsaCrtFile == "" {
+		tsaCrtFile = defaultCADir + "/crtforge-tsa/fullchain.crt"
+	}
+	rootCaCrt := tsaCaFile
+	if rootCaCrt == "" {
+		rootCaDir := defaultCADir + "/rootCA"
+		rootCaCrt = rootCaDir + "/rootCA.crt"
+		// During a rollover the trust bundle has the old and the new root ca
+		if _, err := os.Stat(rootCaDir + "/trust-bundle.crt"); err == nil {
+			rootCaCrt = rootCaDir + "/trust-bundle.crt"
+		}
+	}
+	info, err := services.VerifyTimestamp(services.VerifyTimestampOptions{
+		Token:     args[0],
+		Data:      tsaData,
+		Digest:    tsaDigest,
+		RootCACrt: rootCaCrt,
+		TsaCrt:    tsaCrtFile,
+	})
+	if err != nil {
+		log.Fatal("Verification failed: ", err)
+	}
+	log.Info("Verified OK, timestamped by ", info.Tsa.Subject.String())
+	log.Info("Time: ", info.GenTime.Format(time.RFC3339))
+	log.Info("Serial: ", info.SerialNumber.Text(16))
+	log.Info("Policy: ", info.Policy)
+	log.Info("Digest: ", info.HashAlgorithm.String(), " ", hex.EncodeToString(info.HashedMessage))
+	if tsaData == "" && tsaDigest == "" {
+		log.Warn("The token wasn't checked against data, use --data or --digest.")
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(tsaCmd)
+	tsaCmd.AddCommand(tsaServeCmd, tsaVerifyCmd)
+
+	tsaCmd.PersistentFlags().StringVarP(&caName, "root-ca", "r", "default", "Set CA Name.")
+
+	tsaServeCmd.Flags().StringVar(&tsaListenAddress, "listen", ":3161", "Address to listen on.")
+	tsaServeCmd.Flags().StringVar(&tsaPolicy, "policy", "1.2.3.4.1", "TSA policy oid of the tokens.")
+	tsaServeCmd.Flags().StringVar(&tsaKeyType, "key-type", "ecdsa", "Key type of the timestamping cert: ecdsa or rsa.")
+	tsaServeCmd.Flags().StringVar(&tsaCrtFile, "tsa-cert", "", "Timestamping crt file, optionally with its chain. Issued by the selected ca when empty.")
+	tsaServeCmd.Flags().StringVar(&tsaKeyFile, "tsa-key", "", "Timestamping key file.")
+	tsaServeCmd.Flags().StringVarP(&intermediateCaName, "intermediate-ca", "i", "intermediateCA", "Set Intermediate CA Name.")
+	addCaSubjectFlags(tsaServeCmd)
+
+	tsaVerifyCmd.Flags().StringVar(&tsaData, "data", "", "Timestamped file to check the token against.")
+	tsaVerifyCmd.Flags().StringVar(&tsaDigest, "digest", "", "Hex digest of the timestamped data to check the token against.")
+	tsaVerifyCmd.Flags().StringVar(&tsaCrtFile, "tsa-cert", "", "Timestamping crt file with its chain, for tokens requested without certs. Defaults to the tsa cert of the root ca.")
+	tsaVerifyCmd.Flags().StringVar(&tsaCaFile, "ca-file", "", "Root ca crt file to verify against, instead of the root ca of --root-ca.")
+
+	tsaCmd.Example = `crtforge tsa serve -r signing --listen :3161
+
+Request a timestamp with openssl and verify it:
+openssl ts -query -data app.tar.gz -sha256 -cert -out app.tsq
+curl -s -H "Content-Type: application/timestamp-query" --data-binary @app.tsq http://localhost:3161 -o app.tsr
+crtforge tsa verify app.tsr --data app.tar.gz -r signing`
+}
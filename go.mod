@@ -13,7 +13,9 @@ require (
 )
 
 require (
-	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/crypto v0.37.0
+	golang.org/x/net v0.39.0
 	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/text v0.24.0 // indirect
 	software.sslmate.com/src/go-pkcs12 v0.5.0
 )